@@ -1,12 +1,18 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"strings"
 
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/ssurb"
 
 	"github.com/gorilla/mux"
@@ -22,19 +28,63 @@ type response struct {
 }
 
 type broadcastPayload struct {
-	Text string `json:"text"`
+	Text    string            `json:"text"`
+	Payload []byte            `json:"payload"`
+	Headers map[string]string `json:"headers"`
 }
 
 type launchClientPayload struct {
 	ReqCount int `json:"reqCount"`
 }
 
+type joinPayload struct {
+	ID          int    `json:"id"`
+	IP          string `json:"ip"`
+	Hostname    string `json:"hostname"`
+	UDPPort     int    `json:"udpPort"`
+	APIPort     int    `json:"apiPort"`
+	MetricsPort int    `json:"metricsPort"`
+	PublicKey   string `json:"publicKey"`
+}
+
+type leavePayload struct {
+	ID int `json:"id"`
+}
+
+type transientFaultsPayload struct {
+	Faults        []ssurb.TransientFault `json:"faults"`
+	Seed          int64                  `json:"seed"`
+	MaxIterations int                    `json:"maxIterations"`
+}
+
 func index(w http.ResponseWriter, r *http.Request) {
 	res := response{Endpoint: "/", StatusCode: 200, Data: map[string]interface{}{"foo": "bar", "trusted": resolver.Trusted()}}
 	json.NewEncoder(w).Encode(res)
 }
 
+// broadcast accepts either a json body with text, base64 encoded payload and headers, or any other content type whose
+// raw body is broadcast as payload. For raw bodies, headers are taken from the request
 func broadcast(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, "application/json") {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+
+		headers := map[string]string{ssurb.HeaderContentType: contentType}
+		if topic := r.URL.Query().Get("topic"); topic != "" {
+			headers[ssurb.HeaderTopic] = topic
+		}
+		if traceID := r.Header.Get("X-Trace-Id"); traceID != "" {
+			headers[ssurb.HeaderTraceID] = traceID
+		}
+
+		msg := ssurb.UrbMessage{Payload: body, Headers: headers}
+		go resolver.UrbBroadcast(&msg)
+		return
+	}
+
 	decoder := json.NewDecoder(r.Body)
 
 	var payload broadcastPayload
@@ -43,7 +93,15 @@ func broadcast(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	msg := ssurb.UrbMessage{Text: payload.Text}
+	for key := range payload.Headers {
+		if ssurb.ReservedHeader(key) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(response{Endpoint: "/broadcast", StatusCode: 400, Data: fmt.Sprintf("header %q is reserved", key)})
+			return
+		}
+	}
+
+	msg := ssurb.UrbMessage{Text: payload.Text, Payload: payload.Payload, Headers: payload.Headers}
 	go resolver.UrbBroadcast(&msg)
 }
 
@@ -72,17 +130,137 @@ func launchClient(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
-// SetUp launches the API and registers all handlers
-func SetUp(id int, r *ssurb.Resolver) {
+func injectTransientFaults(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var payload transientFaultsPayload
+	err := decoder.Decode(&payload)
+	if err != nil {
+		panic(err)
+	}
+
+	// inject all kinds of faults if none are given
+	if len(payload.Faults) == 0 {
+		payload.Faults = ssurb.TransientFaults
+	}
+	if payload.MaxIterations <= 0 {
+		payload.MaxIterations = 1000
+	}
+
+	err = resolver.InjectTransientFaults(rand.New(rand.NewSource(payload.Seed)), payload.Faults...)
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(response{Endpoint: "/faults/transient", StatusCode: 400, Data: err.Error()})
+		return
+	}
+
+	// measure convergence in the background, the result is logged and exposed as a metric
+	go resolver.MeasureConvergence(context.Background(), payload.MaxIterations)
+
+	res := response{Endpoint: "/faults/transient", StatusCode: 200, Data: map[string]interface{}{"faults": payload.Faults}}
+	json.NewEncoder(w).Encode(res)
+}
+
+func membership(w http.ResponseWriter, r *http.Request) {
+	epoch, processors := resolver.GetReconfModule().View()
+	res := response{Endpoint: "/membership", StatusCode: 200, Data: map[string]interface{}{"epoch": epoch, "processors": processors}}
+	json.NewEncoder(w).Encode(res)
+}
+
+func join(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var payload joinPayload
+	err := decoder.Decode(&payload)
+	if err != nil {
+		panic(err)
+	}
+
+	p := models.Processor{ID: payload.ID, Hostname: payload.Hostname, IPString: payload.IP, IP: helpers.IPStringToSlice(payload.IP),
+		UDPPort: payload.UDPPort, APIPort: payload.APIPort, MetricsPort: payload.MetricsPort}
+	if p.IP == nil {
+		if payload.IP != "" || payload.Hostname == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(response{Endpoint: "/membership/join", StatusCode: 400, Data: "a valid ip or a resolvable hostname is required"})
+			return
+		}
+		if p.IP, err = helpers.ResolveHostname(payload.Hostname); err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(response{Endpoint: "/membership/join", StatusCode: 400, Data: err.Error()})
+			return
+		}
+	}
+	if err := p.ValidatePorts(); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(response{Endpoint: "/membership/join", StatusCode: 400, Data: err.Error()})
+		return
+	}
+	if payload.PublicKey != "" {
+		if p.PublicKey, err = helpers.ParsePublicKey(payload.PublicKey); err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(response{Endpoint: "/membership/join", StatusCode: 400, Data: err.Error()})
+			return
+		}
+	}
+	if err := resolver.GetReconfModule().Join(p); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(response{Endpoint: "/membership/join", StatusCode: 400, Data: err.Error()})
+		return
+	}
+
+	membership(w, r)
+}
+
+func leave(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var payload leavePayload
+	err := decoder.Decode(&payload)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := resolver.GetReconfModule().Leave(payload.ID); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(response{Endpoint: "/membership/leave", StatusCode: 400, Data: err.Error()})
+		return
+	}
+
+	membership(w, r)
+}
+
+// authorized wraps handler so that it is only called for requests carrying token as bearer token
+func authorized(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(response{Endpoint: r.URL.Path, StatusCode: 401, Data: "a valid bearer token is required"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// SetUp launches the API and registers all handlers. The ones changing the membership are only registered if token is
+// set and require it as bearer token, the ones injecting faults into the state of the node only if debug is set
+func SetUp(addr string, r *ssurb.Resolver, debug bool, token string) {
 	router := mux.NewRouter().StrictSlash(true)
 
 	router.HandleFunc("/", index).Methods("GET")
 	router.HandleFunc("/client/launch", launchClient).Methods("POST")
 	router.HandleFunc("/broadcast", broadcast).Methods("POST")
+	router.HandleFunc("/membership", membership).Methods("GET")
+	if token != "" {
+		router.HandleFunc("/membership/join", authorized(token, join)).Methods("POST")
+		router.HandleFunc("/membership/leave", authorized(token, leave)).Methods("POST")
+	}
+	if debug {
+		log.Println("Debug endpoints are enabled, never do this in production")
+		router.HandleFunc("/faults/transient", injectTransientFaults).Methods("POST")
+	}
 
-	port := 4000 + id
 	resolver = r
-	ipString := helpers.GetIP()
-	log.Printf("Launching API on port %d", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", ipString, port), router))
+	log.Printf("Launching API on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, router))
 }
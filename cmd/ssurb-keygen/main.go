@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+)
+
+// ssurb-keygen writes a new private key to the given file, to be passed to ssurb as -key-file, and prints the public
+// key to be listed as public_key of the processor in the config or hosts file of every node. With -cluster, it prints
+// a new cluster key to be added to the cluster key file of every node instead
+func main() {
+	out := flag.String("out", "", "file to write the private key to")
+	cluster := flag.Bool("cluster", false, "print a new cluster key instead of creating a key pair")
+	flag.Parse()
+
+	if *cluster {
+		key := make([]byte, helpers.ClusterKeySize)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return
+	}
+
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "-out is required")
+		os.Exit(2)
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*out, []byte(base64.StdEncoding.EncodeToString(private.Seed())+"\n"), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(public))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/api"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/config"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/ssurb"
+)
+
+func main() {
+	// load config from file, env vars and flags
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	id := cfg.ID
+
+	// setup logging
+	log.SetPrefix(fmt.Sprintf("[Node %d]: ", id))
+	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
+	log.Printf("Instance %d starting\n", id)
+
+	// pick the wire codec, json is handy when debugging
+	if err := helpers.SelectCodec(cfg.Codec); err != nil {
+		log.Fatal(err)
+	}
+
+	// init node, which wires together all modules and communication
+	node, err := ssurb.NewNode(cfg.NodeConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := node.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	defer node.Stop()
+
+	// deliveries are only consumed through metrics for now
+	go func() {
+		for range node.Deliveries() {
+		}
+	}()
+
+	// launch API
+	go api.SetUp(cfg.Addr(cfg.APIPort), node.Resolver, cfg.Debug, cfg.APIToken)
+
+	// instrument application with prometheus metrics
+	go func() {
+		addr := cfg.Addr(cfg.MetricsPort)
+		http.Handle("/metrics", promhttp.Handler())
+		log.Printf("Launching Prometheus server on %s", addr)
+		http.ListenAndServe(addr, nil)
+	}()
+
+	// run until interrupted, reloading the cluster keys on SIGHUP so that they can be rotated without a restart
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+		if err := reloadClusterKeys(cfg, node); err != nil {
+			log.Printf("Could not reload cluster keys: %v", err)
+		}
+	}
+	log.Printf("Instance %d shutting down\n", id)
+}
+
+// reloadClusterKeys reads the cluster key file again and installs its keys in node
+func reloadClusterKeys(cfg *config.Config, node *ssurb.Node) error {
+	if cfg.ClusterKeyFile == "" {
+		return fmt.Errorf("no cluster key file configured")
+	}
+	keys, err := helpers.ReadClusterKeys(cfg.ClusterKeyFile)
+	if err != nil {
+		return err
+	}
+	if err := node.SetClusterKeys(keys); err != nil {
+		return err
+	}
+	log.Printf("Reloaded %d cluster keys from %s", len(keys), cfg.ClusterKeyFile)
+	return nil
+}
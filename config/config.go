@@ -0,0 +1,336 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/ssurb"
+)
+
+// Config is everything needed to start a node, see Load for where it is read from
+type Config struct {
+	// ID is the id of this processor, must be part of Peers
+	ID int
+	// HostsFile is parsed for the peers if none are listed in the config file
+	HostsFile string
+	// Peers is the set of all processors in the system, including this one
+	Peers []models.Processor
+	// BindIP is the address all servers bind to, empty binds to all addresses
+	BindIP string
+	// UDPPort, APIPort and MetricsPort default to the ports of this processor in Peers
+	UDPPort     int
+	APIPort     int
+	MetricsPort int
+	// DataDir optionally persists the urb state in this directory
+	DataDir string
+	// Codec is the wire codec, either binary or json
+	Codec string
+	// Ordering is the order messages are delivered in, either none, fifo, causal or total
+	Ordering string
+	// Params are the protocol tunables
+	Params ssurb.Params
+	// KeyFile optionally holds the private key of this processor, which enables authentication of all messages. The
+	// clocks of all processors must then be synced within constants.ReplayWindow
+	KeyFile string
+	// PrivateKey is read from KeyFile by Load
+	PrivateKey ed25519.PrivateKey
+	// ClusterKeyFile optionally lists the keys shared by all processors, which enables encryption of all messages
+	ClusterKeyFile string
+	// ClusterKeys are read from ClusterKeyFile by Load
+	ClusterKeys []*helpers.ClusterKey
+	// APITokenFile optionally holds the token that enables the api endpoints changing the membership, such as
+	// /membership/join. Requests to them must carry it as bearer token
+	APITokenFile string
+	// APIToken is read from APITokenFile by Load
+	APIToken string
+	// Debug enables the api endpoints that corrupt the state of the node, such as /faults/transient. They are not
+	// authenticated, so it must never be enabled in production
+	Debug bool
+}
+
+// Default returns the config used for everything not set in the config file, env vars or flags
+func Default() *Config {
+	return &Config{
+		ID:        -1,
+		HostsFile: constants.HostsFilePath,
+		Codec:     "binary",
+		Ordering:  ssurb.NoOrdering.String(),
+		Params: ssurb.Params{
+			ModuleRunSleepDuration: constants.ModuleRunSleepDuration,
+			HeartbeatInterval:      constants.HeartbeatInterval,
+			ThetafdW:               constants.ThetafdW,
+			BufferUnitSize:         constants.BufferUnitSize,
+			SnapshotInterval:       constants.SnapshotInterval,
+		},
+	}
+}
+
+// Load builds the config from the defaults, the config file given by -config, the ID, IP, ENV, CODEC and DATA_DIR
+// env vars and the remaining flags in args, in increasing order of precedence. If no peers are listed in the config
+// file, they are parsed from the hosts file. Returns an error if the config is invalid
+func Load(args []string) (*Config, error) {
+	// a first pass only finds the config file, but reports all malformed flags
+	var path string
+	if err := Default().flagSet(&path, flag.ContinueOnError).Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	// flags are bound to the loaded config, so only the ones given overwrite it
+	fs := c.flagSet(&path, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if len(c.Peers) == 0 {
+		peers, err := helpers.ParseHostsFileAt(c.HostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse hosts file %s: %v", c.HostsFile, err)
+		}
+		c.Peers = peers
+	}
+	c.resolvePeers()
+	c.setDefaultPorts()
+
+	if c.KeyFile != "" {
+		key, err := helpers.ReadPrivateKey(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read key file: %v", err)
+		}
+		c.PrivateKey = key
+	}
+	if c.ClusterKeyFile != "" {
+		keys, err := helpers.ReadClusterKeys(c.ClusterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read cluster key file: %v", err)
+		}
+		c.ClusterKeys = keys
+	}
+	if c.APITokenFile != "" {
+		content, err := ioutil.ReadFile(c.APITokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read api token file: %v", err)
+		}
+		if c.APIToken = strings.TrimSpace(string(content)); c.APIToken == "" {
+			return nil, fmt.Errorf("api token file %s is empty", c.APITokenFile)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// flagSet returns the flags of the ssurb command bound to the fields of c, path is bound to -config
+func (c *Config) flagSet(path *string, handling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet("ssurb", handling)
+	fs.StringVar(path, "config", "", "path to the config file")
+	fs.IntVar(&c.ID, "id", c.ID, "id of this processor")
+	fs.StringVar(&c.HostsFile, "hosts", c.HostsFile, "hosts file listing all processors, used if the config file lists no peers")
+	fs.StringVar(&c.BindIP, "bind-ip", c.BindIP, "address to bind all servers to, binds to all addresses if empty")
+	fs.IntVar(&c.UDPPort, "udp-port", c.UDPPort, "port of the udp server, defaults to the one of this processor in the peers")
+	fs.IntVar(&c.APIPort, "api-port", c.APIPort, "port of the api, defaults to the one of this processor in the peers")
+	fs.IntVar(&c.MetricsPort, "metrics-port", c.MetricsPort, "port of the prometheus metrics, defaults to the one of this processor in the peers")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "directory to persist the urb state in, not persisted if empty")
+	fs.StringVar(&c.Codec, "codec", c.Codec, "wire codec, either binary or json")
+	fs.StringVar(&c.Ordering, "ordering", c.Ordering, "order messages are delivered in, either none, fifo, causal or total")
+	fs.StringVar(&c.KeyFile, "key-file", c.KeyFile, "file holding the private key of this processor, messages are not authenticated if empty")
+	fs.StringVar(&c.ClusterKeyFile, "cluster-key-file", c.ClusterKeyFile, "file listing the keys shared by all processors, messages are not encrypted if empty")
+	fs.StringVar(&c.APITokenFile, "api-token-file", c.APITokenFile, "file holding the token required by the api endpoints changing the membership, they are disabled if empty")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "enable the unauthenticated api endpoints injecting faults into the state of this processor")
+	fs.DurationVar(&c.Params.ModuleRunSleepDuration, "module-run-sleep-duration", c.Params.ModuleRunSleepDuration, "duration the urb module sleeps between iterations")
+	fs.DurationVar(&c.Params.HeartbeatInterval, "heartbeat-interval", c.Params.HeartbeatInterval, "duration between heartbeats of the failure detectors")
+	fs.IntVar(&c.Params.ThetafdW, "thetafd-w", c.Params.ThetafdW, "threshold of the theta failure detector")
+	fs.IntVar(&c.Params.BufferUnitSize, "buffer-unit-size", c.Params.BufferUnitSize, "number of messages allowed in the buffer per processor")
+	fs.IntVar(&c.Params.SnapshotInterval, "snapshot-interval", c.Params.SnapshotInterval, "number of urb iterations between snapshots of the persisted state")
+	return fs
+}
+
+// LoadFile overwrites c with everything set in the toml config file at path
+func (c *Config) LoadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = c.decode(string(content))
+	}
+	if err != nil {
+		return fmt.Errorf("Could not load config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// resolvePeers looks up the ip of every peer that only has a hostname. Peers that can not be resolved yet are kept
+// without ip, sending to them resolves the hostname again
+func (c *Config) resolvePeers() {
+	for i, p := range c.Peers {
+		if p.IP != nil || p.IPString != "" || p.Hostname == "" {
+			continue
+		}
+		ip, err := helpers.ResolveHostname(p.Hostname)
+		if err != nil {
+			log.Printf("Could not resolve %s of processor %d: %v", p.Hostname, p.ID, err)
+		}
+		c.Peers[i].IP = ip
+	}
+}
+
+// loadEnv overwrites c with the env vars that are set, kept for backwards compatibility
+func (c *Config) loadEnv() error {
+	if idStr, exists := os.LookupEnv("ID"); exists {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("Badly formatted ID env var %s", idStr)
+		}
+		c.ID = id
+	}
+	if ip := helpers.GetIP(); ip != "" {
+		c.BindIP = ip
+	}
+	if codec, exists := os.LookupEnv(constants.CodecEnvVar); exists {
+		c.Codec = codec
+	}
+	if dataDir := helpers.GetDataDir(); dataDir != "" {
+		c.DataDir = dataDir
+	}
+	return nil
+}
+
+// setDefaultPorts sets the ports that are not configured to the ones of this processor in the peers
+func (c *Config) setDefaultPorts() {
+	self := models.Processor{ID: c.ID}
+	for _, p := range c.Peers {
+		if p.ID == c.ID {
+			self = p
+		}
+	}
+
+	if c.UDPPort == 0 {
+		c.UDPPort = self.GetUDPPort()
+	}
+	if c.APIPort == 0 {
+		c.APIPort = self.GetAPIPort()
+	}
+	if c.MetricsPort == 0 {
+		c.MetricsPort = self.GetMetricsPort()
+	}
+}
+
+// Validate returns an error listing everything that is wrong with the config
+func (c *Config) Validate() error {
+	problems := []string{}
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.ID < 0 {
+		problem("id must be set to a non-negative integer, got %d", c.ID)
+	}
+	if len(c.Peers) == 0 {
+		problem("no peers configured")
+	}
+	ids := map[int]bool{}
+	for _, p := range c.Peers {
+		if p.ID < 0 {
+			problem("peer id must be a non-negative integer, got %d", p.ID)
+		} else if ids[p.ID] {
+			problem("peer %d listed twice", p.ID)
+		}
+		ids[p.ID] = true
+		if p.IPString == "" && p.Hostname == "" {
+			problem("peer %d needs either a hostname or an ip", p.ID)
+		} else if p.IPString != "" && p.IP == nil {
+			problem("peer %d has invalid ip %q", p.ID, p.IPString)
+		}
+		if err := p.ValidatePorts(); err != nil {
+			problem("%v", err)
+		}
+		if c.PrivateKey != nil && p.PublicKey == nil {
+			problem("peer %d needs a public_key since key_file is set", p.ID)
+		} else if c.PrivateKey != nil && p.ID == c.ID && !bytes.Equal(p.PublicKey, c.PrivateKey.Public().(ed25519.PublicKey)) {
+			problem("public_key of peer %d does not match key_file", p.ID)
+		}
+	}
+	if c.ID >= 0 && len(c.Peers) > 0 && !ids[c.ID] {
+		problem("id %d is not one of the peers", c.ID)
+	}
+
+	if c.BindIP != "" && net.ParseIP(c.BindIP) == nil {
+		problem("bind_ip %q is not an ip address", c.BindIP)
+	}
+	ports := []struct {
+		name string
+		port int
+	}{{"udp_port", c.UDPPort}, {"api_port", c.APIPort}, {"metrics_port", c.MetricsPort}}
+	for _, p := range ports {
+		if p.port < 1 || p.port > 65535 {
+			problem("%s must be between 1 and 65535, got %d", p.name, p.port)
+		}
+	}
+	if c.APIPort == c.MetricsPort {
+		problem("api_port and metrics_port must differ, both are %d", c.APIPort)
+	}
+	if c.Codec != "binary" && c.Codec != "json" {
+		problem("codec must be binary or json, got %q", c.Codec)
+	}
+	if _, err := ssurb.ParseOrdering(c.Ordering); err != nil {
+		problem("ordering must be none, fifo, causal or total, got %q", c.Ordering)
+	}
+
+	if c.Params.ModuleRunSleepDuration <= 0 {
+		problem("protocol.module_run_sleep_duration must be positive, got %v", c.Params.ModuleRunSleepDuration)
+	}
+	if c.Params.HeartbeatInterval <= 0 {
+		problem("protocol.heartbeat_interval must be positive, got %v", c.Params.HeartbeatInterval)
+	}
+	if c.Params.ThetafdW <= 0 {
+		problem("protocol.thetafd_w must be positive, got %d", c.Params.ThetafdW)
+	}
+	if c.Params.BufferUnitSize <= 0 {
+		problem("protocol.buffer_unit_size must be positive, got %d", c.Params.BufferUnitSize)
+	}
+	if c.Params.SnapshotInterval <= 0 {
+		problem("protocol.snapshot_interval must be positive, got %d", c.Params.SnapshotInterval)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// NodeConfig returns the config of the node run by the ssurb command
+func (c *Config) NodeConfig() ssurb.Config {
+	var ip net.IP
+	if c.BindIP != "" {
+		ip = net.ParseIP(c.BindIP)
+	}
+	ordering, _ := ssurb.ParseOrdering(c.Ordering)
+	return ssurb.Config{ID: c.ID, Processors: c.Peers, IP: ip, Port: c.UDPPort, DataDir: c.DataDir, Params: c.Params,
+		Ordering: ordering, PrivateKey: c.PrivateKey, ClusterKeys: c.ClusterKeys}
+}
+
+// Addr returns the address of a server bound to BindIP and port
+func (c *Config) Addr(port int) string {
+	return net.JoinHostPort(c.BindIP, strconv.Itoa(port))
+}
@@ -0,0 +1,328 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/ssurb"
+)
+
+const validConfig = `
+# node 1 out of three
+id = 1
+bind_ip = "127.0.0.1"   # only reachable locally
+data_dir = '/tmp/ssurb#1'  # literal string
+codec = "json"
+ordering = "fifo"
+
+[protocol]
+module_run_sleep_duration = "100ms"
+heartbeat_interval = "2s"
+thetafd_w = 50
+buffer_unit_size = 20
+snapshot_interval = 10
+
+[[peers]]
+id = 0
+hostname = "localhost"
+ip = "127.0.0.1"
+
+[[peers]]
+id = 1
+hostname = "localhost"
+ip = "127.0.0.1"
+
+[[peers]]
+id = 2
+hostname = "localhost"
+ip = "127.0.0.1"
+`
+
+// writeFile writes content to a file called name in a new temp dir and returns its path
+func writeFile(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "ssurb")
+	assert.NilError(t, err)
+	path := filepath.Join(dir, name)
+	assert.NilError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeFile(t, "ssurb.toml", validConfig)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load([]string{"-config", path})
+	assert.NilError(t, err)
+	assert.Equal(t, c.ID, 1)
+	assert.Equal(t, c.BindIP, "127.0.0.1")
+	assert.Equal(t, c.DataDir, "/tmp/ssurb#1")
+	assert.Equal(t, c.Codec, "json")
+	assert.Equal(t, c.Ordering, "fifo")
+	assert.Equal(t, c.Debug, false)
+	assert.DeepEqual(t, c.Params, ssurb.Params{ModuleRunSleepDuration: 100 * time.Millisecond, HeartbeatInterval: 2 * time.Second, ThetafdW: 50, BufferUnitSize: 20, SnapshotInterval: 10})
+	assert.Equal(t, len(c.Peers), 3)
+	assert.DeepEqual(t, c.Peers[2], models.Processor{ID: 2, Hostname: "localhost", IPString: "127.0.0.1", IP: []byte{127, 0, 0, 1}})
+
+	// ports not configured are derived from the id
+	assert.Equal(t, c.UDPPort, 4001)
+	assert.Equal(t, c.APIPort, 4001)
+	assert.Equal(t, c.MetricsPort, 2113)
+
+	nodeConfig := c.NodeConfig()
+	assert.Equal(t, nodeConfig.Port, 4001)
+	assert.Equal(t, nodeConfig.Params, c.Params)
+	assert.Equal(t, nodeConfig.Ordering, ssurb.FIFOOrdering)
+	assert.Assert(t, nodeConfig.IP.Equal([]byte{127, 0, 0, 1}))
+}
+
+func TestFlagsOverrideConfigFile(t *testing.T) {
+	path := writeFile(t, "ssurb.toml", validConfig)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load([]string{"-thetafd-w", "7", "-config", path, "-id", "2", "-udp-port", "5000", "-heartbeat-interval", "500ms", "-debug"})
+	assert.NilError(t, err)
+	assert.Equal(t, c.Debug, true)
+	assert.Equal(t, c.ID, 2)
+	assert.Equal(t, c.UDPPort, 5000)
+	assert.Equal(t, c.APIPort, 4002)
+	assert.Equal(t, c.Params.ThetafdW, 7)
+	assert.Equal(t, c.Params.HeartbeatInterval, 500*time.Millisecond)
+
+	// everything else is still taken from the file
+	assert.Equal(t, c.Codec, "json")
+	assert.Equal(t, c.Params.BufferUnitSize, 20)
+}
+
+func TestLoadHostsFileWithoutPeers(t *testing.T) {
+	path := writeFile(t, "hosts.txt", "0,localhost,127.0.0.1\n1,localhost,127.0.0.1\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// without a config file, all tunables keep their defaults
+	c, err := Load([]string{"-id", "0", "-hosts", path})
+	assert.NilError(t, err)
+	assert.Equal(t, len(c.Peers), 2)
+	assert.DeepEqual(t, c.Params, Default().Params)
+
+	_, err = Load([]string{"-id", "0", "-hosts", path + ".missing"})
+	assert.ErrorContains(t, err, "Could not parse hosts file")
+}
+
+func TestLoadReportsAllValidationErrors(t *testing.T) {
+	path := writeFile(t, "ssurb.toml", `
+id = 3
+bind_ip = "localhost"
+api_port = 70000
+metrics_port = 70000
+codec = "xml"
+ordering = "lifo"
+
+[protocol]
+thetafd_w = 0
+heartbeat_interval = "-1s"
+
+[[peers]]
+id = 0
+ip = "127.0.0.1"
+
+[[peers]]
+id = 0
+ip = "999.0.0.1"
+
+[[peers]]
+id = 63000
+ip = "127.0.0.1"
+metrics_port = 9000
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	_, err := Load([]string{"-config", path, "-buffer-unit-size", "-1"})
+	assert.Assert(t, err != nil)
+	for _, problem := range []string{
+		`peer 0 listed twice`,
+		`peer 0 has invalid ip "999.0.0.1"`,
+		`udp port 67000 of processor 63000 is not between 1 and 65535`,
+		`id 3 is not one of the peers`,
+		`bind_ip "localhost" is not an ip address`,
+		`api_port must be between 1 and 65535, got 70000`,
+		`api_port and metrics_port must differ`,
+		`codec must be binary or json, got "xml"`,
+		`ordering must be none, fifo, causal or total, got "lifo"`,
+		`protocol.heartbeat_interval must be positive, got -1s`,
+		`protocol.thetafd_w must be positive, got 0`,
+		`protocol.buffer_unit_size must be positive, got -1`,
+	} {
+		assert.Assert(t, strings.Contains(err.Error(), problem), "%q not in %v", problem, err)
+	}
+}
+
+func TestLoadRejectsMalformedInput(t *testing.T) {
+	cases := map[string]string{
+		"id = \"one\"":   `cannot load TOML value of type string into a Go integer`,
+		"id = 1\nid = 2": `Near line 2 (last key parsed 'id'): Key 'id' has already been defined`,
+		"port = 4000":    `unknown keys port`,
+		"[protocol]\nthetafd_w = 1\nfoo = \"bar\"": `unknown keys protocol.foo`,
+		"[protocol]\nheartbeat_interval = 1000":    `must be a duration such as "250ms", got "1000"`,
+		"[nodes]":                                  `unknown keys nodes`,
+		"[[peers]]\nid = 0\nfoo = 1":               `unknown keys peers.foo`,
+		"[protocol]\n[protocol]":                   `Near line 2 (last key parsed ''): Key 'protocol' has already been defined`,
+		"[[peers]]\nid = 0\nip = 1":                `cannot load TOML value of type int64 into a Go string`,
+		"codec = \"json":                           `Near line 1 (last key parsed 'codec'): unexpected EOF`,
+		"id =":                                     `Near line 1 (last key parsed 'id'): expected value`,
+		"[protocol":                                `Near line 1 (last key parsed ''): expected '.' or ']' to end table name`,
+		"bind ip = \"127.0.0.1\"":                  `Near line 1 (last key parsed 'bind'): expected key separator '='`,
+		"debug = \"yes\"":                          `cannot load TOML value of type string into a Go boolean`,
+	}
+	for content, expected := range cases {
+		path := writeFile(t, "ssurb.toml", content)
+		err := Default().LoadFile(path)
+		os.RemoveAll(filepath.Dir(path))
+
+		assert.ErrorContains(t, err, expected, "loading %q", content)
+	}
+
+	// malformed flags are reported as well
+	_, err := Load([]string{"-thetafd-w", "many"})
+	assert.ErrorContains(t, err, "invalid value")
+}
+
+func TestLoadPeerPortsAndHostnames(t *testing.T) {
+	path := writeFile(t, "ssurb.toml", `
+id = 1
+
+[[peers]]
+id = 0
+hostname = "node0.example.com"
+
+[[peers]]
+id = 1
+ip = "::1"
+udp_port = 5000
+api_port = 5001
+metrics_port = 5002
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	helpers.LookupIP = func(host string) ([]net.IP, error) {
+		t.Fatalf("looked up %s while loading the config file", host)
+		return nil, nil
+	}
+	defer func() { helpers.LookupIP = net.LookupIP }()
+
+	// loading the config file alone does not resolve hostnames, Load does
+	c := Default()
+	assert.NilError(t, c.LoadFile(path))
+	assert.DeepEqual(t, c.Peers[0], models.Processor{ID: 0, Hostname: "node0.example.com"})
+
+	helpers.LookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+	c, err := Load([]string{"-config", path})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, c.Peers[0], models.Processor{ID: 0, Hostname: "node0.example.com", IP: []byte{10, 0, 0, 1}})
+
+	// the ports of this processor are taken from its peer entry
+	assert.Equal(t, c.UDPPort, 5000)
+	assert.Equal(t, c.APIPort, 5001)
+	assert.Equal(t, c.MetricsPort, 5002)
+}
+
+func TestAddr(t *testing.T) {
+	c := Default()
+	assert.Equal(t, c.Addr(4000), ":4000")
+	c.BindIP = "127.0.0.1"
+	assert.Equal(t, c.Addr(4000), "127.0.0.1:4000")
+	c.BindIP = "::1"
+	assert.Equal(t, c.Addr(4000), "[::1]:4000")
+	assert.Assert(t, c.NodeConfig().IP.Equal(net.IPv6loopback))
+}
+
+func TestLoadKeys(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NilError(t, err)
+	otherPublic, _, err := ed25519.GenerateKey(nil)
+	assert.NilError(t, err)
+	keyPath := writeFile(t, "node0.key", base64.StdEncoding.EncodeToString(private.Seed()))
+	defer os.RemoveAll(filepath.Dir(keyPath))
+
+	path := writeFile(t, "ssurb.toml", fmt.Sprintf(`
+id = 0
+key_file = %q
+
+[[peers]]
+id = 0
+ip = "127.0.0.1"
+public_key = %q
+
+[[peers]]
+id = 1
+ip = "127.0.0.1"
+public_key = %q
+`, keyPath, base64.StdEncoding.EncodeToString(public), base64.StdEncoding.EncodeToString(otherPublic)))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load([]string{"-config", path})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, c.PrivateKey, private)
+	assert.DeepEqual(t, c.Peers[1].PublicKey, []byte(otherPublic))
+	assert.DeepEqual(t, c.NodeConfig().PrivateKey, private)
+
+	// every peer needs a public key, and the own one must match the private key
+	hostsPath := writeFile(t, "hosts.txt", fmt.Sprintf("0,localhost,127.0.0.1,,,,%s\n1,localhost,127.0.0.1\n", base64.StdEncoding.EncodeToString(otherPublic)))
+	defer os.RemoveAll(filepath.Dir(hostsPath))
+	_, err = Load([]string{"-id", "0", "-hosts", hostsPath, "-key-file", keyPath})
+	assert.ErrorContains(t, err, "public_key of peer 0 does not match key_file; peer 1 needs a public_key since key_file is set")
+
+	_, err = Load([]string{"-id", "0", "-hosts", hostsPath, "-key-file", keyPath + ".missing"})
+	assert.ErrorContains(t, err, "Could not read key file")
+	path = writeFile(t, "ssurb.toml", "[[peers]]\nid = 3\npublic_key = \"AAEC\"")
+	defer os.RemoveAll(filepath.Dir(path))
+	err = Default().LoadFile(path)
+	assert.ErrorContains(t, err, "peer 3: public key must be 32 bytes, got 3")
+}
+
+func TestLoadClusterKeys(t *testing.T) {
+	hostsPath := writeFile(t, "hosts.txt", "0,localhost,127.0.0.1\n")
+	defer os.RemoveAll(filepath.Dir(hostsPath))
+	keysPath := writeFile(t, "cluster.keys", base64.StdEncoding.EncodeToString(make([]byte, 32))+"\n")
+	defer os.RemoveAll(filepath.Dir(keysPath))
+
+	c, err := Load([]string{"-id", "0", "-hosts", hostsPath, "-cluster-key-file", keysPath})
+	assert.NilError(t, err)
+	assert.Equal(t, len(c.ClusterKeys), 1)
+	assert.Equal(t, len(c.NodeConfig().ClusterKeys), 1)
+
+	_, err = Load([]string{"-id", "0", "-hosts", hostsPath, "-cluster-key-file", hostsPath})
+	assert.ErrorContains(t, err, "Could not read cluster key file: Malformed line 1")
+}
+
+func TestLoadAPIToken(t *testing.T) {
+	hostsPath := writeFile(t, "hosts.txt", "0,localhost,127.0.0.1\n")
+	defer os.RemoveAll(filepath.Dir(hostsPath))
+	tokenPath := writeFile(t, "api.token", "secret\n")
+	defer os.RemoveAll(filepath.Dir(tokenPath))
+
+	c, err := Load([]string{"-id", "0", "-hosts", hostsPath})
+	assert.NilError(t, err)
+	assert.Equal(t, c.APIToken, "")
+
+	c, err = Load([]string{"-id", "0", "-hosts", hostsPath, "-api-token-file", tokenPath})
+	assert.NilError(t, err)
+	assert.Equal(t, c.APIToken, "secret")
+
+	emptyPath := writeFile(t, "api.token", "\n")
+	defer os.RemoveAll(filepath.Dir(emptyPath))
+	_, err = Load([]string{"-id", "0", "-hosts", hostsPath, "-api-token-file", emptyPath})
+	assert.ErrorContains(t, err, "is empty")
+}
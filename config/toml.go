@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// file is the layout of a config file. It is filled with the values of the config it is decoded into, so that keys that
+// are not set in the file keep them
+type file struct {
+	ID             int           `toml:"id"`
+	HostsFile      string        `toml:"hosts_file"`
+	BindIP         string        `toml:"bind_ip"`
+	UDPPort        int           `toml:"udp_port"`
+	APIPort        int           `toml:"api_port"`
+	MetricsPort    int           `toml:"metrics_port"`
+	DataDir        string        `toml:"data_dir"`
+	Codec          string        `toml:"codec"`
+	Ordering       string        `toml:"ordering"`
+	KeyFile        string        `toml:"key_file"`
+	ClusterKeyFile string        `toml:"cluster_key_file"`
+	APITokenFile   string        `toml:"api_token_file"`
+	Debug          bool          `toml:"debug"`
+	Protocol       protocolTable `toml:"protocol"`
+	Peers          []peerTable   `toml:"peers"`
+}
+
+// protocolTable is the [protocol] table of a config file
+type protocolTable struct {
+	ModuleRunSleepDuration duration `toml:"module_run_sleep_duration"`
+	HeartbeatInterval      duration `toml:"heartbeat_interval"`
+	ThetafdW               int      `toml:"thetafd_w"`
+	BufferUnitSize         int      `toml:"buffer_unit_size"`
+	SnapshotInterval       int      `toml:"snapshot_interval"`
+}
+
+// peerTable is one [[peers]] table of a config file, ID is nil if not set
+type peerTable struct {
+	ID          *int   `toml:"id"`
+	Hostname    string `toml:"hostname"`
+	IP          string `toml:"ip"`
+	UDPPort     int    `toml:"udp_port"`
+	APIPort     int    `toml:"api_port"`
+	MetricsPort int    `toml:"metrics_port"`
+	PublicKey   string `toml:"public_key"`
+}
+
+// duration is a time.Duration written as a string such as "250ms"
+type duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration such as "250ms"
+func (d *duration) UnmarshalText(text []byte) error {
+	x, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("must be a duration such as \"250ms\", got %q", text)
+	}
+	d.Duration = x
+	return nil
+}
+
+// decode overwrites c with the values set in the toml document content. Returns an error if it is malformed or sets
+// unknown keys. Hostnames are not resolved, see resolvePeers
+func (c *Config) decode(content string) error {
+	f := file{
+		ID: c.ID, HostsFile: c.HostsFile, BindIP: c.BindIP, UDPPort: c.UDPPort, APIPort: c.APIPort,
+		MetricsPort: c.MetricsPort, DataDir: c.DataDir, Codec: c.Codec, Ordering: c.Ordering, KeyFile: c.KeyFile,
+		ClusterKeyFile: c.ClusterKeyFile, APITokenFile: c.APITokenFile, Debug: c.Debug,
+		Protocol: protocolTable{
+			ModuleRunSleepDuration: duration{c.Params.ModuleRunSleepDuration},
+			HeartbeatInterval:      duration{c.Params.HeartbeatInterval},
+			ThetafdW:               c.Params.ThetafdW,
+			BufferUnitSize:         c.Params.BufferUnitSize,
+			SnapshotInterval:       c.Params.SnapshotInterval,
+		},
+	}
+	meta, err := toml.Decode(content, &f)
+	if err != nil {
+		return err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := []string{}
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("unknown keys %s", strings.Join(keys, ", "))
+	}
+
+	peers := []models.Processor{}
+	for _, t := range f.Peers {
+		p := models.Processor{ID: -1, Hostname: t.Hostname, IPString: t.IP, UDPPort: t.UDPPort, APIPort: t.APIPort,
+			MetricsPort: t.MetricsPort}
+		if t.ID != nil {
+			p.ID = *t.ID
+		}
+		if t.PublicKey != "" {
+			if p.PublicKey, err = helpers.ParsePublicKey(t.PublicKey); err != nil {
+				return fmt.Errorf("peer %d: %v", p.ID, err)
+			}
+		}
+		if p.IPString != "" {
+			p.IP = helpers.IPStringToSlice(p.IPString)
+		}
+		peers = append(peers, p)
+	}
+
+	c.ID, c.HostsFile, c.BindIP = f.ID, f.HostsFile, f.BindIP
+	c.UDPPort, c.APIPort, c.MetricsPort = f.UDPPort, f.APIPort, f.MetricsPort
+	c.DataDir, c.Codec, c.Ordering = f.DataDir, f.Codec, f.Ordering
+	c.KeyFile, c.ClusterKeyFile, c.APITokenFile, c.Debug = f.KeyFile, f.ClusterKeyFile, f.APITokenFile, f.Debug
+	c.Params.ModuleRunSleepDuration = f.Protocol.ModuleRunSleepDuration.Duration
+	c.Params.HeartbeatInterval = f.Protocol.HeartbeatInterval.Duration
+	c.Params.ThetafdW = f.Protocol.ThetafdW
+	c.Params.BufferUnitSize = f.Protocol.BufferUnitSize
+	c.Params.SnapshotInterval = f.Protocol.SnapshotInterval
+	if len(peers) > 0 {
+		c.Peers = peers
+	}
+	return nil
+}
@@ -11,12 +11,40 @@ const TestHostFilePath = "./test_hosts.txt"
 // ModuleRunSleepDuration is the duration each module sleeps before one iteration of the do forever loop
 const ModuleRunSleepDuration = 250 * time.Millisecond
 
+// HeartbeatInterval is the duration the failure detector modules sleep between sending heartbeats
+const HeartbeatInterval = 1 * time.Second
+
+// SnapshotInterval is the number of urb iterations between two snapshots of the persisted state
+const SnapshotInterval = 20
+
 // ThetafdW is the threshold used by the theta fd
 const ThetafdW = 100
 
-// ServerBufferSize is the size of the server buffer used when reading messages over the UDP socket
+// CoordinatorTimeout is the number of urb iterations without any consensus message from a suspected coordinator
+// before another processor takes over from it
+const CoordinatorTimeout = 20
+
+// ServerBufferSize is the size of the server buffer used when reading messages over the UDP socket, larger messages
+// are split into fragments of this size
 const ServerBufferSize = 1024
 
+// MaxMessageSize is the largest packed message that can be sent, after reassembling its fragments
+const MaxMessageSize = 1 << 20
+
+// ReassemblyTimeout is how long the server keeps the fragments of a message that has not been completely received
+const ReassemblyTimeout = 5 * time.Second
+
+// ReplayWindow is how far the counter of a signed datagram, a timestamp taken by its signer, may lie behind the clock
+// of the receiver or the latest counter of the same signer before the datagram is rejected as replayed
+const ReplayWindow = 30 * time.Second
+
+// SendQueueSize is the number of messages that may wait to be sent to each receiver, further messages are dropped
+const SendQueueSize = 1024
+
+// BatchDelay is how long messages to the same receiver are collected before being sent, batched into as few
+// datagrams as possible
+const BatchDelay = 1 * time.Millisecond
+
 // UnitTestingEnvVar indicates that the system is performing unit tests
 const UnitTestingEnvVar = "UNIT_TESTING"
 
@@ -31,3 +59,9 @@ const IPEnvVar = "IP"
 
 // Env is used to control what env is currently launching the app
 const Env = "ENV"
+
+// CodecEnvVar selects the wire codec used when sending messages, either binary (default) or json
+const CodecEnvVar = "CODEC"
+
+// DataDirEnvVar optionally points to a directory where the urb state is persisted
+const DataDirEnvVar = "DATA_DIR"
@@ -0,0 +1,83 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// BatchMagic is written as the first byte of every datagram holding several packed messages, it must differ from
+// the first byte of packed messages and fragments
+const BatchMagic byte = 0xB7
+
+// IsBatch returns true if datagram holds several packed messages
+func IsBatch(datagram []byte) bool {
+	return len(datagram) > 0 && datagram[0] == BatchMagic
+}
+
+// batchEntrySize is the number of bytes payload takes up in a batch, including its length prefix
+func batchEntrySize(payload []byte) int {
+	var tmp [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(tmp[:], uint64(len(payload))) + len(payload)
+}
+
+// Batch coalesces payloads into as few datagrams of at most size bytes as possible, keeping their order. A datagram
+// holding more than one payload starts with BatchMagic followed by the length-prefixed payloads, single payloads are
+// left as they are. Payloads larger than size end up in a datagram of their own and must be fragmented by the caller
+func Batch(payloads [][]byte, size int) [][]byte {
+	datagrams := [][]byte{}
+	group := [][]byte{}
+	groupSize := 1
+
+	flush := func() {
+		if len(group) == 1 {
+			datagrams = append(datagrams, group[0])
+		} else if len(group) > 1 {
+			datagram := make([]byte, 1, groupSize)
+			datagram[0] = BatchMagic
+			var tmp [binary.MaxVarintLen64]byte
+			for _, payload := range group {
+				n := binary.PutUvarint(tmp[:], uint64(len(payload)))
+				datagram = append(datagram, tmp[:n]...)
+				datagram = append(datagram, payload...)
+			}
+			datagrams = append(datagrams, datagram)
+		}
+		group = [][]byte{}
+		groupSize = 1
+	}
+
+	for _, payload := range payloads {
+		entrySize := batchEntrySize(payload)
+		if len(group) > 0 && groupSize+entrySize > size {
+			flush()
+		}
+		group = append(group, payload)
+		groupSize += entrySize
+	}
+	flush()
+
+	return datagrams
+}
+
+// Unbatch splits a datagram created by Batch into the payloads it holds
+func Unbatch(datagram []byte) ([][]byte, error) {
+	if !IsBatch(datagram) {
+		return nil, errors.New("Datagram is not a batch")
+	}
+
+	payloads := [][]byte{}
+	buf := datagram[1:]
+	for len(buf) > 0 {
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < l || l == 0 {
+			return nil, errors.New("Malformed batch entry")
+		}
+		payloads = append(payloads, buf[n:n+int(l)])
+		buf = buf[n+int(l):]
+	}
+	if len(payloads) < 2 {
+		return nil, errors.New("Batch holds less than two payloads")
+	}
+
+	return payloads, nil
+}
@@ -0,0 +1,48 @@
+package helpers
+
+import (
+	"bytes"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestBatchAndUnbatch(t *testing.T) {
+	payloads := [][]byte{}
+	for i := 0; i < 10; i++ {
+		payloads = append(payloads, bytes.Repeat([]byte{byte(i + 1)}, 100+i))
+	}
+
+	// every datagram holds as many payloads as fit, in order
+	datagrams := Batch(payloads, 512)
+	assert.Equal(t, len(datagrams), 3)
+	unbatched := [][]byte{}
+	for _, d := range datagrams {
+		assert.Assert(t, len(d) <= 512)
+		assert.Assert(t, IsBatch(d))
+		p, err := Unbatch(d)
+		assert.NilError(t, err)
+		unbatched = append(unbatched, p...)
+	}
+	assert.DeepEqual(t, unbatched, payloads)
+
+	// single payloads and payloads too large to share a datagram are left as they are
+	large := bytes.Repeat([]byte{1}, 600)
+	datagrams = Batch([][]byte{payloads[0], large, payloads[1]}, 512)
+	assert.DeepEqual(t, datagrams, [][]byte{payloads[0], large, payloads[1]})
+	assert.Equal(t, len(Batch(nil, 512)), 0)
+}
+
+func TestUnbatchRejectsMalformedBatches(t *testing.T) {
+	cases := map[string][]byte{
+		"not a batch":      {1, 2, 3},
+		"truncated entry":  {BatchMagic, 2, 1, 5, 1},
+		"empty entry":      {BatchMagic, 0, 1, 1},
+		"single entry":     {BatchMagic, 1, 1},
+		"malformed length": {BatchMagic, 0xFF},
+	}
+	for name, datagram := range cases {
+		_, err := Unbatch(datagram)
+		assert.Assert(t, err != nil, name)
+	}
+}
@@ -0,0 +1,232 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// BinaryCodecVersion is written as the first byte of every binary encoded message. It must never be '{', which
+// marks JSON encoded messages
+const BinaryCodecVersion byte = 1
+
+// BinaryCodec encodes messages in a compact binary format. After the version byte and the message type, the sender
+// and all integer fields are written as varints and strings are prefixed with their length
+type BinaryCodec struct{}
+
+// binaryWriter appends fields to a buffer
+type binaryWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) int(x int) {
+	n := binary.PutVarint(w.tmp[:], int64(x))
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binaryWriter) string(s string) {
+	n := binary.PutUvarint(w.tmp[:], uint64(len(s)))
+	w.buf = append(w.buf, w.tmp[:n]...)
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.string(string(b))
+}
+
+// headers writes the number of headers followed by all keys and values, sorted by key so that encoding is stable
+func (w *binaryWriter) headers(h map[string]string) {
+	keys := []string{}
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.int(len(keys))
+	for _, k := range keys {
+		w.string(k)
+		w.string(h[k])
+	}
+}
+
+// binaryReader consumes fields from a buffer, remembering the first error encountered
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binaryReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("Malformed integer field")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return int(x)
+}
+
+func (r *binaryReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	l, n := binary.Uvarint(r.buf)
+	if n <= 0 || uint64(len(r.buf)-n) < l {
+		r.err = errors.New("Malformed string field")
+		return ""
+	}
+	s := string(r.buf[n : n+int(l)])
+	r.buf = r.buf[n+int(l):]
+	return s
+}
+
+func (r *binaryReader) bytes() []byte {
+	s := r.string()
+	if len(s) == 0 {
+		return nil
+	}
+	return []byte(s)
+}
+
+func (r *binaryReader) headers() map[string]string {
+	count := r.int()
+	if count < 0 || count > len(r.buf) {
+		if r.err == nil {
+			r.err = errors.New("Malformed headers field")
+		}
+		return nil
+	} else if count == 0 {
+		return nil
+	}
+
+	h := map[string]string{}
+	for i := 0; i < count && r.err == nil; i++ {
+		k := r.string()
+		h[k] = r.string()
+	}
+	return h
+}
+
+func (r *binaryReader) reconf() *models.RECONFData {
+	data := &models.RECONFData{Epoch: r.int(), Proposer: r.int(), Processors: []models.Processor{}}
+	count := r.int()
+	if count < 0 || count > len(r.buf) {
+		if r.err == nil {
+			r.err = errors.New("Malformed processors field")
+		}
+		return data
+	}
+
+	for i := 0; i < count && r.err == nil; i++ {
+		data.Processors = append(data.Processors, models.Processor{ID: r.int(), Hostname: r.string(), IPString: r.string(), IP: r.bytes(), UDPPort: r.int(), APIPort: r.int(), MetricsPort: r.int(), PublicKey: r.bytes()})
+	}
+	return data
+}
+
+// Pack encodes the message in the binary format
+func (BinaryCodec) Pack(m *models.Message) ([]byte, error) {
+	w := binaryWriter{buf: make([]byte, 0, 32)}
+	w.buf = append(w.buf, BinaryCodecVersion, byte(m.Type))
+	w.int(m.Sender)
+
+	switch data := m.Data.(type) {
+	case *models.MSGData:
+		w.int(data.J)
+		w.int(data.S)
+		w.string(data.Text)
+		w.bytes(data.Payload)
+		w.headers(data.Headers)
+	case *models.MSGackData:
+		w.int(data.J)
+		w.int(data.S)
+	case *models.GOSSIPData:
+		w.int(data.SeqJ)
+		w.int(data.TxObsSJ)
+		w.int(data.RxObsSJ)
+	case *models.RECONFData:
+		w.int(data.Epoch)
+		w.int(data.Proposer)
+		w.int(len(data.Processors))
+		for _, p := range data.Processors {
+			w.int(p.ID)
+			w.string(p.Hostname)
+			w.string(p.IPString)
+			w.bytes(p.IP)
+			w.int(p.UDPPort)
+			w.int(p.APIPort)
+			w.int(p.MetricsPort)
+			w.bytes(p.PublicKey)
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("Unsupported data %T", m.Data)
+	}
+
+	if !dataMatchesType(m) {
+		return nil, fmt.Errorf("Data %T does not match message type %d", m.Data, m.Type)
+	}
+
+	return w.buf, nil
+}
+
+// Unpack decodes a binary encoded message
+func (BinaryCodec) Unpack(bytes []byte) (*models.Message, error) {
+	if len(bytes) < 2 {
+		return nil, errors.New("Message too short")
+	} else if bytes[0] != BinaryCodecVersion {
+		return nil, fmt.Errorf("Unsupported codec version %d", bytes[0])
+	}
+
+	m := models.Message{Type: models.MessageType(bytes[1])}
+	r := binaryReader{buf: bytes[2:]}
+	m.Sender = r.int()
+
+	switch m.Type {
+	case models.MSG:
+		m.Data = &models.MSGData{J: r.int(), S: r.int(), Text: r.string(), Payload: r.bytes(), Headers: r.headers()}
+	case models.MSGack:
+		m.Data = &models.MSGackData{J: r.int(), S: r.int()}
+	case models.GOSSIP:
+		m.Data = &models.GOSSIPData{SeqJ: r.int(), TxObsSJ: r.int(), RxObsSJ: r.int()}
+	case models.RECONF:
+		m.Data = r.reconf()
+	case models.HBFDheartbeat, models.THETAheartbeat:
+	default:
+		return nil, fmt.Errorf("Unknown message type %d", m.Type)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	} else if len(r.buf) > 0 {
+		return nil, fmt.Errorf("Got %d trailing bytes", len(r.buf))
+	}
+
+	return &m, nil
+}
+
+// dataMatchesType returns true if the data of m is of the type expected for its message type
+func dataMatchesType(m *models.Message) bool {
+	switch m.Type {
+	case models.MSG:
+		_, ok := m.Data.(*models.MSGData)
+		return ok
+	case models.MSGack:
+		_, ok := m.Data.(*models.MSGackData)
+		return ok
+	case models.GOSSIP:
+		_, ok := m.Data.(*models.GOSSIPData)
+		return ok
+	case models.RECONF:
+		_, ok := m.Data.(*models.RECONFData)
+		return ok
+	case models.HBFDheartbeat, models.THETAheartbeat:
+		return m.Data == nil
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package helpers
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EncryptedMagic is written as the first byte of every encrypted datagram, it must differ from the first byte of
+// packed messages, fragments, batches and signed datagrams
+const EncryptedMagic byte = 0xE7
+
+// ClusterKeySize is the size of the AES-256 keys datagrams are encrypted with
+const ClusterKeySize = 32
+
+// keyIDSize is the number of bytes identifying the key a datagram is encrypted with
+const keyIDSize = 4
+
+// nonceSize and tagSize are the sizes of the nonce and authentication tag of AES-GCM
+const (
+	nonceSize = 12
+	tagSize   = 16
+)
+
+// EncryptionOverhead is the number of bytes encryption adds to a datagram, i.e. the magic byte, key id, nonce and tag
+const EncryptionOverhead = 1 + keyIDSize + nonceSize + tagSize
+
+// ErrUnencrypted is returned when decrypting a datagram that is not encrypted
+var ErrUnencrypted = errors.New("Datagram is not encrypted")
+
+// ErrUnknownKey is returned when decrypting a datagram encrypted with a key that is not known
+var ErrUnknownKey = errors.New("Datagram is encrypted with an unknown key")
+
+// ErrDecrypt is returned when a datagram could not be decrypted or was tampered with
+var ErrDecrypt = errors.New("Datagram could not be decrypted")
+
+// ClusterKey is an AES-256-GCM key shared by all processors of a cluster
+type ClusterKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// NewClusterKey returns a cluster key from its raw bytes
+func NewClusterKey(key []byte) (*ClusterKey, error) {
+	if len(key) != ClusterKeySize {
+		return nil, fmt.Errorf("cluster key must be %d bytes, got %d", ClusterKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// keys are identified by a prefix of their hash, so that receivers know which key to decrypt with
+	k := &ClusterKey{aead: aead}
+	hash := sha256.Sum256(key)
+	copy(k.id[:], hash[:])
+	return k, nil
+}
+
+// IsEncrypted returns true if datagram is encrypted
+func IsEncrypted(datagram []byte) bool {
+	return len(datagram) > 0 && datagram[0] == EncryptedMagic
+}
+
+// Encrypt encrypts and authenticates datagram with key under a random nonce
+func Encrypt(datagram []byte, key *ClusterKey) ([]byte, error) {
+	header := make([]byte, 1+keyIDSize+nonceSize, len(datagram)+EncryptionOverhead)
+	header[0] = EncryptedMagic
+	copy(header[1:], key.id[:])
+	nonce := header[1+keyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return key.aead.Seal(header, nonce, datagram, header[:1+keyIDSize]), nil
+}
+
+// Decrypt decrypts a datagram created by Encrypt with whichever of keys it was encrypted with
+func Decrypt(encrypted []byte, keys []*ClusterKey) ([]byte, error) {
+	if !IsEncrypted(encrypted) || len(encrypted) < EncryptionOverhead {
+		return nil, ErrUnencrypted
+	}
+
+	header := encrypted[:1+keyIDSize+nonceSize]
+	for _, key := range keys {
+		if string(key.id[:]) != string(header[1:1+keyIDSize]) {
+			continue
+		}
+		datagram, err := key.aead.Open(nil, header[1+keyIDSize:], encrypted[len(header):], header[:1+keyIDSize])
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		return datagram, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// ReadClusterKeys reads the base64 encoded cluster keys listed one per line in the file at path. The first key is
+// used for encrypting and all of them for decrypting, so that keys can be rotated. Blank lines and everything after a
+// # are ignored
+func ReadClusterKeys(path string) ([]*ClusterKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := []*ClusterKey{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if idx := strings.Index(text, "#"); idx != -1 {
+			text = text[:idx]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed line %d in cluster key file: key is not base64 encoded: %v", line, err)
+		}
+		key, err := NewClusterKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed line %d in cluster key file: %v", line, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No cluster keys found in %s", path)
+	}
+	return keys, nil
+}
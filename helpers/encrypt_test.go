@@ -0,0 +1,89 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// newClusterKey returns a random cluster key along with its base64 encoding
+func newClusterKey(t *testing.T) (*ClusterKey, string) {
+	raw := make([]byte, ClusterKeySize)
+	_, err := rand.Read(raw)
+	assert.NilError(t, err)
+	key, err := NewClusterKey(raw)
+	assert.NilError(t, err)
+	return key, base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	oldKey, _ := newClusterKey(t)
+	newKey, _ := newClusterKey(t)
+
+	datagram := []byte("Hello world!")
+	encrypted, err := Encrypt(datagram, newKey)
+	assert.NilError(t, err)
+	assert.Equal(t, len(encrypted), len(datagram)+EncryptionOverhead)
+	assert.Assert(t, IsEncrypted(encrypted))
+	assert.Assert(t, !bytes.Contains(encrypted, datagram))
+
+	// any of the keys decrypts, as long as it is the one the datagram was encrypted with
+	decrypted, err := Decrypt(encrypted, []*ClusterKey{oldKey, newKey})
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(decrypted, datagram))
+	_, err = Decrypt(encrypted, []*ClusterKey{oldKey})
+	assert.Equal(t, err, ErrUnknownKey)
+
+	// encrypting the same datagram twice yields different ciphertexts
+	again, err := Encrypt(datagram, newKey)
+	assert.NilError(t, err)
+	assert.Assert(t, !bytes.Equal(again, encrypted))
+
+	for i := 1 + keyIDSize; i < len(encrypted); i++ {
+		tampered := append([]byte{}, encrypted...)
+		tampered[i]++
+		_, err = Decrypt(tampered, []*ClusterKey{newKey})
+		assert.Equal(t, err, ErrDecrypt, "byte %d", i)
+	}
+	_, err = Decrypt(datagram, []*ClusterKey{newKey})
+	assert.Equal(t, err, ErrUnencrypted)
+	_, err = Decrypt(encrypted[:EncryptionOverhead-1], []*ClusterKey{newKey})
+	assert.Equal(t, err, ErrUnencrypted)
+}
+
+func TestReadClusterKeys(t *testing.T) {
+	_, first := newClusterKey(t)
+	_, second := newClusterKey(t)
+	file, err := ioutil.TempFile("", "ssurb-cluster-keys")
+	assert.NilError(t, err)
+	defer os.Remove(file.Name())
+
+	content := fmt.Sprintf("# current key\n%s\n\n%s # old key\n", first, second)
+	assert.NilError(t, ioutil.WriteFile(file.Name(), []byte(content), 0600))
+	keys, err := ReadClusterKeys(file.Name())
+	assert.NilError(t, err)
+	assert.Equal(t, len(keys), 2)
+
+	// the first key encrypts what the others can not decrypt
+	encrypted, err := Encrypt([]byte{1}, keys[0])
+	assert.NilError(t, err)
+	_, err = Decrypt(encrypted, keys[1:])
+	assert.Equal(t, err, ErrUnknownKey)
+
+	cases := map[string]string{
+		"# no keys\n":      "No cluster keys found",
+		first + "\nAAEC\n": "Malformed line 2 in cluster key file: cluster key must be 32 bytes, got 3",
+		"!":                "Malformed line 1 in cluster key file: key is not base64 encoded",
+	}
+	for content, expected := range cases {
+		assert.NilError(t, ioutil.WriteFile(file.Name(), []byte(content), 0600))
+		_, err := ReadClusterKeys(file.Name())
+		assert.ErrorContains(t, err, expected)
+	}
+}
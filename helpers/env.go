@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"os"
+	"strings"
 
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
 )
@@ -23,7 +24,8 @@ func IsRunningOnTravis() bool {
 	return isSet
 }
 
-// GetIP returns the current IP address defined by IPEnvVar, if not set it returns ""
+// GetIP returns the current IP address defined by IPEnvVar, if not set it returns "". IPv6 addresses may be given
+// in brackets, which are stripped
 func GetIP() string {
 	if IsDevEnv() {
 		return "127.0.0.1"
@@ -34,7 +36,7 @@ func GetIP() string {
 		return ""
 	}
 
-	return val
+	return strings.TrimSuffix(strings.TrimPrefix(val, "["), "]")
 }
 
 // IsDevEnv returns true if env var is set to DEV
@@ -45,3 +47,18 @@ func IsDevEnv() bool {
 	}
 	return val == "DEV"
 }
+
+// GetCodec returns the name of the wire codec defined by CodecEnvVar, defaults to binary
+func GetCodec() string {
+	val, isSet := os.LookupEnv(constants.CodecEnvVar)
+	if !isSet {
+		return "binary"
+	}
+
+	return val
+}
+
+// GetDataDir returns the directory defined by DataDirEnvVar, empty if the urb state should not be persisted
+func GetDataDir() string {
+	return os.Getenv(constants.DataDirEnvVar)
+}
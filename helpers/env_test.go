@@ -0,0 +1,26 @@
+package helpers
+
+import (
+	"os"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+)
+
+func TestGetIP(t *testing.T) {
+	defer os.Unsetenv(constants.IPEnvVar)
+
+	os.Unsetenv(constants.IPEnvVar)
+	assert.Equal(t, GetIP(), "")
+
+	for _, val := range []string{"10.0.0.1", "2001:db8::1"} {
+		os.Setenv(constants.IPEnvVar, val)
+		assert.Equal(t, GetIP(), val)
+	}
+
+	// IPv6 addresses may be given in brackets
+	os.Setenv(constants.IPEnvVar, "[::1]")
+	assert.Equal(t, GetIP(), "::1")
+}
@@ -0,0 +1,165 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FragmentMagic is written as the first byte of every fragment, it must differ from the first byte of packed messages
+const FragmentMagic byte = 0xF5
+
+// fragmentHeaderSize is the size of the magic byte, message id, fragment index and fragment count
+const fragmentHeaderSize = 1 + 8 + 2 + 2
+
+// maxFragments is the largest number of fragments a payload can be split into
+const maxFragments = 1<<16 - 1
+
+// maxPendingPayloads bounds the number of payloads being reassembled at the same time
+const maxPendingPayloads = 256
+
+// IsFragment returns true if datagram is a fragment of a larger payload
+func IsFragment(datagram []byte) bool {
+	return len(datagram) > 0 && datagram[0] == FragmentMagic
+}
+
+// Fragment splits payload into datagrams of at most size bytes, headers included. id must be unique among the
+// payloads sent from the same address within the reassembly timeout
+func Fragment(payload []byte, id uint64, size int) ([][]byte, error) {
+	chunkSize := size - fragmentHeaderSize
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("Fragment size %d is too small", size)
+	}
+
+	count := (len(payload) + chunkSize - 1) / chunkSize
+	if count > maxFragments {
+		return nil, fmt.Errorf("Payload of size %d needs more than %d fragments", len(payload), maxFragments)
+	}
+
+	fragments := [][]byte{}
+	for idx := 0; idx < count; idx++ {
+		end := (idx + 1) * chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := payload[idx*chunkSize : end]
+
+		datagram := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(chunk))
+		datagram[0] = FragmentMagic
+		binary.BigEndian.PutUint64(datagram[1:], id)
+		binary.BigEndian.PutUint16(datagram[9:], uint16(idx))
+		binary.BigEndian.PutUint16(datagram[11:], uint16(count))
+		fragments = append(fragments, append(datagram, chunk...))
+	}
+
+	return fragments, nil
+}
+
+// fragmentKey identifies a payload being reassembled
+type fragmentKey struct {
+	source string
+	id     uint64
+}
+
+// partialPayload holds the fragments of a payload received so far
+type partialPayload struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// Reassembler collects fragments until all fragments of a payload have been received. Payloads that are not
+// complete within Timeout are dropped, which is fine since the urb module keeps retransmitting until acked
+type Reassembler struct {
+	// Timeout is how long the fragments of an incomplete payload are kept
+	Timeout time.Duration
+	// MaxSize is the largest payload that will be reassembled
+	MaxSize int
+
+	mux     sync.Mutex
+	pending map[fragmentKey]*partialPayload
+	now     func() time.Time
+}
+
+// NewReassembler returns a reassembler dropping incomplete payloads after timeout and payloads larger than maxSize
+func NewReassembler(timeout time.Duration, maxSize int) *Reassembler {
+	return &Reassembler{Timeout: timeout, MaxSize: maxSize, pending: map[fragmentKey]*partialPayload{}, now: time.Now}
+}
+
+// Add adds a fragment received from source. Returns the reassembled payload once all of its fragments are received,
+// otherwise nil. Duplicated fragments are ignored
+func (r *Reassembler) Add(source string, datagram []byte) ([]byte, error) {
+	if len(datagram) < fragmentHeaderSize || !IsFragment(datagram) {
+		return nil, errors.New("Malformed fragment")
+	}
+
+	id := binary.BigEndian.Uint64(datagram[1:])
+	idx := int(binary.BigEndian.Uint16(datagram[9:]))
+	count := int(binary.BigEndian.Uint16(datagram[11:]))
+	chunk := datagram[fragmentHeaderSize:]
+	if count == 0 || idx >= count {
+		return nil, fmt.Errorf("Malformed fragment %d of %d", idx, count)
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	now := r.now()
+	r.expire(now)
+
+	key := fragmentKey{source: source, id: id}
+	p, exists := r.pending[key]
+	if !exists {
+		if len(r.pending) >= maxPendingPayloads {
+			return nil, fmt.Errorf("Too many payloads being reassembled, dropping fragment of %d", id)
+		}
+		p = &partialPayload{chunks: make([][]byte, count), started: now}
+		r.pending[key] = p
+	} else if len(p.chunks) != count {
+		delete(r.pending, key)
+		return nil, fmt.Errorf("Fragment count of payload %d changed from %d to %d", id, len(p.chunks), count)
+	}
+
+	if p.chunks[idx] != nil {
+		return nil, nil
+	}
+	p.chunks[idx] = append([]byte{}, chunk...)
+	p.received++
+	p.size += len(chunk)
+
+	if p.size > r.MaxSize {
+		delete(r.pending, key)
+		return nil, fmt.Errorf("Payload %d exceeds max size of %d bytes", id, r.MaxSize)
+	}
+
+	if p.received < count {
+		return nil, nil
+	}
+
+	delete(r.pending, key)
+	payload := make([]byte, 0, p.size)
+	for _, c := range p.chunks {
+		payload = append(payload, c...)
+	}
+	return payload, nil
+}
+
+// Pending returns the number of payloads being reassembled
+func (r *Reassembler) Pending() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return len(r.pending)
+}
+
+// expire drops all payloads that have not been completed within the timeout, the caller must hold the lock
+func (r *Reassembler) expire(now time.Time) {
+	for key, p := range r.pending {
+		if now.Sub(p.started) > r.Timeout {
+			delete(r.pending, key)
+		}
+	}
+}
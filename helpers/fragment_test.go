@@ -0,0 +1,92 @@
+package helpers
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestFragmentAndReassemble(t *testing.T) {
+	payload := make([]byte, 40000)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	fragments, err := Fragment(payload, 7, 1024)
+	assert.NilError(t, err)
+	assert.Equal(t, len(fragments), 40)
+	for _, f := range fragments {
+		assert.Assert(t, len(f) <= 1024)
+		assert.Assert(t, IsFragment(f))
+	}
+
+	// fragments may arrive in any order and more than once
+	r := NewReassembler(time.Second, 1<<20)
+	rand.New(rand.NewSource(2)).Shuffle(len(fragments), func(i, j int) {
+		fragments[i], fragments[j] = fragments[j], fragments[i]
+	})
+	fragments = append([][]byte{fragments[1]}, fragments...)
+	for _, f := range fragments[:len(fragments)-1] {
+		out, err := r.Add("a", f)
+		assert.NilError(t, err)
+		assert.Assert(t, out == nil)
+	}
+	reassembled, err := r.Add("a", fragments[len(fragments)-1])
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(reassembled, payload))
+	assert.Equal(t, r.Pending(), 0)
+}
+
+func TestReassembleKeepsSourcesApart(t *testing.T) {
+	a, _ := Fragment([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), 1, 20)
+	b, _ := Fragment([]byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"), 1, 20)
+
+	r := NewReassembler(time.Second, 1<<20)
+	for idx := range a[1:] {
+		r.Add("a", a[idx+1])
+		r.Add("b", b[idx+1])
+	}
+	outA, err := r.Add("a", a[0])
+	assert.NilError(t, err)
+	outB, err := r.Add("b", b[0])
+	assert.NilError(t, err)
+	assert.Equal(t, string(outA), "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	assert.Equal(t, string(outB), "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+}
+
+func TestReassembleDropsExpiredAndOversizedPayloads(t *testing.T) {
+	fragments, _ := Fragment(make([]byte, 100), 1, 50)
+
+	now := time.Now()
+	r := NewReassembler(time.Second, 1<<20)
+	r.now = func() time.Time { return now }
+	r.Add("a", fragments[0])
+	assert.Equal(t, r.Pending(), 1)
+
+	// the first fragment is gone once the timeout has passed, so the payload is never completed
+	now = now.Add(2 * time.Second)
+	for _, f := range fragments[1:] {
+		out, err := r.Add("a", f)
+		assert.NilError(t, err)
+		assert.Assert(t, out == nil)
+	}
+
+	r = NewReassembler(time.Second, 60)
+	r.Add("a", fragments[0])
+	_, err := r.Add("a", fragments[1])
+	assert.ErrorContains(t, err, "exceeds max size")
+	assert.Equal(t, r.Pending(), 0)
+}
+
+func TestReassembleRejectsMalformedFragments(t *testing.T) {
+	r := NewReassembler(time.Second, 1<<20)
+
+	_, err := r.Add("a", []byte{FragmentMagic, 0, 0})
+	assert.Assert(t, err != nil)
+	_, err = r.Add("a", []byte{FragmentMagic, 0, 0, 0, 0, 0, 0, 0, 1, 0, 3, 0, 2})
+	assert.ErrorContains(t, err, "Malformed fragment 3 of 2")
+
+	_, err = Fragment([]byte("foo"), 1, fragmentHeaderSize)
+	assert.Assert(t, err != nil)
+}
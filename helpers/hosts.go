@@ -3,7 +3,8 @@ package helpers
 import (
 	"bufio"
 	"fmt"
-	"io"
+	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -15,6 +16,9 @@ import (
 // Processors is a slice of all processors
 var Processors []models.Processor
 
+// LookupIP resolves hostnames to ip addresses, replaceable in tests
+var LookupIP = net.LookupIP
+
 func getHostsPath() string {
 	if IsUnitTesting() {
 		return constants.TestHostFilePath
@@ -22,22 +26,50 @@ func getHostsPath() string {
 	return constants.HostsFilePath
 }
 
-// IPStringToSlice converts a string of the form X.X.X.X to an IP struct []byte
+// IPStringToSlice parses an IPv4 or IPv6 address, IPv4 addresses are returned in their 4 byte form. Returns nil if
+// ipString is not a valid address
 func IPStringToSlice(ipString string) []byte {
-	parts := strings.Split(ipString, ".")
-	ip := []byte{}
-	for _, p := range parts {
-		x, _ := strconv.Atoi(p)
-		ip = append(ip, byte(x))
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return nil
+	} else if ip4 := ip.To4(); ip4 != nil {
+		return ip4
 	}
-
 	return ip
 }
 
-// ParseHostsFile parses a host file at the given path and returns a slice of corresponding processors
+// ResolveHostname looks up the ip address of hostname, preferring IPv4 addresses
+func ResolveHostname(hostname string) ([]byte, error) {
+	ips, err := LookupIP(hostname)
+	if err != nil {
+		return nil, err
+	} else if len(ips) == 0 {
+		return nil, fmt.Errorf("No addresses found for %s", hostname)
+	}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return ips[0], nil
+}
+
+// ParseHostsFile parses the default hosts file and returns a slice of corresponding processors
 func ParseHostsFile() ([]models.Processor, error) {
+	return ParseHostsFileAt(getHostsPath())
+}
+
+// ParseHostsFileAt parses a host file at the given path and returns a slice of corresponding processors. Every line
+// is of the form
+//
+//	id,hostname,ip[,udp_port[,api_port[,metrics_port[,public_key]]]]
+//
+// where ip may be IPv4 or IPv6 and public_key is a base64 encoded ed25519 key. If ip is empty the hostname is
+// resolved, and omitted or empty ports fall back to their defaults. Blank lines and everything after a # are ignored
+func ParseHostsFileAt(path string) ([]models.Processor, error) {
 	// parse file and exit if error
-	file, err := os.Open(getHostsPath())
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -45,41 +77,27 @@ func ParseHostsFile() ([]models.Processor, error) {
 	// close file after we're done
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	var line string
 	processors := []models.Processor{}
+	scanner := bufio.NewScanner(file)
 
 	// read hosts file line by line
-	for {
-		line, err = reader.ReadString('\n')
-
-		if err != nil {
-			break
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if idx := strings.Index(text, "#"); idx != -1 {
+			text = text[:idx]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
 		}
 
-		// parse out processor information from line and att to slice
-		if len(line) > 0 {
-			parts := strings.Split(line, ",")
-			// check for malformed line
-			if len(parts) != 3 {
-				return nil, fmt.Errorf("Malformed line in hosts file: %s", line)
-			}
-			id, err := strconv.Atoi(parts[0])
-			if err != nil {
-				return nil, fmt.Errorf("Could not parse ID. Got error: %v", err)
-			}
-			hostname := parts[1]
-			ipString := strings.TrimSuffix(parts[2], "\n")
-
-			// build net.IP struct
-			ip := IPStringToSlice(ipString)
-			p := models.Processor{ID: id, Hostname: hostname, IPString: ipString, IP: ip}
-			processors = append(processors, p)
+		p, err := parseHostsLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed line %d in hosts file: %s: %v", line, text, err)
 		}
+		processors = append(processors, p)
 	}
-
-	// EOF error is expected
-	if err != io.EOF {
+	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 
@@ -87,3 +105,53 @@ func ParseHostsFile() ([]models.Processor, error) {
 	return processors, nil
 }
 
+// parseHostsLine parses out processor information from one line of a hosts file
+func parseHostsLine(line string) (models.Processor, error) {
+	parts := strings.Split(line, ",")
+	if len(parts) < 3 || len(parts) > 7 {
+		return models.Processor{}, fmt.Errorf("expected 3 to 7 fields, got %d", len(parts))
+	}
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return models.Processor{}, fmt.Errorf("could not parse ID. Got error: %v", err)
+	}
+	p := models.Processor{ID: id, Hostname: parts[1], IPString: parts[2]}
+
+	// ports and public key are optional
+	if len(parts) == 7 {
+		if parts[6] != "" {
+			if p.PublicKey, err = ParsePublicKey(parts[6]); err != nil {
+				return models.Processor{}, err
+			}
+		}
+		parts = parts[:6]
+	}
+	ports := []*int{&p.UDPPort, &p.APIPort, &p.MetricsPort}
+	for i, s := range parts[3:] {
+		if s == "" {
+			continue
+		}
+		port, err := strconv.Atoi(s)
+		if err != nil || port < 1 || port > 65535 {
+			return models.Processor{}, fmt.Errorf("invalid port %s", s)
+		}
+		*ports[i] = port
+	}
+
+	if p.IPString != "" {
+		if p.IP = IPStringToSlice(p.IPString); p.IP == nil {
+			return models.Processor{}, fmt.Errorf("invalid ip %s", p.IPString)
+		}
+	} else if p.Hostname == "" {
+		return models.Processor{}, fmt.Errorf("either hostname or ip must be set")
+	} else if p.IP, err = ResolveHostname(p.Hostname); err != nil {
+		// the host may not be up yet, sending to it resolves the hostname again
+		log.Printf("Could not resolve %s of processor %d: %v", p.Hostname, p.ID, err)
+	}
+
+	return p, nil
+}
@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"net"
 	"os"
 	"reflect"
 	"testing"
@@ -40,13 +41,13 @@ func TestCanParseValidFile(t *testing.T) {
 }
 
 func TestFailsOnMalformedLine(t *testing.T) {
-	createHostsFile("0,localhost,127.0.0.1,5\n1,localhost,127.0.0.1\n")
+	createHostsFile("0,localhost,127.0.0.1\n1,localhost\n")
 	SetUnitTestingEnv()
 
 	// make sure it fails appropriately due to malformed hosts file
 	processors, err := ParseHostsFile()
 	assert.Assert(t, processors == nil)
-	assert.Error(t, err, "Malformed line in hosts file: 0,localhost,127.0.0.1,5\n")
+	assert.Error(t, err, "Malformed line 2 in hosts file: 1,localhost: expected 3 to 7 fields, got 2")
 
 	os.Remove(constants.TestHostFilePath)
 }
@@ -58,7 +59,69 @@ func TestFailsOnIdNotBeingAnInt(t *testing.T) {
 	// make sure it fails appropriately due to malformed hosts file
 	processors, err := ParseHostsFile()
 	assert.Assert(t, processors == nil)
-	assert.Error(t, err, "Could not parse ID. Got error: strconv.Atoi: parsing \"asd\": invalid syntax")
+	assert.Error(t, err, "Malformed line 1 in hosts file: asd,localhost,127.0.0.1: could not parse ID. Got error: strconv.Atoi: parsing \"asd\": invalid syntax")
 
 	os.Remove(constants.TestHostFilePath)
 }
+
+func TestCanParseExtendedFile(t *testing.T) {
+	createHostsFile(`# two nodes sharing a host
+0, localhost, 127.0.0.1, 5000, 5001, 5002
+
+1,localhost,::1,6000  # IPv6 with only the udp port set
+2,node2.example.com,,,7001
+3,localhost,127.0.0.1
+4,localhost,127.0.0.1,,,,AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=`)
+	SetUnitTestingEnv()
+	defer os.Remove(constants.TestHostFilePath)
+
+	LookupIP = func(host string) ([]net.IP, error) {
+		assert.Equal(t, host, "node2.example.com")
+		return []net.IP{net.ParseIP("2001:db8::2"), net.ParseIP("10.0.0.2")}, nil
+	}
+	defer func() { LookupIP = net.LookupIP }()
+
+	processors, err := ParseHostsFile()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, processors, []models.Processor{
+		{ID: 0, Hostname: "localhost", IPString: "127.0.0.1", IP: []byte{127, 0, 0, 1}, UDPPort: 5000, APIPort: 5001, MetricsPort: 5002},
+		{ID: 1, Hostname: "localhost", IPString: "::1", IP: net.IPv6loopback, UDPPort: 6000},
+		{ID: 2, Hostname: "node2.example.com", IP: []byte{10, 0, 0, 2}, APIPort: 7001},
+		{ID: 3, Hostname: "localhost", IPString: "127.0.0.1", IP: []byte{127, 0, 0, 1}},
+		{ID: 4, Hostname: "localhost", IPString: "127.0.0.1", IP: []byte{127, 0, 0, 1}, PublicKey: []byte{
+			0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31}},
+	})
+
+	// ports that are not set fall back to the defaults
+	assert.Equal(t, processors[1].GetAPIPort(), 4001)
+	assert.Equal(t, processors[2].GetUDPPort(), 4002)
+	assert.Equal(t, processors[2].GetMetricsPort(), 2114)
+}
+
+func TestFailsOnInvalidAddresses(t *testing.T) {
+	SetUnitTestingEnv()
+	defer os.Remove(constants.TestHostFilePath)
+
+	cases := map[string]string{
+		"0,localhost,127.0.0.256":     "invalid ip 127.0.0.256",
+		"0,localhost,127.0.0.1,0":     "invalid port 0",
+		"0,localhost,127.0.0.1,4,x":   "invalid port x",
+		"0,,":                         "either hostname or ip must be set",
+		"0,a,127.0.0.1,1,2,3,4,5":     "expected 3 to 7 fields, got 8",
+		"0,a,127.0.0.1,,,,AAEC":       "public key must be 32 bytes, got 3",
+		"0,a,127.0.0.1,,,,!":          "public key is not base64 encoded",
+		"0,localhost,256.256.256.256": "invalid ip",
+	}
+	for line, expected := range cases {
+		createHostsFile(line)
+		_, err := ParseHostsFile()
+		assert.ErrorContains(t, err, expected)
+	}
+}
+
+func TestIPStringToSlice(t *testing.T) {
+	assert.DeepEqual(t, IPStringToSlice("10.0.0.1"), []byte{10, 0, 0, 1})
+	assert.DeepEqual(t, IPStringToSlice("::1"), []byte(net.IPv6loopback))
+	assert.Assert(t, IPStringToSlice("localhost") == nil)
+	assert.Assert(t, IPStringToSlice("1.2.3") == nil)
+}
@@ -0,0 +1,58 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// JSONCodec encodes messages as human readable JSON
+type JSONCodec struct{}
+
+// jsonMessage mirrors models.Message, but holds off decoding the data until its type is known
+type jsonMessage struct {
+	Type   models.MessageType
+	Sender int
+	Data   json.RawMessage
+}
+
+// Pack encodes the message as JSON
+func (JSONCodec) Pack(m *models.Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Unpack decodes JSON into a message whose data matches its type
+func (JSONCodec) Unpack(bytes []byte) (*models.Message, error) {
+	var raw jsonMessage
+	err := json.Unmarshal(bytes, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	m := models.Message{Type: raw.Type, Sender: raw.Sender}
+	switch raw.Type {
+	case models.MSG:
+		m.Data = &models.MSGData{}
+	case models.MSGack:
+		m.Data = &models.MSGackData{}
+	case models.GOSSIP:
+		m.Data = &models.GOSSIPData{}
+	case models.RECONF:
+		m.Data = &models.RECONFData{}
+	case models.HBFDheartbeat, models.THETAheartbeat:
+		return &m, nil
+	default:
+		return nil, fmt.Errorf("Unknown message type %d", raw.Type)
+	}
+
+	if len(raw.Data) == 0 || string(raw.Data) == "null" {
+		return nil, fmt.Errorf("Missing data for message type %d", raw.Type)
+	}
+	err = json.Unmarshal(raw.Data, m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
@@ -1,14 +1,37 @@
 package helpers
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
 )
 
+// Codec encodes messages to and decodes messages from their wire format
+type Codec interface {
+	Pack(m *models.Message) ([]byte, error)
+	Unpack(bytes []byte) (*models.Message, error)
+}
+
+// WireCodec is the codec used by Pack to encode outgoing messages
+var WireCodec Codec = BinaryCodec{}
+
+// SelectCodec sets WireCodec by name, either "binary" or "json" which is handy for debugging
+func SelectCodec(name string) error {
+	switch name {
+	case "binary":
+		WireCodec = BinaryCodec{}
+	case "json":
+		WireCodec = JSONCodec{}
+	default:
+		return fmt.Errorf("Unknown codec %s", name)
+	}
+	return nil
+}
+
 // Pack encodes the message as bytes
 func Pack(m *models.Message) ([]byte, error) {
-	bytes, err := json.Marshal(m)
+	bytes, err := WireCodec.Pack(m)
 	if err != nil {
 		return nil, err
 	}
@@ -16,13 +39,15 @@ func Pack(m *models.Message) ([]byte, error) {
 	return bytes, nil
 }
 
-// Unpack decodes a slice of bytes to a Message
+// Unpack decodes a slice of bytes to a Message. The codec is picked from the first byte, so that processors using
+// different codecs can still talk to each other
 func Unpack(bytes []byte) (*models.Message, error) {
-	var m models.Message
-	err := json.Unmarshal(bytes, &m)
-	if err != nil {
-		return nil, err
+	if len(bytes) == 0 {
+		return nil, errors.New("Empty message")
 	}
 
-	return &m, nil
+	if bytes[0] == '{' {
+		return JSONCodec{}.Unpack(bytes)
+	}
+	return BinaryCodec{}.Unpack(bytes)
 }
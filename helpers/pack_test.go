@@ -9,8 +9,22 @@ import (
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
 )
 
+// testMessages holds one message of every type
+var testMessages = []models.Message{
+	{Type: models.MSG, Sender: 0, Data: &models.MSGData{J: 0, S: 12, Text: "Hello world!"}},
+	{Type: models.MSG, Sender: 0, Data: &models.MSGData{J: 1, S: 3, Payload: []byte{0, 1, 2, 255},
+		Headers: map[string]string{"content-type": "application/octet-stream", "topic": "foo", "trace-id": "abc"}}},
+	{Type: models.MSGack, Sender: 1, Data: &models.MSGackData{J: 0, S: 12}},
+	{Type: models.GOSSIP, Sender: 2, Data: &models.GOSSIPData{SeqJ: 100, TxObsSJ: -1, RxObsSJ: 99}},
+	{Type: models.HBFDheartbeat, Sender: 3},
+	{Type: models.THETAheartbeat, Sender: 4},
+	{Type: models.RECONF, Sender: 5, Data: &models.RECONFData{Epoch: 2, Proposer: 5, Processors: []models.Processor{
+		{ID: 0, Hostname: "node0", IPString: "127.0.0.1", IP: []byte{127, 0, 0, 1}}, {ID: 5},
+		{ID: 7, Hostname: "node7", IP: []byte{10, 0, 0, 7}, UDPPort: 5000, APIPort: 5001, MetricsPort: 5002, PublicKey: []byte{1, 2, 3}}}}},
+}
+
 func TestPackAndUnpack(t *testing.T) {
-	msg := models.Message{Type: models.MSG, Sender: 0, Data: map[string]interface{}{"foo": "bar"}}
+	msg := models.Message{Type: models.MSG, Sender: 0, Data: &models.MSGData{J: 1, S: 2, Text: "foo"}}
 	encoded, err := Pack(&msg)
 	assert.Assert(t, encoded != nil)
 	assert.Assert(t, err == nil)
@@ -22,5 +36,88 @@ func TestPackAndUnpack(t *testing.T) {
 	// check that message was correctly decoded
 	assert.Equal(t, decoded.Type, models.MSG)
 	assert.Equal(t, decoded.Sender, 0)
-	assert.Assert(t, reflect.DeepEqual(decoded.Data, map[string]interface{}{"foo": "bar"}))
+	assert.Assert(t, reflect.DeepEqual(decoded.Data, &models.MSGData{J: 1, S: 2, Text: "foo"}))
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		for _, msg := range testMessages {
+			encoded, err := codec.Pack(&msg)
+			assert.NilError(t, err)
+
+			// Unpack should detect the codec used
+			decoded, err := Unpack(encoded)
+			assert.NilError(t, err)
+			assert.Assert(t, reflect.DeepEqual(*decoded, msg), "%T decoded %v as %v", codec, msg, decoded)
+		}
+	}
+}
+
+func TestSelectCodec(t *testing.T) {
+	defer SelectCodec("binary")
+
+	assert.NilError(t, SelectCodec("json"))
+	encoded, err := Pack(&testMessages[0])
+	assert.NilError(t, err)
+	assert.Equal(t, encoded[0], byte('{'))
+
+	assert.NilError(t, SelectCodec("binary"))
+	encoded, err = Pack(&testMessages[0])
+	assert.NilError(t, err)
+	assert.Equal(t, encoded[0], BinaryCodecVersion)
+
+	assert.Error(t, SelectCodec("xml"), "Unknown codec xml")
 }
+
+func TestUnpackRejectsMalformedMessages(t *testing.T) {
+	valid, err := BinaryCodec{}.Pack(&testMessages[0])
+	assert.NilError(t, err)
+
+	malformed := map[string][]byte{
+		"empty":            {},
+		"unknown version":  {9, 0, 0},
+		"unknown type":     {BinaryCodecVersion, 42, 0},
+		"truncated":        valid[:len(valid)-3],
+		"trailing bytes":   append(append([]byte{}, valid...), 0),
+		"json unknown":     []byte(`{"Type": 42, "Sender": 0}`),
+		"json missing":     []byte(`{"Type": 0, "Sender": 0}`),
+		"json wrong field": []byte(`{"Type": 0, "Sender": 0, "Data": {"j": "foo"}}`),
+	}
+	for name, bytes := range malformed {
+		msg, err := Unpack(bytes)
+		assert.Assert(t, msg == nil, name)
+		assert.Assert(t, err != nil, name)
+	}
+
+	// data that does not match the message type cannot be packed
+	_, err = BinaryCodec{}.Pack(&models.Message{Type: models.MSG, Data: &models.MSGackData{}})
+	assert.Error(t, err, "Data *models.MSGackData does not match message type 0")
+}
+
+func benchmarkPack(b *testing.B, codec Codec) {
+	size := 0
+	for i := 0; i < b.N; i++ {
+		msg := testMessages[i%len(testMessages)]
+		encoded, _ := codec.Pack(&msg)
+		size += len(encoded)
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "bytes/msg")
+}
+
+func benchmarkUnpack(b *testing.B, codec Codec) {
+	encoded := [][]byte{}
+	for _, msg := range testMessages {
+		bytes, _ := codec.Pack(&msg)
+		encoded = append(encoded, bytes)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec.Unpack(encoded[i%len(encoded)])
+	}
+}
+
+func BenchmarkPackJSON(b *testing.B)     { benchmarkPack(b, JSONCodec{}) }
+func BenchmarkPackBinary(b *testing.B)   { benchmarkPack(b, BinaryCodec{}) }
+func BenchmarkUnpackJSON(b *testing.B)   { benchmarkUnpack(b, JSONCodec{}) }
+func BenchmarkUnpackBinary(b *testing.B) { benchmarkUnpack(b, BinaryCodec{}) }
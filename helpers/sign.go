@@ -0,0 +1,109 @@
+package helpers
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// SignedMagic is written as the first byte of every signed datagram, it must differ from the first byte of packed
+// messages, fragments and batches
+const SignedMagic byte = 0xA5
+
+// SignatureOverhead is the number of bytes signing adds to a datagram, i.e. the magic byte, signer id, counter and
+// signature
+const SignatureOverhead = 1 + 4 + 8 + ed25519.SignatureSize
+
+// ErrUnsigned is returned when verifying a datagram that is not signed
+var ErrUnsigned = errors.New("Datagram is not signed")
+
+// ErrUnknownSigner is returned when verifying a datagram signed by a processor without a known public key
+var ErrUnknownSigner = errors.New("Datagram is signed by an unknown processor")
+
+// ErrBadSignature is returned when verifying a datagram whose signature does not match its content
+var ErrBadSignature = errors.New("Signature of datagram is invalid")
+
+// ErrReplayed is returned when a datagram carries a counter its signer has already used, or that is too old or too far
+// ahead of the clock of the receiver
+var ErrReplayed = errors.New("Datagram is replayed")
+
+// IsSigned returns true if datagram is signed
+func IsSigned(datagram []byte) bool {
+	return len(datagram) > 0 && datagram[0] == SignedMagic
+}
+
+// Sign prefixes datagram with the id of the signer, a counter that the signer never uses twice and an ed25519
+// signature over all three, made with key
+func Sign(datagram []byte, signer int, counter uint64, key ed25519.PrivateKey) []byte {
+	signed := make([]byte, SignatureOverhead, SignatureOverhead+len(datagram))
+	signed[0] = SignedMagic
+	binary.BigEndian.PutUint32(signed[1:], uint32(signer))
+	binary.BigEndian.PutUint64(signed[5:], counter)
+	signed = append(signed, datagram...)
+
+	copy(signed[13:SignatureOverhead], ed25519.Sign(key, signedContent(signed)))
+	return signed
+}
+
+// Verify checks the signature of a datagram created by Sign against the public key returned by keys for its signer,
+// returning the signer, its counter and the datagram that was signed. Checking that the counter was not used before
+// is up to the caller
+func Verify(signed []byte, keys func(signer int) ed25519.PublicKey) (int, uint64, []byte, error) {
+	if !IsSigned(signed) || len(signed) <= SignatureOverhead {
+		return -1, 0, nil, ErrUnsigned
+	}
+
+	signer := int(binary.BigEndian.Uint32(signed[1:]))
+	counter := binary.BigEndian.Uint64(signed[5:])
+	key := keys(signer)
+	if len(key) != ed25519.PublicKeySize {
+		return signer, counter, nil, ErrUnknownSigner
+	} else if !ed25519.Verify(key, signedContent(signed), signed[13:SignatureOverhead]) {
+		return signer, counter, nil, ErrBadSignature
+	}
+
+	return signer, counter, signed[SignatureOverhead:], nil
+}
+
+// signedContent returns the parts of a signed datagram covered by the signature, i.e. the signer id, the counter and
+// the datagram
+func signedContent(signed []byte) []byte {
+	content := make([]byte, 0, len(signed)-1-ed25519.SignatureSize)
+	content = append(content, signed[1:13]...)
+	return append(content, signed[SignatureOverhead:]...)
+}
+
+// ParsePublicKey decodes a base64 encoded ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("public key is not base64 encoded: %v", err)
+	} else if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return key, nil
+}
+
+// ReadPrivateKey reads a base64 encoded ed25519 private key or seed from the file at path
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("private key in %s is not base64 encoded: %v", path, err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("private key in %s must be %d or %d bytes, got %d", path, ed25519.SeedSize, ed25519.PrivateKeySize, len(key))
+}
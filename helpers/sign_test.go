@@ -0,0 +1,76 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NilError(t, err)
+	keys := func(signer int) ed25519.PublicKey {
+		if signer == 3 {
+			return public
+		}
+		return nil
+	}
+
+	datagram := []byte{1, 2, 3}
+	signed := Sign(datagram, 3, 42, private)
+	assert.Equal(t, len(signed), len(datagram)+SignatureOverhead)
+	assert.Assert(t, IsSigned(signed))
+	signer, counter, verified, err := Verify(signed, keys)
+	assert.NilError(t, err)
+	assert.Equal(t, signer, 3)
+	assert.Equal(t, counter, uint64(42))
+	assert.Assert(t, bytes.Equal(verified, datagram))
+
+	// tampering with the content, the counter or the signer is detected
+	tampered := append([]byte{}, signed...)
+	tampered[len(tampered)-1]++
+	_, _, _, err = Verify(tampered, keys)
+	assert.Equal(t, err, ErrBadSignature)
+	tampered = Sign(datagram, 3, 42, private)
+	tampered[12]++
+	_, _, _, err = Verify(tampered, keys)
+	assert.Equal(t, err, ErrBadSignature)
+	tampered = Sign(datagram, 3, 42, private)
+	tampered[4] = 4
+	_, _, _, err = Verify(tampered, keys)
+	assert.Equal(t, err, ErrUnknownSigner)
+
+	_, _, _, err = Verify(datagram, keys)
+	assert.Equal(t, err, ErrUnsigned)
+	_, _, _, err = Verify(signed[:SignatureOverhead], keys)
+	assert.Equal(t, err, ErrUnsigned)
+}
+
+func TestParseKeys(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NilError(t, err)
+
+	parsed, err := ParsePublicKey(base64.StdEncoding.EncodeToString(public) + "\n")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, parsed, public)
+
+	// private keys are read either as seeds or in full
+	file, err := ioutil.TempFile("", "ssurb-key")
+	assert.NilError(t, err)
+	defer os.Remove(file.Name())
+	for _, content := range [][]byte{private.Seed(), private} {
+		assert.NilError(t, ioutil.WriteFile(file.Name(), []byte(base64.StdEncoding.EncodeToString(content)+"\n"), 0600))
+		read, err := ReadPrivateKey(file.Name())
+		assert.NilError(t, err)
+		assert.DeepEqual(t, read, private)
+	}
+
+	assert.NilError(t, ioutil.WriteFile(file.Name(), []byte("AAEC"), 0600))
+	_, err = ReadPrivateKey(file.Name())
+	assert.ErrorContains(t, err, "must be 32 or 64 bytes, got 3")
+}
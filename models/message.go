@@ -14,11 +14,44 @@ const (
 	HBFDheartbeat MessageType = 3
 	// THETAheartbeat represents a hbfd message
 	THETAheartbeat MessageType = 4
+	// RECONF represents a membership view, used to let processors join and leave
+	RECONF MessageType = 5
 )
 
 // Message represents a message sent between two processors over UDP
 type Message struct {
 	Type   MessageType
 	Sender int
-	Data   map[string]interface{}
+	// Data holds the payload matching Type, i.e. *MSGData, *MSGackData, *GOSSIPData, *RECONFData or nil for heartbeats
+	Data interface{}
+}
+
+// MSGData is the payload of a MSG message, carrying the message with identifier (J, S)
+type MSGData struct {
+	J       int               `json:"j"`
+	S       int               `json:"s"`
+	Text    string            `json:"msgText"`
+	Payload []byte            `json:"payload,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// MSGackData is the payload of a MSGack message, acknowledging the message with identifier (J, S)
+type MSGackData struct {
+	J int `json:"j"`
+	S int `json:"s"`
+}
+
+// GOSSIPData is the payload of a GOSSIP message
+type GOSSIPData struct {
+	SeqJ    int `json:"seqJ"`
+	TxObsSJ int `json:"txObsSJ"`
+	RxObsSJ int `json:"rxObsSJ"`
+}
+
+// RECONFData is the payload of a RECONF message, holding the membership view with the given epoch. Views with equal
+// epochs are ordered by the id of the proposing processor
+type RECONFData struct {
+	Epoch      int         `json:"epoch"`
+	Proposer   int         `json:"proposer"`
+	Processors []Processor `json:"processors"`
 }
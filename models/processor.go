@@ -2,16 +2,67 @@ package models
 
 import (
 	"fmt"
+	"net"
 )
 
 // Processor represents a server/node in the network
 type Processor struct {
 	ID       int
 	Hostname string
+	// IPString is empty if the ip was resolved from Hostname, in which case it is re-resolved when sending fails
 	IPString string
 	IP       []byte
+	// UDPPort, APIPort and MetricsPort are optional, use the getters to fall back to the defaults derived from ID
+	UDPPort     int
+	APIPort     int
+	MetricsPort int
+	// PublicKey is the ed25519 key the processor signs its messages with, required if messages are authenticated
+	PublicKey []byte
+}
+
+// GetUDPPort returns the port of the udp server of the processor, defaults to 4000 + ID
+func (p Processor) GetUDPPort() int {
+	if p.UDPPort != 0 {
+		return p.UDPPort
+	}
+	return 4000 + p.ID
+}
+
+// GetAPIPort returns the port of the api of the processor, defaults to 4000 + ID
+func (p Processor) GetAPIPort() int {
+	if p.APIPort != 0 {
+		return p.APIPort
+	}
+	return 4000 + p.ID
+}
+
+// GetMetricsPort returns the port of the prometheus metrics of the processor, defaults to 2112 + ID
+func (p Processor) GetMetricsPort() int {
+	if p.MetricsPort != 0 {
+		return p.MetricsPort
+	}
+	return 2112 + p.ID
+}
+
+// ValidatePorts returns an error if any port of the processor, including the defaults derived from ID, is not between
+// 1 and 65535
+func (p Processor) ValidatePorts() error {
+	ports := []struct {
+		name string
+		port int
+	}{{"udp port", p.GetUDPPort()}, {"api port", p.GetAPIPort()}, {"metrics port", p.GetMetricsPort()}}
+	for _, x := range ports {
+		if x.port < 1 || x.port > 65535 {
+			return fmt.Errorf("%s %d of processor %d is not between 1 and 65535, ports default to 4000 + id and 2112 + id", x.name, x.port, p.ID)
+		}
+	}
+	return nil
 }
 
 func (p Processor) String() string {
-	return fmt.Sprintf("Processor %d - %s - %s", p.ID, p.Hostname, p.IPString)
+	ip := p.IPString
+	if ip == "" && p.IP != nil {
+		ip = net.IP(p.IP).String()
+	}
+	return fmt.Sprintf("Processor %d - %s - %s - %d", p.ID, p.Hostname, ip, p.GetUDPPort())
 }
@@ -53,7 +53,7 @@ log "Starting $INSTANCE_COUNT node(s) locally"
 for (( i=0; i<=$(($INSTANCE_COUNT-1)); i++ ))
 do
     log "Starting node $i"
-    ID=$i IP=$IP ENV="DEV" go run main.go &
+    go run ./cmd/ssurb -id $i -bind-ip $IP -hosts hosts.txt &
 done
 
 while true; do sleep 2; done
@@ -0,0 +1,173 @@
+package ssurb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// Authenticator signs all datagrams sent by a processor and verifies the datagrams it receives against the public
+// keys of the other processors, so that no host can forge messages on behalf of a processor without its private key.
+// Every datagram carries a counter taken from the clock of its signer, which is accepted only once and only within
+// constants.ReplayWindow of the clock of the receiver, so that captured datagrams can not be replayed. The clocks of all
+// processors must therefore agree within constants.ReplayWindow
+type Authenticator struct {
+	ID  int
+	Key ed25519.PrivateKey
+	// Now is optional and replaces the clock counters are taken from and checked against
+	Now func() time.Time
+
+	// mux guards keys, which holds the public key of every processor by id, counter, which is the last counter used
+	// when signing, and seen, which holds the counters accepted from every processor within the replay window
+	mux     sync.Mutex
+	keys    map[int]ed25519.PublicKey
+	counter uint64
+	seen    map[int]*replayWindow
+}
+
+// replayWindow holds the counters accepted from a processor that are not older than the replay window, counters
+// older than pruned are removed each time the highest one moved by a window
+type replayWindow struct {
+	highest  uint64
+	pruned   uint64
+	counters map[uint64]bool
+}
+
+// NewAuthenticator returns an authenticator signing with key on behalf of processor id. All processors must have a
+// public key, and the one of processor id must match key
+func NewAuthenticator(id int, key ed25519.PrivateKey, processors []models.Processor) (*Authenticator, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("Private key must be %d bytes, got %d", ed25519.PrivateKeySize, len(key))
+	}
+
+	a := &Authenticator{ID: id, Key: key}
+	if err := a.SetProcessors(processors); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(key.Public().(ed25519.PublicKey), a.publicKey(id)) {
+		return nil, fmt.Errorf("Public key of processor %d does not match its private key", id)
+	}
+	return a, nil
+}
+
+// SetProcessors replaces the public keys that datagrams are verified against. Processors without a valid public key
+// are left out, so that their datagrams are rejected, and reported in the returned error
+func (a *Authenticator) SetProcessors(processors []models.Processor) error {
+	keys := map[int]ed25519.PublicKey{}
+	missing := []int{}
+	for _, p := range processors {
+		if len(p.PublicKey) != ed25519.PublicKeySize {
+			missing = append(missing, p.ID)
+			continue
+		}
+		keys[p.ID] = p.PublicKey
+	}
+
+	a.mux.Lock()
+	a.keys = keys
+	a.mux.Unlock()
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Processors %v have no valid public key", missing)
+	}
+	return nil
+}
+
+// Sign signs datagram on behalf of this processor with the current time as counter, or the next one if the clock did
+// not move since the last datagram
+func (a *Authenticator) Sign(datagram []byte) []byte {
+	a.mux.Lock()
+	a.counter = maxCounter(uint64(a.now().UnixNano()), a.counter+1)
+	counter := a.counter
+	a.mux.Unlock()
+
+	return helpers.Sign(datagram, a.ID, counter, a.Key)
+}
+
+// Verify checks that datagram is signed by a known processor and was not received before, returning the id of the
+// signer and the datagram that was signed
+func (a *Authenticator) Verify(datagram []byte) (int, []byte, error) {
+	signer, counter, datagram, err := helpers.Verify(datagram, a.publicKey)
+	if err != nil {
+		return signer, nil, err
+	} else if !a.accept(signer, counter) {
+		return signer, nil, helpers.ErrReplayed
+	}
+	return signer, datagram, nil
+}
+
+// accept records counter of signer, returning false if it was accepted before or is older than the replay window,
+// measured from the clock of this processor as well as from the latest counter of signer. Counters more than the replay
+// window ahead of the clock of this processor are rejected without being recorded, so that a signer whose clock was
+// ahead for a while is not locked out once its clock is set back
+func (a *Authenticator) accept(signer int, counter uint64) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.seen == nil {
+		a.seen = map[int]*replayWindow{}
+	}
+	w, exists := a.seen[signer]
+	if !exists {
+		w = &replayWindow{counters: map[uint64]bool{}}
+		a.seen[signer] = w
+	}
+
+	window := uint64(constants.ReplayWindow)
+	now := uint64(a.now().UnixNano())
+	if counter > now+window {
+		return false
+	}
+	oldest := maxCounter(now, w.highest)
+	if oldest > window {
+		oldest -= window
+	} else {
+		oldest = 0
+	}
+	if counter < oldest || counter < w.pruned || w.counters[counter] {
+		return false
+	}
+
+	w.counters[counter] = true
+	w.highest = maxCounter(w.highest, counter)
+	if oldest > w.pruned+window {
+		for c := range w.counters {
+			if c < oldest {
+				delete(w.counters, c)
+			}
+		}
+		w.pruned = oldest
+	}
+	return true
+}
+
+// now returns the current time of the clock counters are taken from
+func (a *Authenticator) now() time.Time {
+	if a.Now != nil {
+		return a.Now()
+	}
+	return time.Now()
+}
+
+// maxCounter returns the larger of two counters
+func maxCounter(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// publicKey returns the public key of processor id, or nil if it is not known
+func (a *Authenticator) publicKey(id int) ed25519.PublicKey {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	return a.keys[id]
+}
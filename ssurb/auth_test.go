@@ -0,0 +1,196 @@
+package ssurb
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/assert"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// generateKeys returns processors with ids 0 to n-1 listening on consecutive ports from port, along with their
+// private keys
+func generateKeys(t *testing.T, n int, port int) ([]models.Processor, []ed25519.PrivateKey) {
+	processors := []models.Processor{}
+	keys := []ed25519.PrivateKey{}
+	for id := 0; id < n; id++ {
+		public, private, err := ed25519.GenerateKey(nil)
+		assert.NilError(t, err)
+		processors = append(processors, models.Processor{ID: id, IP: []byte{127, 0, 0, 1}, UDPPort: port + id, PublicKey: public})
+		keys = append(keys, private)
+	}
+	return processors, keys
+}
+
+// counterValue returns the current value of c
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	assert.NilError(t, c.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestNewAuthenticatorChecksKeys(t *testing.T) {
+	processors, keys := generateKeys(t, 2, PORT)
+
+	_, err := NewAuthenticator(0, keys[1], processors)
+	assert.Error(t, err, "Public key of processor 0 does not match its private key")
+	_, err = NewAuthenticator(0, keys[0][:10], processors)
+	assert.ErrorContains(t, err, "Private key must be 64 bytes")
+
+	processors[1].PublicKey = nil
+	_, err = NewAuthenticator(0, keys[0], processors)
+	assert.Error(t, err, "Processors [1] have no valid public key")
+}
+
+func TestAuthenticatorRejectsReplays(t *testing.T) {
+	processors, keys := generateKeys(t, 2, PORT)
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	sender, err := NewAuthenticator(1, keys[1], processors)
+	assert.NilError(t, err)
+	sender.Now = clock
+	receiver, err := NewAuthenticator(0, keys[0], processors)
+	assert.NilError(t, err)
+	receiver.Now = clock
+
+	// datagrams signed at the same time still get distinct counters, and each is accepted only once
+	first, second := sender.Sign([]byte{1}), sender.Sign([]byte{2})
+	for _, datagram := range [][]byte{second, first} {
+		signer, _, err := receiver.Verify(datagram)
+		assert.NilError(t, err)
+		assert.Equal(t, signer, 1)
+	}
+	_, _, err = receiver.Verify(first)
+	assert.Equal(t, err, helpers.ErrReplayed)
+
+	// once the replay window passed, datagrams are rejected even by a receiver that never saw them
+	now = now.Add(constants.ReplayWindow + time.Second)
+	late := sender.Sign([]byte{3})
+	_, _, err = receiver.Verify(late)
+	assert.NilError(t, err)
+	restarted, err := NewAuthenticator(0, keys[0], processors)
+	assert.NilError(t, err)
+	restarted.Now = clock
+	_, _, err = restarted.Verify(second)
+	assert.Equal(t, err, helpers.ErrReplayed)
+	_, _, err = restarted.Verify(late)
+	assert.NilError(t, err)
+}
+
+func TestAuthenticatorSurvivesClockSteps(t *testing.T) {
+	processors, keys := generateKeys(t, 2, PORT)
+	now := time.Unix(1000, 0)
+	senderNow := now
+	sender, err := NewAuthenticator(1, keys[1], processors)
+	assert.NilError(t, err)
+	sender.Now = func() time.Time { return senderNow }
+	receiver, err := NewAuthenticator(0, keys[0], processors)
+	assert.NilError(t, err)
+	receiver.Now = func() time.Time { return now }
+
+	// a datagram signed while the clock of the sender was far ahead is rejected, and does not lock the sender out once
+	// its clock is set back
+	senderNow = now.Add(time.Hour)
+	_, _, err = receiver.Verify(sender.Sign([]byte{1}))
+	assert.Equal(t, err, helpers.ErrReplayed)
+	senderNow = now
+	restarted, err := NewAuthenticator(1, keys[1], processors)
+	assert.NilError(t, err)
+	restarted.Now = sender.Now
+	_, _, err = receiver.Verify(restarted.Sign([]byte{2}))
+	assert.NilError(t, err)
+
+	// a clock ahead within the replay window is accepted, and the sender is accepted again right after stepping back
+	senderNow = now.Add(constants.ReplayWindow - time.Second)
+	_, _, err = receiver.Verify(restarted.Sign([]byte{3}))
+	assert.NilError(t, err)
+	now = now.Add(time.Second)
+	senderNow = now
+	restarted, err = NewAuthenticator(1, keys[1], processors)
+	assert.NilError(t, err)
+	restarted.Now = sender.Now
+	_, _, err = receiver.Verify(restarted.Sign([]byte{4}))
+	assert.NilError(t, err)
+}
+
+func TestServerRejectsUnauthenticatedMessages(t *testing.T) {
+	processors, keys := generateKeys(t, 2, PORT+10)
+	receiver, err := NewAuthenticator(0, keys[0], processors)
+	assert.NilError(t, err)
+	resolver := &chanResolver{dispatched: make(chan *models.Message, 10)}
+	server := &Server{IP: IP, Port: PORT + 10, Resolver: resolver, Auth: receiver}
+	assert.NilError(t, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
+
+	rejected := func(reason string) float64 {
+		return counterValue(t, sharedServerMetrics.RejectedCount.WithLabelValues(reason))
+	}
+	before := map[string]float64{}
+	reasons := []string{sharedServerMetrics.UnsignedRejection, sharedServerMetrics.UnknownSignerRejection,
+		sharedServerMetrics.BadSignatureRejection, sharedServerMetrics.ReplayedRejection,
+		sharedServerMetrics.SenderMismatchRejection}
+	for _, reason := range reasons {
+		before[reason] = rejected(reason)
+	}
+
+	// a processor signing with the key of processor 1 but claiming to be processor 0, a host without any of the
+	// keys trying to pass as processor 1 and a host replaying a datagram of processor 1 captured long ago
+	forged := &models.Message{Type: models.MSGack, Sender: 0, Data: &models.MSGackData{J: 0, S: 1}}
+	payload, err := helpers.Pack(forged)
+	assert.NilError(t, err)
+	captured, err := helpers.Pack(&models.Message{Type: models.MSGack, Sender: 1, Data: &models.MSGackData{J: 0, S: 1}})
+	assert.NilError(t, err)
+	_, intruderKey, err := ed25519.GenerateKey(nil)
+	assert.NilError(t, err)
+	now := uint64(time.Now().UnixNano())
+	datagrams := [][]byte{
+		payload,
+		helpers.Sign(payload, 1, now, keys[1]),
+		helpers.Sign(payload, 1, now, intruderKey),
+		helpers.Sign(payload, 2, now, intruderKey),
+		helpers.Sign(captured, 1, now-2*uint64(constants.ReplayWindow), keys[1]),
+	}
+	conn := newClientConn(t)
+	defer conn.Close()
+	_, err = write(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: PORT + 10}, datagrams, 0)
+	assert.NilError(t, err)
+
+	// only messages signed by their sender are dispatched
+	transport := &UDPTransport{Processors: processors}
+	transport.Auth, err = NewAuthenticator(1, keys[1], processors)
+	assert.NilError(t, err)
+	defer transport.Close()
+	transport.SendToProcessor(0, &models.Message{Type: models.MSGack, Sender: 1, Data: &models.MSGackData{J: 0, S: 2}})
+	select {
+	case msg := <-resolver.dispatched:
+		assert.Equal(t, msg.Sender, 1)
+		assert.Equal(t, msg.Data.(*models.MSGackData).S, 2)
+	case <-time.After(5 * time.Second):
+		t.Fatal("signed message was not dispatched")
+	}
+
+	total := func() float64 {
+		sum := 0.0
+		for _, reason := range reasons {
+			sum += rejected(reason) - before[reason]
+		}
+		return sum
+	}
+	for i := 0; i < 50 && total() < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, reason := range reasons {
+		assert.Equal(t, rejected(reason)-before[reason], float64(1), reason)
+	}
+	assert.Equal(t, len(resolver.dispatched), 0)
+}
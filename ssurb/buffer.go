@@ -1,10 +1,21 @@
 package ssurb
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+)
 
-// Buffer holds a number of Records
+// Buffer holds a number of Records. Besides the order they were added in, records are indexed by identifier and by
+// sender in the order of their sequence numbers, so that lookups do not scan the whole buffer. The zero value is an
+// empty buffer
 type Buffer struct {
-	Records []*BufferRecord
+	// records holds all records in the order they were added
+	records []*BufferRecord
+	// byID holds the first record added per identifier
+	byID map[Identifier]*BufferRecord
+	// bySender holds the records of every sender ordered by sequence number, records with the same identifier in the
+	// order they were added
+	bySender map[int][]*BufferRecord
 }
 
 // Identifier is a pair (ID, Seq) associating a message with the sender and its local sequence number
@@ -23,23 +34,103 @@ type BufferRecord struct {
 	Delivered bool
 	// set that includes the identifiers of processors that have acknowledge the message msg
 	RecBy map[int]bool
-	// value of the HB failure detector
-	PrevHB []int
+	// value of the HB failure detector, keyed by processor id
+	PrevHB map[int]int
 }
 
-// Get is a helper function that can be used to check membership for a BufferRecord in a Buffer. Returns nil if no record exists with id
-func (b Buffer) Get(id Identifier) *BufferRecord {
-	for _, r := range b.Records {
-		if r.Identifier == id {
-			return r
-		}
+// NewBuffer returns a buffer holding records in the given order
+func NewBuffer(records ...*BufferRecord) *Buffer {
+	b := &Buffer{}
+	for _, r := range records {
+		b.Add(r)
 	}
-	return nil
+	return b
+}
+
+// Get is a helper function that can be used to check membership for a BufferRecord in a Buffer. Returns the first
+// record added with id, or nil if no record exists with id
+func (b *Buffer) Get(id Identifier) *BufferRecord {
+	return b.byID[id]
 }
 
-// Add is a wrapper to make it cleaner to add records to the buffer
+// Add is a wrapper to make it cleaner to add records to the buffer. The identifier of a record must not change once
+// it is added
 func (b *Buffer) Add(br *BufferRecord) {
-	b.Records = append(b.Records, br)
+	if b.byID == nil {
+		b.byID = map[Identifier]*BufferRecord{}
+		b.bySender = map[int][]*BufferRecord{}
+	}
+
+	b.records = append(b.records, br)
+	if _, exists := b.byID[br.Identifier]; !exists {
+		b.byID[br.Identifier] = br
+	}
+
+	// records mostly arrive in order, in which case this appends
+	records := b.bySender[br.Identifier.ID]
+	idx := sort.Search(len(records), func(i int) bool { return records[i].Identifier.Seq > br.Identifier.Seq })
+	records = append(records, nil)
+	copy(records[idx+1:], records[idx:])
+	records[idx] = br
+	b.bySender[br.Identifier.ID] = records
+}
+
+// Records returns all records in the order they were added, the returned slice must not be modified
+func (b *Buffer) Records() []*BufferRecord {
+	return b.records
+}
+
+// Len returns the number of records in the buffer
+func (b *Buffer) Len() int {
+	return len(b.records)
+}
+
+// Senders returns the ids of all processors with records in the buffer in ascending order
+func (b *Buffer) Senders() []int {
+	senders := make([]int, 0, len(b.bySender))
+	for id := range b.bySender {
+		senders = append(senders, id)
+	}
+	sort.Ints(senders)
+	return senders
+}
+
+// Sender returns the records of processor id ordered by sequence number, the returned slice must not be modified
+func (b *Buffer) Sender(id int) []*BufferRecord {
+	return b.bySender[id]
+}
+
+// MaxSeq returns the highest sequence number of the records of processor id, or -1 if there are none
+func (b *Buffer) MaxSeq(id int) int {
+	records := b.bySender[id]
+	if len(records) == 0 {
+		return -1
+	}
+	return records[len(records)-1].Identifier.Seq
+}
+
+// Filter removes all records for which keep returns false. keep is called for every record in the order they were
+// added, before any of them is removed
+func (b *Buffer) Filter(keep func(r *BufferRecord) bool) {
+	kept := []*BufferRecord{}
+	for _, r := range b.records {
+		if keep(r) {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == len(b.records) {
+		return
+	}
+
+	*b = Buffer{}
+	for _, r := range kept {
+		b.Add(r)
+	}
+}
+
+// Clear removes all records
+func (b *Buffer) Clear() {
+	*b = Buffer{}
 }
 
 func (br *BufferRecord) String() string {
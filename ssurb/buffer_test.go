@@ -1,14 +1,16 @@
 package ssurb
 
 import (
+	"math/rand"
 	"testing"
 
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
 	"gotest.tools/assert"
 )
 
 func TestGet(t *testing.T) {
 	// init buffer and add 3 records
-	buf := Buffer{Records: []*BufferRecord{}}
+	buf := Buffer{}
 	r := BufferRecord{Identifier: Identifier{ID: 0, Seq: 0}}
 	r2 := BufferRecord{Identifier: Identifier{ID: 0, Seq: 1}}
 	r3 := BufferRecord{Identifier: Identifier{ID: 0, Seq: 2}}
@@ -17,20 +19,198 @@ func TestGet(t *testing.T) {
 	buf.Add(&r3)
 
 	// make sure that Get returns correct record for a given identifier and nil if no record with id exists in buffer
-	assert.Equal(t, len(buf.Records), 3)
+	assert.Equal(t, buf.Len(), 3)
 	assert.Equal(t, buf.Get(Identifier{ID: 0, Seq: 0}).Identifier, Identifier{ID: 0, Seq: 0})
 	assert.Assert(t, buf.Get(Identifier{ID: 1, Seq: 0}) == nil)
 }
 
 func TestAdd(t *testing.T) {
 	// init buffer and check that a record can be added
-	buf := Buffer{Records: []*BufferRecord{}}
-	assert.Equal(t, len(buf.Records), 0)
+	buf := Buffer{}
+	assert.Equal(t, buf.Len(), 0)
 	buf.Add(&BufferRecord{Identifier: Identifier{ID: 0, Seq: 0}})
-	assert.Equal(t, len(buf.Records), 1)
+	assert.Equal(t, buf.Len(), 1)
 
 	// adding another record should (not surprisingly) add that record to the buffer
 	buf.Add(&BufferRecord{Identifier: Identifier{ID: 0, Seq: 1}})
-	assert.Equal(t, len(buf.Records), 2)
-	assert.Equal(t, buf.Records[1].Identifier, Identifier{ID: 0, Seq: 1})
+	assert.Equal(t, buf.Len(), 2)
+	assert.Equal(t, buf.Records()[1].Identifier, Identifier{ID: 0, Seq: 1})
+}
+
+// randomRecords returns n records of the given number of senders in random order, some of them with the same
+// identifier, delivered and acked by processors 0 and 1 at random
+func randomRecords(rng *rand.Rand, n int, senders int) []*BufferRecord {
+	records := []*BufferRecord{}
+	for i := 0; i < n; i++ {
+		recBy := map[int]bool{0: true}
+		if rng.Intn(4) > 0 {
+			recBy[1] = true
+		}
+		id := Identifier{ID: rng.Intn(senders), Seq: rng.Intn(n / senders * 2)}
+		records = append(records, &BufferRecord{Msg: &UrbMessage{}, Identifier: id, Delivered: rng.Intn(4) > 0, RecBy: recBy})
+	}
+	return records
+}
+
+func TestBufferIndexes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	records := randomRecords(rng, 500, 7)
+	buf := NewBuffer(records...)
+	assert.Equal(t, buf.Len(), 500)
+	assert.DeepEqual(t, buf.Records(), records)
+	assert.DeepEqual(t, buf.Senders(), []int{0, 1, 2, 3, 4, 5, 6})
+
+	// the indexes must agree with scanning the records in the order they were added
+	for _, sender := range buf.Senders() {
+		maxSeq := -1
+		count := 0
+		for _, r := range records {
+			if r.Identifier.ID == sender {
+				maxSeq = max(maxSeq, r.Identifier.Seq)
+				count++
+			}
+		}
+		assert.Equal(t, buf.MaxSeq(sender), maxSeq)
+		assert.Equal(t, len(buf.Sender(sender)), count)
+		for i, r := range buf.Sender(sender) {
+			if i > 0 {
+				assert.Assert(t, buf.Sender(sender)[i-1].Identifier.Seq <= r.Identifier.Seq)
+			}
+		}
+	}
+	for seq := 0; seq < 200; seq++ {
+		id := Identifier{ID: 3, Seq: seq}
+		var first *BufferRecord
+		for _, r := range records {
+			if r.Identifier == id {
+				first = r
+				break
+			}
+		}
+		assert.Assert(t, buf.Get(id) == first, "identifier %v", id)
+	}
+	assert.Equal(t, buf.MaxSeq(7), -1)
+
+	// filtering keeps the order of the records and the indexes
+	buf.Filter(func(r *BufferRecord) bool { return r.Delivered })
+	for _, r := range buf.Records() {
+		assert.Assert(t, r.Delivered)
+		assert.Assert(t, buf.Get(r.Identifier).Delivered)
+	}
+	for _, r := range buf.Sender(3) {
+		assert.Assert(t, r.Delivered)
+	}
+	buf.Clear()
+	assert.Equal(t, buf.Len(), 0)
+	assert.Assert(t, buf.Get(records[0].Identifier) == nil)
+}
+
+func TestIndexedBufferMatchesScans(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		modules := []*UrbModule{}
+		for i := 0; i < 2; i++ {
+			mod, r := bootstrap()
+			mod.Params.BufferUnitSize = 10
+			r.TrustedRet = []int{0, 1}
+			rng := rand.New(rand.NewSource(seed))
+			mod.Buffer = NewBuffer(randomRecords(rng, 300, len(mod.P))...)
+			for _, k := range mod.P {
+				mod.RxObsS[k] = rng.Intn(20) - 1
+				mod.TxObsS[k] = rng.Intn(20) - 1
+			}
+			modules = append(modules, mod)
+		}
+
+		// the second module runs the scans over all records the buffer was indexed to avoid
+		indexed, scanned := modules[0], modules[1]
+		indexed.updateReceiverCounters()
+		indexed.trimBuffer()
+		for {
+			var obsolete *BufferRecord
+			for _, r := range scanned.Buffer.Records() {
+				if scanned.obsolete(r) {
+					obsolete = r
+					break
+				}
+			}
+			if obsolete == nil {
+				break
+			}
+			scanned.RxObsS[obsolete.Identifier.ID]++
+		}
+		kept := []*BufferRecord{}
+		for _, r := range scanned.Buffer.Records() {
+			k, s := r.Identifier.ID, r.Identifier.Seq
+			maxSeq := -1
+			for _, other := range scanned.Buffer.Records() {
+				if other.Identifier.ID == k && other.Identifier.Seq > maxSeq {
+					maxSeq = other.Identifier.Seq
+				}
+			}
+			if (k == scanned.ID && scanned.minTxObsS() < s) ||
+				(k != scanned.ID && contains(scanned.P, k) && scanned.RxObsS[k] < s && maxSeq-scanned.Params.bufferUnitSize() <= s) {
+				kept = append(kept, r)
+			}
+		}
+
+		assert.Assert(t, len(kept) > 0 && len(kept) < 300)
+		assert.DeepEqual(t, indexed.RxObsS, scanned.RxObsS)
+		assert.DeepEqual(t, indexed.Buffer.Records(), kept)
+	}
+}
+
+// benchmarkModule runs step on a module whose buffer holds a full receiving window of messages that are not acked
+// yet from each of the given number of senders
+func benchmarkModule(b *testing.B, senders int, step func(m *UrbModule)) {
+	P := []int{}
+	for id := 0; id < senders; id++ {
+		P = append(P, id)
+	}
+	r := &MockResolver{Modules: map[ModuleType]interface{}{}, TrustedRet: P, HbRet: constMap(P, 0)}
+	mod := &UrbModule{ID: 0, P: P, Resolver: r}
+	mod.Init()
+	mod.RxObsS = constMap(P, 0)
+	mod.TxObsS = constMap(P, 0)
+	helpers.SetUnitTestingEnv()
+
+	for _, id := range P[1:] {
+		for s := 1; s <= mod.Params.bufferUnitSize(); s++ {
+			mod.Buffer.Add(&BufferRecord{Msg: &UrbMessage{}, Identifier: Identifier{ID: id, Seq: s}, RecBy: map[int]bool{id: true}, PrevHB: constMap(P, 0)})
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		step(mod)
+	}
+	if mod.Buffer.Len() != (senders-1)*mod.Params.bufferUnitSize() {
+		b.Fatalf("buffer holds %d records", mod.Buffer.Len())
+	}
+}
+
+// windowChecks runs the parts of the do forever loop that look up records by sender
+func windowChecks(m *UrbModule) {
+	m.checkTransmitWindow()
+	m.checkReceivingWindow()
+	m.updateReceiverCounters()
+	m.trimBuffer()
+	m.gossip()
+}
+
+func BenchmarkStep10Senders(b *testing.B)         { benchmarkModule(b, 10, (*UrbModule).Step) }
+func BenchmarkStep50Senders(b *testing.B)         { benchmarkModule(b, 50, (*UrbModule).Step) }
+func BenchmarkWindowChecks10Senders(b *testing.B) { benchmarkModule(b, 10, windowChecks) }
+func BenchmarkWindowChecks50Senders(b *testing.B) { benchmarkModule(b, 50, windowChecks) }
+
+func BenchmarkBufferGet(b *testing.B) {
+	buf := NewBuffer(randomRecords(rand.New(rand.NewSource(1)), 5000, 50)...)
+	ids := []Identifier{}
+	for _, r := range buf.Records() {
+		ids = append(ids, r.Identifier)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Get(ids[i%len(ids)])
+	}
 }
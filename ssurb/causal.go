@@ -0,0 +1,131 @@
+package ssurb
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HeaderVectorClock carries the causal dependencies of a message broadcast in causal ordering. It lists, for every
+// other processor, the highest sequence number up to which the sender had delivered its messages, e.g. "1:4,3:2"
+const HeaderVectorClock = "vector-clock"
+
+// encodeVectorClock encodes vc as the value of HeaderVectorClock, leaving out processors without any message
+func encodeVectorClock(vc map[int]int) string {
+	ids := []Identifier{}
+	for id, seq := range vc {
+		if seq > 0 {
+			ids = append(ids, Identifier{ID: id, Seq: seq})
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a].ID < ids[b].ID })
+	return encodeIdentifiers(ids)
+}
+
+// decodeVectorClock decodes the value of HeaderVectorClock
+func decodeVectorClock(s string) (map[int]int, error) {
+	ids, err := decodeIdentifiers(s)
+	if err != nil {
+		return nil, err
+	}
+
+	vc := map[int]int{}
+	for _, id := range ids {
+		vc[id.ID] = id.Seq
+	}
+	return vc, nil
+}
+
+// encodeIdentifiers encodes ids as a comma separated list of id:seq entries
+func encodeIdentifiers(ids []Identifier) string {
+	entries := make([]string, len(ids))
+	for i, id := range ids {
+		entries[i] = fmt.Sprintf("%d:%d", id.ID, id.Seq)
+	}
+	return strings.Join(entries, ",")
+}
+
+// decodeIdentifiers decodes a list encoded by encodeIdentifiers
+func decodeIdentifiers(s string) ([]Identifier, error) {
+	ids := []Identifier{}
+	if s == "" {
+		return ids, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed identifier %q", entry)
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Malformed identifier %q: %v", entry, err)
+		}
+		seq, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Malformed identifier %q: %v", entry, err)
+		}
+		ids = append(ids, Identifier{ID: id, Seq: seq})
+	}
+	return ids, nil
+}
+
+// deliveredThrough returns the highest sequence number s such that all messages of processor k up to s are delivered
+// or obsolete
+func (m *UrbModule) deliveredThrough(k int) int {
+	s := m.RxObsS[k]
+	for _, r := range m.Buffer.Sender(k) {
+		if r.Identifier.Seq == s+1 && r.Delivered {
+			s++
+		} else if r.Identifier.Seq > s+1 {
+			break
+		}
+	}
+	return s
+}
+
+// attachVectorClock sets HeaderVectorClock of msg to the messages of other processors delivered so far, copying the
+// headers so that the ones of the caller are left untouched. Messages of this processor are ordered by their sequence
+// numbers and need no entry
+func (m *UrbModule) attachVectorClock(msg *UrbMessage) {
+	vc := map[int]int{}
+	for _, k := range m.P {
+		if k != m.ID {
+			vc[k] = m.deliveredThrough(k)
+		}
+	}
+
+	headers := map[string]string{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[HeaderVectorClock] = encodeVectorClock(vc)
+	msg.Headers = headers
+}
+
+// causallyReady returns true if all messages r depends on are delivered or obsolete, where next holds the first
+// sequence number per sender that is neither. Dependencies on processors that left the system are ignored, as are
+// malformed vector clocks since holding back the message would block its sender forever
+func (m *UrbModule) causallyReady(r *BufferRecord, next map[int]int) bool {
+	vc, err := decodeVectorClock(r.Msg.Headers[HeaderVectorClock])
+	if err != nil {
+		log.Printf("Ignoring vector clock of %v. Got error: %v", r.Identifier, err)
+		return true
+	}
+
+	for k, seq := range vc {
+		if !contains(m.P, k) {
+			continue
+		}
+		through := m.RxObsS[k]
+		if n, exists := next[k]; exists {
+			through = n - 1
+		}
+		if through < seq {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package ssurb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// inCausalOrder returns true if every node delivered a chain of replies in the order they were broadcast in, where
+// message i was broadcast upon delivering message i-1
+func inCausalOrder(sim *Simulator) bool {
+	for _, node := range sim.Nodes {
+		next := 0
+		for _, d := range node.Delivered {
+			if d.Msg.Text != fmt.Sprintf("Message %d", next) {
+				return false
+			}
+			next++
+		}
+	}
+	return true
+}
+
+// hasDelivered returns true if processor id delivered a message with the given text
+func hasDelivered(sim *Simulator, id int, text string) func() bool {
+	return func() bool {
+		for _, d := range sim.Nodes[id].Delivered {
+			if d.Msg.Text == text {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestVectorClockEncoding(t *testing.T) {
+	vc := map[int]int{3: 2, 1: 4, 2: -1, 5: 0}
+	assert.Equal(t, encodeVectorClock(vc), "1:4,3:2")
+
+	decoded, err := decodeVectorClock("1:4,3:2")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, map[int]int{1: 4, 3: 2})
+	decoded, err = decodeVectorClock("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(decoded), 0)
+
+	_, err = decodeVectorClock("1:4,3")
+	assert.Error(t, err, `Malformed identifier "3"`)
+}
+
+func TestCausalHoldsBackMessages(t *testing.T) {
+	mod, r, delivered := bootstrapOrdering(CausalOrdering)
+	r.TrustedRet = []int{0, 1, 2}
+	acked := func() map[int]bool { return map[int]bool{0: true, 1: true, 2: true} }
+
+	// processor 2 replied to message 1 of processor 1, which is not acked yet
+	reply := &UrbMessage{Headers: map[string]string{HeaderVectorClock: "1:1"}}
+	addRecord(mod, reply, Identifier{ID: 2, Seq: 1}, acked())
+	addRecord(mod, &UrbMessage{}, Identifier{ID: 1, Seq: 1}, map[int]bool{1: true})
+	processAndHandOver(mod)
+	assert.Equal(t, len(*delivered), 0)
+	assert.Equal(t, mod.HeldBackCount(), 1)
+
+	// once the message is acked, both are delivered in causal order, even though the reply comes first in the buffer
+	mod.Buffer.Get(Identifier{ID: 1, Seq: 1}).RecBy = acked()
+	processAndHandOver(mod)
+	assert.DeepEqual(t, *delivered, []Identifier{{ID: 1, Seq: 1}, {ID: 2, Seq: 1}})
+	assert.Equal(t, mod.HeldBackCount(), 0)
+
+	// a dependency that is given up on by the receiving window no longer holds back the message
+	reply = &UrbMessage{Headers: map[string]string{HeaderVectorClock: "1:2"}}
+	addRecord(mod, reply, Identifier{ID: 2, Seq: 2}, acked())
+	processAndHandOver(mod)
+	assert.Equal(t, mod.HeldBackCount(), 1)
+	mod.RxObsS[1] = 2
+	processAndHandOver(mod)
+	assert.Equal(t, (*delivered)[2], Identifier{ID: 2, Seq: 2})
+
+	// broadcasts carry the messages delivered so far without changing the headers of the caller
+	headers := map[string]string{HeaderTopic: "replies"}
+	mod.UrbBroadcast(&UrbMessage{Headers: headers})
+	assert.Equal(t, mod.Buffer.Get(Identifier{ID: 0, Seq: 1}).Msg.Headers[HeaderVectorClock], "1:2,2:2")
+	assert.Equal(t, mod.Buffer.Get(Identifier{ID: 0, Seq: 1}).Msg.Headers[HeaderTopic], "replies")
+	assert.Equal(t, len(headers), 1)
+
+	// a vector clock set by the application is replaced
+	mod.UrbBroadcast(&UrbMessage{Headers: map[string]string{HeaderVectorClock: "1:9"}})
+	assert.Equal(t, mod.Buffer.Get(Identifier{ID: 0, Seq: 2}).Msg.Headers[HeaderVectorClock], "1:2,2:2")
+}
+
+func TestSimulatorCausalHoldsBackReplies(t *testing.T) {
+	run := func(ordering Ordering) *Simulator {
+		sim := NewSimulator(3)
+		sim.SetOrdering(ordering)
+		faults := NewFaultInjector(7, LinkFaults{})
+		sim.SetFaults(faults)
+		sim.Run(time.Second)
+
+		// processor 2 hears about the reply of processor 1 through processor 0, but not that processor 1 got the
+		// message replied to, until the link is restored
+		faults.SetLink(Link{From: 1, To: 2}, LinkFaults{Loss: 1})
+		sim.Broadcast(0, &UrbMessage{Text: "Message 0"})
+		assert.Assert(t, sim.RunUntil(hasDelivered(sim, 1, "Message 0"), time.Minute))
+		sim.Broadcast(1, &UrbMessage{Text: "Message 1"})
+		sim.Run(2 * time.Second)
+		faults.SetLink(Link{From: 1, To: 2}, LinkFaults{})
+		assert.Assert(t, sim.RunUntil(allDelivered(sim, 2), time.Minute))
+		return sim
+	}
+
+	assert.Assert(t, !inCausalOrder(run(NoOrdering)))
+	sim := run(CausalOrdering)
+	assert.Assert(t, inCausalOrder(sim))
+	assert.Assert(t, strings.HasPrefix(sim.Nodes[2].Delivered[1].Msg.Headers[HeaderVectorClock], "0:1"))
+}
+
+func TestSimulatorCausalUnderReordering(t *testing.T) {
+	count := 12
+	sim := NewSimulator(3)
+	sim.SetOrdering(CausalOrdering)
+	sim.SetFaults(NewFaultInjector(7, LinkFaults{Loss: 0.2, Duplicate: 0.1, Reorder: 0.5, Delay: 2 * time.Second}))
+	sim.Run(time.Second)
+
+	// every message is a reply to the previous one, broadcast by the next processor once it delivered it
+	for i := 0; i < count; i++ {
+		sender := i % len(sim.Nodes)
+		if i > 0 {
+			assert.Assert(t, sim.RunUntil(hasDelivered(sim, sender, fmt.Sprintf("Message %d", i-1)), time.Minute))
+		}
+		sim.Broadcast(sender, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+	}
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, count), 2*time.Minute))
+	assert.Assert(t, inCausalOrder(sim))
+	for _, node := range sim.Nodes {
+		assert.Equal(t, len(node.Delivered), count)
+	}
+}
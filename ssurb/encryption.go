@@ -0,0 +1,56 @@
+package ssurb
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+)
+
+// Keyring holds the cluster keys that all datagrams sent between processors are encrypted with, so that neither
+// payloads nor control messages can be read or altered by hosts outside the cluster. The first key encrypts while
+// all keys decrypt, which lets the keys be rotated one processor at a time
+type Keyring struct {
+	// mux guards keys
+	mux  sync.Mutex
+	keys []*helpers.ClusterKey
+}
+
+// NewKeyring returns a keyring holding keys
+func NewKeyring(keys []*helpers.ClusterKey) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.SetKeys(keys); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// SetKeys replaces the keys of the keyring, the first one is used for encrypting from now on
+func (k *Keyring) SetKeys(keys []*helpers.ClusterKey) error {
+	if len(keys) == 0 {
+		return errors.New("At least one cluster key is needed")
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.keys = append([]*helpers.ClusterKey{}, keys...)
+	return nil
+}
+
+// Encrypt encrypts datagram with the current key
+func (k *Keyring) Encrypt(datagram []byte) ([]byte, error) {
+	k.mux.Lock()
+	key := k.keys[0]
+	k.mux.Unlock()
+
+	return helpers.Encrypt(datagram, key)
+}
+
+// Decrypt decrypts datagram with any of the keys
+func (k *Keyring) Decrypt(datagram []byte) ([]byte, error) {
+	k.mux.Lock()
+	keys := k.keys
+	k.mux.Unlock()
+
+	return helpers.Decrypt(datagram, keys)
+}
@@ -0,0 +1,126 @@
+package ssurb
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// newClusterKey returns a random cluster key
+func newClusterKey(t *testing.T) *helpers.ClusterKey {
+	raw := make([]byte, helpers.ClusterKeySize)
+	_, err := rand.Read(raw)
+	assert.NilError(t, err)
+	key, err := helpers.NewClusterKey(raw)
+	assert.NilError(t, err)
+	return key
+}
+
+func TestServerRejectsUnencryptedDatagrams(t *testing.T) {
+	oldKey, newKey := newClusterKey(t), newClusterKey(t)
+	keyring, err := NewKeyring([]*helpers.ClusterKey{newKey, oldKey})
+	assert.NilError(t, err)
+	resolver := &chanResolver{dispatched: make(chan *models.Message, 10)}
+	server := &Server{IP: IP, Port: PORT + 11, Resolver: resolver, Keyring: keyring}
+	assert.NilError(t, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
+
+	reasons := []string{sharedServerMetrics.UnencryptedRejection, sharedServerMetrics.UnknownKeyRejection, sharedServerMetrics.DecryptRejection}
+	before := map[string]float64{}
+	for _, reason := range reasons {
+		before[reason] = counterValue(t, sharedServerMetrics.RejectedCount.WithLabelValues(reason))
+	}
+
+	// datagrams in plaintext, under a key outside the keyring and tampered with are dropped
+	payload, err := helpers.Pack(&models.Message{Type: models.MSGack, Sender: 1, Data: &models.MSGackData{J: 0, S: 1}})
+	assert.NilError(t, err)
+	unknown, err := helpers.Encrypt(payload, newClusterKey(t))
+	assert.NilError(t, err)
+	tampered, err := helpers.Encrypt(payload, newKey)
+	assert.NilError(t, err)
+	tampered[len(tampered)-1]++
+	conn := newClientConn(t)
+	defer conn.Close()
+	_, err = write(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: PORT + 11}, [][]byte{payload, unknown, tampered}, 0)
+	assert.NilError(t, err)
+
+	// processors still on the old key are understood during the rollover
+	for i, key := range []*helpers.ClusterKey{oldKey, newKey} {
+		sender, err := NewKeyring([]*helpers.ClusterKey{key})
+		assert.NilError(t, err)
+		transport := &UDPTransport{Processors: []models.Processor{{ID: 0, IP: []byte{127, 0, 0, 1}, UDPPort: PORT + 11}}, Keyring: sender}
+		transport.SendToProcessor(0, &models.Message{Type: models.MSGack, Sender: 1, Data: &models.MSGackData{J: 0, S: i + 2}})
+		transport.Close()
+
+		select {
+		case msg := <-resolver.dispatched:
+			assert.Equal(t, msg.Data.(*models.MSGackData).S, i+2)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message encrypted with key %d was not dispatched", i)
+		}
+	}
+
+	for _, reason := range reasons {
+		for i := 0; i < 50 && counterValue(t, sharedServerMetrics.RejectedCount.WithLabelValues(reason)) == before[reason]; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, counterValue(t, sharedServerMetrics.RejectedCount.WithLabelValues(reason))-before[reason], float64(1), reason)
+	}
+	assert.Equal(t, len(resolver.dispatched), 0)
+}
+
+func TestNodeClusterRotatesClusterKeys(t *testing.T) {
+	processors, keys := generateKeys(t, 3, 9130)
+	params := Params{ModuleRunSleepDuration: 50 * time.Millisecond, HeartbeatInterval: 100 * time.Millisecond}
+	oldKey, newKey := newClusterKey(t), newClusterKey(t)
+
+	// encryption is combined with authentication, which signs the datagrams before they are encrypted
+	nodes := []*Node{}
+	for _, p := range processors {
+		node, err := NewNode(Config{ID: p.ID, Processors: processors, IP: []byte{127, 0, 0, 1}, Params: params, PrivateKey: keys[p.ID],
+			ClusterKeys: []*helpers.ClusterKey{oldKey}})
+		assert.NilError(t, err)
+		assert.NilError(t, node.Start(context.Background()))
+		defer node.Stop()
+		nodes = append(nodes, node)
+	}
+	time.Sleep(4 * params.ModuleRunSleepDuration)
+
+	broadcast := func(text string, seq int) {
+		nodes[0].Broadcast(&UrbMessage{Text: text})
+		for _, node := range nodes {
+			select {
+			case d := <-node.Deliveries():
+				assert.Equal(t, d.Msg.Text, text)
+				assert.Equal(t, d.Identifier, Identifier{ID: 0, Seq: seq})
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%q was not delivered by node %d", text, node.Config.ID)
+			}
+		}
+	}
+	broadcast("before rotation", 1)
+
+	// all nodes accept the new key first, then switch to it one at a time while the old one is still accepted
+	for _, node := range nodes {
+		assert.NilError(t, node.SetClusterKeys([]*helpers.ClusterKey{oldKey, newKey}))
+	}
+	assert.NilError(t, nodes[0].SetClusterKeys([]*helpers.ClusterKey{newKey, oldKey}))
+	broadcast("during rotation", 2)
+	for _, node := range nodes {
+		assert.NilError(t, node.SetClusterKeys([]*helpers.ClusterKey{newKey}))
+	}
+	broadcast("after rotation", 3)
+
+	unencrypted, err := NewNode(Config{ID: 0, Processors: processors})
+	assert.NilError(t, err)
+	assert.Error(t, unencrypted.SetClusterKeys([]*helpers.ClusterKey{newKey}), "Encryption is not enabled")
+}
@@ -0,0 +1,225 @@
+package ssurb
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+type faultMetrics struct {
+	Loss      string
+	Duplicate string
+	Reorder   string
+	Delay     string
+
+	FaultCount *prometheus.CounterVec
+}
+
+var sharedFaultMetrics = &faultMetrics{
+	Loss:      "loss",
+	Duplicate: "duplicate",
+	Reorder:   "reorder",
+	Delay:     "delay",
+
+	FaultCount: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "injected_fault_count",
+		Help: "The amount of faults injected on packets",
+	}, []string{"fault_type"}),
+}
+
+// maxHoldTime is the longest a packet is held back for reordering, it is released once it passed even if no other
+// packet followed on its link
+const maxHoldTime = time.Second
+
+// Link is a directed communication channel from one processor to another
+type Link struct {
+	From int
+	To   int
+}
+
+// LinkFaults configures what faults are injected on a link. Probabilities are given in [0, 1]
+type LinkFaults struct {
+	// Loss is the probability that a packet is dropped
+	Loss float64
+	// Duplicate is the probability that a packet is delivered twice
+	Duplicate float64
+	// Reorder is the probability that a packet is held back and delivered after the next packet on the link, or after
+	// maxHoldTime if none follows
+	Reorder float64
+	// Delay is the maximum delay of a packet, the actual delay is picked uniformly from [0, Delay]
+	Delay time.Duration
+	// Seed seeds the random source of the link, if zero one is derived from the seed of the injector
+	Seed int64
+}
+
+// Scheduler runs functions after a delay, implemented by VirtualClock to inject delays in simulations
+type Scheduler interface {
+	AfterFunc(d time.Duration, fn func())
+}
+
+// realScheduler schedules functions using wall-clock time
+type realScheduler struct{}
+
+func (realScheduler) AfterFunc(d time.Duration, fn func()) {
+	time.AfterFunc(d, fn)
+}
+
+// linkState holds the random source of a link as well as any packet held back for reordering, holds counts the
+// packets held back so far
+type linkState struct {
+	rand  *rand.Rand
+	held  func()
+	holds int
+}
+
+// FaultInjector emulates an unreliable channel by dropping, duplicating, reordering and delaying packets. Every link
+// has its own random source, so that the faults on one link do not depend on the traffic on other links
+type FaultInjector struct {
+	// Default is used for all links that have not been configured through SetLink
+	Default LinkFaults
+	// Scheduler is used to delay packets, defaults to wall-clock time
+	Scheduler Scheduler
+
+	mux   sync.Mutex
+	seed  int64
+	links map[Link]LinkFaults
+	state map[Link]*linkState
+}
+
+// NewFaultInjector returns an injector that applies defaults to all links, seed makes the injected faults reproducible
+func NewFaultInjector(seed int64, defaults LinkFaults) *FaultInjector {
+	return &FaultInjector{
+		Default:   defaults,
+		Scheduler: realScheduler{},
+		seed:      seed,
+		links:     map[Link]LinkFaults{},
+		state:     map[Link]*linkState{},
+	}
+}
+
+// SetLink configures the faults injected on link, overriding the defaults
+func (f *FaultInjector) SetLink(link Link, faults LinkFaults) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.links[link] = faults
+	delete(f.state, link)
+}
+
+// Inject passes a packet sent on link through the configured faults. deliver is called zero or more times, possibly
+// later from another goroutine, to hand the packet over to the receiver
+func (f *FaultInjector) Inject(link Link, deliver func()) {
+	f.mux.Lock()
+	faults, exists := f.links[link]
+	if !exists {
+		faults = f.Default
+	}
+	state := f.linkState(link, faults)
+
+	// decide the fate of the packet while holding the lock, so that runs are reproducible
+	lost := state.rand.Float64() < faults.Loss
+	duplicated := state.rand.Float64() < faults.Duplicate
+	reordered := state.rand.Float64() < faults.Reorder
+	var delay time.Duration
+	if faults.Delay > 0 {
+		delay = time.Duration(state.rand.Int63n(int64(faults.Delay) + 1))
+	}
+
+	if lost {
+		f.mux.Unlock()
+		sharedFaultMetrics.FaultCount.WithLabelValues(sharedFaultMetrics.Loss).Inc()
+		return
+	}
+
+	packet := deliver
+	if duplicated {
+		sharedFaultMetrics.FaultCount.WithLabelValues(sharedFaultMetrics.Duplicate).Inc()
+		packet = func() {
+			deliver()
+			deliver()
+		}
+	}
+
+	// hold the packet back until the next one on the link passes, or release the one already held after this one
+	if reordered && state.held == nil {
+		sharedFaultMetrics.FaultCount.WithLabelValues(sharedFaultMetrics.Reorder).Inc()
+		state.held = packet
+		state.holds++
+		hold, scheduler := state.holds, f.Scheduler
+		f.mux.Unlock()
+		scheduler.AfterFunc(maxHoldTime, func() { f.release(state, hold) })
+		return
+	} else if held := state.held; held != nil {
+		state.held = nil
+		current := packet
+		packet = func() {
+			current()
+			held()
+		}
+	}
+	scheduler := f.Scheduler
+	f.mux.Unlock()
+
+	if delay > 0 {
+		sharedFaultMetrics.FaultCount.WithLabelValues(sharedFaultMetrics.Delay).Inc()
+		scheduler.AfterFunc(delay, packet)
+	} else {
+		packet()
+	}
+}
+
+// release delivers the packet held back by the given hold on a link if no other packet released it yet
+func (f *FaultInjector) release(state *linkState, hold int) {
+	f.mux.Lock()
+	held := state.held
+	if held == nil || state.holds != hold {
+		f.mux.Unlock()
+		return
+	}
+	state.held = nil
+	f.mux.Unlock()
+
+	held()
+}
+
+// linkState returns the state of link, creating it if needed. The caller must hold the lock
+func (f *FaultInjector) linkState(link Link, faults LinkFaults) *linkState {
+	if s, exists := f.state[link]; exists {
+		return s
+	}
+
+	seed := faults.Seed
+	if seed == 0 {
+		seed = f.seed*31*31 + int64(link.From)*31 + int64(link.To)
+	}
+	s := &linkState{rand: rand.New(rand.NewSource(seed))}
+	f.state[link] = s
+	return s
+}
+
+// FaultyTransport wraps a transport and injects faults on all messages sent through it
+type FaultyTransport struct {
+	// ID is the id of the sending processor
+	ID        int
+	Transport Transport
+	Faults    *FaultInjector
+}
+
+// SetProcessors passes processors on to the wrapped transport
+func (t *FaultyTransport) SetProcessors(processors []models.Processor) {
+	if setter, ok := t.Transport.(ProcessorSetter); ok {
+		setter.SetProcessors(processors)
+	}
+}
+
+// Send passes msg through the fault injector before handing it over to the wrapped transport
+func (t *FaultyTransport) Send(receiverID int, msg *models.Message) {
+	t.Faults.Inject(Link{From: t.ID, To: receiverID}, func() {
+		t.Transport.Send(receiverID, msg)
+	})
+}
@@ -0,0 +1,96 @@
+package ssurb
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestFaultInjectorLossAndDuplication(t *testing.T) {
+	faults := NewFaultInjector(1, LinkFaults{Loss: 1})
+	faults.SetLink(Link{From: 0, To: 2}, LinkFaults{Duplicate: 1})
+	delivered := map[Link]int{}
+
+	// the default drops every packet, while the configured link duplicates every packet
+	for i := 0; i < 10; i++ {
+		for _, link := range []Link{{From: 0, To: 1}, {From: 0, To: 2}} {
+			l := link
+			faults.Inject(l, func() { delivered[l]++ })
+		}
+	}
+	assert.Equal(t, delivered[Link{From: 0, To: 1}], 0)
+	assert.Equal(t, delivered[Link{From: 0, To: 2}], 20)
+}
+
+func TestFaultInjectorReorder(t *testing.T) {
+	faults := NewFaultInjector(1, LinkFaults{Reorder: 1})
+	link := Link{From: 0, To: 1}
+	delivered := []int{}
+
+	// every other packet is held back and delivered right after the one following it
+	for i := 0; i < 4; i++ {
+		x := i
+		faults.Inject(link, func() { delivered = append(delivered, x) })
+	}
+	assert.Assert(t, reflect.DeepEqual(delivered, []int{1, 0, 3, 2}))
+
+	// a packet held back is released after a while when no other packet follows on its link
+	clock := &VirtualClock{}
+	faults.Scheduler = clock
+	faults.Inject(link, func() { delivered = append(delivered, 4) })
+	clock.Advance(maxHoldTime - time.Millisecond)
+	assert.Equal(t, len(delivered), 4)
+	clock.Advance(time.Millisecond)
+	assert.Assert(t, reflect.DeepEqual(delivered, []int{1, 0, 3, 2, 4}))
+}
+
+func TestFaultInjectorDelay(t *testing.T) {
+	clock := &VirtualClock{}
+	faults := NewFaultInjector(1, LinkFaults{Delay: time.Second})
+	faults.Scheduler = clock
+	delivered := 0
+
+	// all packets are delayed by at most a second
+	for i := 0; i < 10; i++ {
+		faults.Inject(Link{From: 0, To: 1}, func() { delivered++ })
+	}
+	assert.Assert(t, delivered < 10)
+	clock.Advance(time.Second)
+	assert.Equal(t, delivered, 10)
+}
+
+func TestFaultInjectorIsReproducible(t *testing.T) {
+	run := func(seed int64) []int {
+		faults := NewFaultInjector(seed, LinkFaults{Loss: 0.3, Duplicate: 0.3, Reorder: 0.3})
+		delivered := []int{}
+		for i := 0; i < 50; i++ {
+			x := i
+			faults.Inject(Link{From: 0, To: 1}, func() { delivered = append(delivered, x) })
+		}
+		return delivered
+	}
+
+	assert.Assert(t, reflect.DeepEqual(run(7), run(7)))
+	assert.Assert(t, !reflect.DeepEqual(run(7), run(8)))
+}
+
+func TestSimulatorBroadcastOverUnreliableChannel(t *testing.T) {
+	sim := NewSimulator(4)
+	sim.SetFaults(NewFaultInjector(42, LinkFaults{Loss: 0.3, Duplicate: 0.2, Reorder: 0.2, Delay: 500 * time.Millisecond}))
+	sim.Run(time.Second)
+
+	// uniform reliable broadcast should deliver every message exactly once despite the lossy channel
+	ids := []Identifier{}
+	for i := 0; i < 3; i++ {
+		for _, node := range sim.Nodes {
+			sim.Broadcast(node.ID, &UrbMessage{Text: fmt.Sprintf("Message %d from %d", i, node.ID)})
+			ids = append(ids, Identifier{ID: node.ID, Seq: i + 1})
+		}
+	}
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, len(ids)), time.Minute))
+	sim.Run(10 * time.Second)
+	assertDeliveredOnce(t, sim, ids)
+}
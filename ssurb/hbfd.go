@@ -1,6 +1,8 @@
 package ssurb
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
@@ -11,36 +13,82 @@ type HbfdModule struct {
 	ID       int
 	P        []int
 	Resolver IResolver
+	Params   Params
 
-	Hb []int
+	// mux guards P and Hb, which are updated from the server goroutines
+	mux sync.Mutex
+	// Hb is keyed by processor id
+	Hb map[int]int
 }
 
 // Init initializes the hbfd module
 func (m *HbfdModule) Init() {
-	for i := 0; i < len(m.P); i++ {
-		m.Hb = append(m.Hb, 0)
+	m.Hb = map[int]int{}
+	for _, id := range m.P {
+		m.Hb[id] = 0
 	}
 }
 
-// HB returns the current value of the hb failure detector
-func (m *HbfdModule) HB() []int {
-	return m.Hb
+// HB returns a copy of the current value of the hb failure detector
+func (m *HbfdModule) HB() map[int]int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	hb := map[int]int{}
+	for id, x := range m.Hb {
+		hb[id] = x
+	}
+	return hb
 }
 
-// DoForever starts the algorithm and runs forever
-func (m *HbfdModule) DoForever() {
+// DoForever starts the algorithm and runs until ctx is cancelled
+func (m *HbfdModule) DoForever(ctx context.Context) {
 	for {
-		for _, id := range m.P {
-			m.sendHeartbeat(id)
+		m.Step()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.Params.heartbeatInterval()):
 		}
+	}
+}
+
+// Step runs one iteration of the do forever loop
+func (m *HbfdModule) Step() {
+	m.mux.Lock()
+	P := m.P
+	m.mux.Unlock()
 
-		time.Sleep(time.Second * 1)
+	for _, id := range P {
+		m.sendHeartbeat(id)
+	}
+}
+
+// setMembers replaces the set of processors. Counters of the ones joining start over, also if they were part of the
+// system before, and the ones of the processors leaving are removed
+func (m *HbfdModule) setMembers(P []int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for _, k := range P {
+		if !contains(m.P, k) {
+			m.Hb[k] = 0
+		}
+	}
+	for k := range m.Hb {
+		if !contains(P, k) {
+			delete(m.Hb, k)
+		}
 	}
+	m.P = P
 }
 
 // onHearbeat is called by the resolver when a new heartbeat message was received from another processor
 func (m *HbfdModule) onHeartbeat(senderID int) {
+	m.mux.Lock()
 	m.Hb[senderID]++
+	m.mux.Unlock()
 }
 
 // sendHeartbeat sends a heartbeat to another processor to indicate that this processor is alive
@@ -48,8 +96,8 @@ func (m *HbfdModule) sendHeartbeat(receiverID int) {
 	message := models.Message{Type: models.HBFDheartbeat, Sender: m.ID, Data: nil}
 
 	if receiverID == m.ID {
-		m.Hb[m.ID]++
+		m.onHeartbeat(m.ID)
 	} else {
-		go SendToProcessor(receiverID, &message)
+		m.Resolver.Send(receiverID, &message)
 	}
 }
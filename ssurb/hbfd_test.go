@@ -0,0 +1,33 @@
+package ssurb
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestHbfdOnHeartbeat(t *testing.T) {
+	mod := HbfdModule{ID: 0, P: []int{0, 1, 2}}
+	mod.Init()
+
+	// heartbeats are received concurrently from the server goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(senderID int) {
+			defer wg.Done()
+			mod.onHeartbeat(senderID)
+			mod.HB()
+		}(i%2 + 1)
+	}
+	wg.Wait()
+
+	assert.Assert(t, reflect.DeepEqual(mod.HB(), map[int]int{0: 0, 1: 50, 2: 50}))
+
+	// HB should return a copy that is not affected by later heartbeats
+	hb := mod.HB()
+	mod.onHeartbeat(0)
+	assert.Assert(t, reflect.DeepEqual(hb, map[int]int{0: 0, 1: 50, 2: 50}))
+}
@@ -0,0 +1,269 @@
+package ssurb
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// defaultDeliveryBufferSize is the capacity of the deliveries channel when none is configured
+const defaultDeliveryBufferSize = 1024
+
+// Config holds everything needed to run a node in-process
+type Config struct {
+	// ID is the id of this processor, must be part of Processors
+	ID int
+	// Processors is the set of all processors in the system, including this one
+	Processors []models.Processor
+	// IP is the address the udp server binds to, nil binds to all addresses
+	IP net.IP
+	// Port is the port the udp server binds to, defaults to the udp port of this processor
+	Port int
+	// DeliveryBufferSize is the capacity of the channel returned by Deliveries
+	DeliveryBufferSize int
+	// Transport is used to send messages to other processors, defaults to udp
+	Transport Transport
+	// Faults optionally injects faults on all sent messages
+	Faults *FaultInjector
+	// InboundFaults optionally injects faults on all messages received by the udp server
+	InboundFaults *FaultInjector
+	// DataDir optionally persists the urb state in this directory, so that a restarted node resumes without
+	// redelivering messages
+	DataDir string
+	// Params are the protocol tunables passed to all modules
+	Params Params
+	// PrivateKey optionally enables authentication, every datagram sent over udp is signed with it and datagrams
+	// received are verified against the PublicKey of the processor that signed them, which all processors must have
+	PrivateKey ed25519.PrivateKey
+	// Ordering is the order messages are delivered in, defaults to delivering them as soon as possible
+	Ordering Ordering
+	// ClusterKeys optionally enables encryption of every datagram sent over udp, see Keyring
+	ClusterKeys []*helpers.ClusterKey
+}
+
+// Delivery is a message that has been urb-delivered together with its identifier
+type Delivery struct {
+	Msg        *UrbMessage
+	Identifier Identifier
+}
+
+// Node wires all modules, the resolver and the udp server together into one runnable processor
+type Node struct {
+	Config   Config
+	Resolver *Resolver
+
+	urbModule     *UrbModule
+	hbfdModule    *HbfdModule
+	thetafdModule *ThetafdModule
+	reconfModule  *ReconfModule
+	server        *Server
+	udpTransport  *UDPTransport
+	keyring       *Keyring
+
+	deliveries chan Delivery
+	// backlog holds the deliveries not published on the deliveries channel yet, it is only accessed by the goroutine
+	// running the urb module
+	backlog []Delivery
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewNode validates the config and initializes all modules of a node, call Start to launch it
+func NewNode(cfg Config) (*Node, error) {
+	P := []int{}
+	var self *models.Processor
+	for i, p := range cfg.Processors {
+		P = append(P, p.ID)
+		if p.ID == cfg.ID {
+			self = &cfg.Processors[i]
+		}
+	}
+	if self == nil {
+		return nil, fmt.Errorf("ID %d is not part of processors %v", cfg.ID, P)
+	}
+	if err := cfg.Params.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := ParseOrdering(cfg.Ordering.String()); err != nil {
+		return nil, err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = self.GetUDPPort()
+	}
+	if cfg.DeliveryBufferSize <= 0 {
+		cfg.DeliveryBufferSize = defaultDeliveryBufferSize
+	}
+
+	var auth *Authenticator
+	if cfg.PrivateKey != nil {
+		var err error
+		if auth, err = NewAuthenticator(cfg.ID, cfg.PrivateKey, cfg.Processors); err != nil {
+			return nil, err
+		}
+	}
+
+	n := &Node{Config: cfg, deliveries: make(chan Delivery, cfg.DeliveryBufferSize)}
+	if cfg.ClusterKeys != nil {
+		var err error
+		if n.keyring, err = NewKeyring(cfg.ClusterKeys); err != nil {
+			return nil, err
+		}
+	}
+	n.Resolver = &Resolver{Modules: make(map[ModuleType]interface{}), Transport: cfg.Transport}
+	if cfg.Transport == nil {
+		n.udpTransport = &UDPTransport{Processors: cfg.Processors, Auth: auth, Keyring: n.keyring}
+		n.Resolver.Transport = n.udpTransport
+	}
+	if cfg.Faults != nil {
+		n.Resolver.Transport = &FaultyTransport{ID: cfg.ID, Transport: n.Resolver.Transport, Faults: cfg.Faults}
+	}
+
+	// init modules
+	n.urbModule = &UrbModule{ID: cfg.ID, P: P, Resolver: n.Resolver, Params: cfg.Params, Deliverer: DelivererFunc(n.deliver),
+		Ordering: cfg.Ordering}
+	n.urbModule.Init()
+	if err := n.openStore(); err != nil {
+		return nil, err
+	}
+	n.hbfdModule = &HbfdModule{ID: cfg.ID, P: P, Resolver: n.Resolver, Params: cfg.Params}
+	n.hbfdModule.Init()
+	n.thetafdModule = &ThetafdModule{ID: cfg.ID, P: P, Resolver: n.Resolver, Params: cfg.Params}
+	n.thetafdModule.Init()
+	n.reconfModule = &ReconfModule{ID: cfg.ID, Resolver: n.Resolver, Params: cfg.Params, RequireKeys: auth != nil}
+	n.reconfModule.Init(cfg.Processors)
+
+	// attach modules to resolver
+	n.Resolver.Modules[URB] = n.urbModule
+	n.Resolver.Modules[HBFD] = n.hbfdModule
+	n.Resolver.Modules[THETAFD] = n.thetafdModule
+	n.Resolver.Modules[RECONF] = n.reconfModule
+
+	n.server = &Server{ID: cfg.ID, IP: cfg.IP, Port: cfg.Port, Resolver: n.Resolver, Faults: cfg.InboundFaults, Auth: auth,
+		Keyring: n.keyring}
+	return n, nil
+}
+
+// openStore recovers the urb state from the data dir and persists all further changes to it, unless the node has no
+// data dir or its store is open already
+func (n *Node) openStore() error {
+	if n.Config.DataDir == "" || n.urbModule.Store != nil {
+		return nil
+	}
+
+	store, err := OpenStore(n.Config.DataDir)
+	if err != nil {
+		return err
+	}
+	if err := n.urbModule.Recover(store); err != nil {
+		store.Close()
+		return err
+	}
+	return nil
+}
+
+// Start binds the udp server and launches all modules in separate goroutines, which run until ctx is cancelled or
+// Stop is called. A node started again after Stop reopens its store
+func (n *Node) Start(ctx context.Context) error {
+	if err := n.openStore(); err != nil {
+		return err
+	}
+	if err := n.server.Start(); err != nil {
+		n.urbModule.CloseStore()
+		return err
+	}
+	n.ctx, n.cancel = context.WithCancel(ctx)
+	ctx = n.ctx
+
+	n.run(func() {
+		if err := n.server.Listen(ctx); err != nil {
+			log.Printf("UDP server stopped with error: %v", err)
+		}
+	})
+	n.run(func() { n.hbfdModule.DoForever(ctx) })
+	n.run(func() { n.thetafdModule.DoForever(ctx) })
+	n.run(func() {
+		n.publish()
+		n.urbModule.DoForever(ctx)
+	})
+	n.run(func() { n.reconfModule.DoForever(ctx) })
+
+	return nil
+}
+
+// Stop stops all modules and the udp server, and blocks until they have returned and all messages in flight have
+// been sent. Deliveries pending on a full Deliveries channel are kept and published once the node is started again.
+// The store is snapshotted and closed. A stopped node can be started again
+func (n *Node) Stop() {
+	if n.cancel == nil {
+		return
+	}
+	n.cancel()
+	n.cancel = nil
+	n.wg.Wait()
+
+	if n.udpTransport != nil {
+		n.udpTransport.Close()
+	}
+	if err := n.urbModule.CloseStore(); err != nil {
+		log.Printf("Could not close store. Got error: %v", err)
+	}
+}
+
+// SetClusterKeys replaces the keys datagrams are encrypted with while the node is running, the first key is used for
+// encrypting. Fails if the node was created without cluster keys
+func (n *Node) SetClusterKeys(keys []*helpers.ClusterKey) error {
+	if n.keyring == nil {
+		return errors.New("Encryption is not enabled")
+	}
+	return n.keyring.SetKeys(keys)
+}
+
+// Broadcast urb-broadcasts msg to all processors, blocking until the flow control mechanism allows it
+func (n *Node) Broadcast(msg *UrbMessage) {
+	n.urbModule.BlockUntilAvailableSpace()
+	n.urbModule.UrbBroadcast(msg)
+}
+
+// Deliveries returns a channel on which all urb-delivered messages are published. The channel must be drained,
+// otherwise the do forever loop of the urb module blocks once its capacity is reached
+func (n *Node) Deliveries() <-chan Delivery {
+	return n.deliveries
+}
+
+// deliver is registered as the deliverer of the urb module. It never drops a delivery, since the store records it as
+// delivered once handed over, so it blocks until there is room in the channel. Once the node is stopping, the
+// delivery is kept in the backlog instead
+func (n *Node) deliver(msg *UrbMessage, id Identifier) {
+	n.backlog = append(n.backlog, Delivery{Msg: msg, Identifier: id})
+	n.publish()
+}
+
+// publish publishes the backlog on the deliveries channel in order, until it is empty or the node is stopping
+func (n *Node) publish() {
+	for len(n.backlog) > 0 {
+		select {
+		case n.deliveries <- n.backlog[0]:
+			n.backlog = n.backlog[1:]
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// run launches fn in a goroutine tracked by the node
+func (n *Node) run(fn func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		fn()
+	}()
+}
@@ -0,0 +1,227 @@
+package ssurb
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+	"gotest.tools/assert"
+)
+
+func TestNewNodeRejectsUnknownID(t *testing.T) {
+	processors := []models.Processor{{ID: 0, IP: []byte{127, 0, 0, 1}}, {ID: 1, IP: []byte{127, 0, 0, 1}}}
+	node, err := NewNode(Config{ID: 2, Processors: processors})
+	assert.Assert(t, node == nil)
+	assert.Error(t, err, "ID 2 is not part of processors [0 1]")
+}
+
+func TestNewNodeRejectsInvalidParams(t *testing.T) {
+	processors := []models.Processor{{ID: 0, IP: []byte{127, 0, 0, 1}}}
+	node, err := NewNode(Config{ID: 0, Processors: processors, Params: Params{ThetafdW: -1, BufferUnitSize: -5}})
+	assert.Assert(t, node == nil)
+	assert.Error(t, err, "Invalid params: ThetafdW must not be negative (0 means default), got -1; BufferUnitSize must not be negative (0 means default), got -5")
+}
+
+func TestNewNodeRejectsUnknownOrdering(t *testing.T) {
+	processors := []models.Processor{{ID: 0, IP: []byte{127, 0, 0, 1}}}
+	node, err := NewNode(Config{ID: 0, Processors: processors, Ordering: Ordering(7)})
+	assert.Assert(t, node == nil)
+	assert.Error(t, err, `Unknown ordering "Ordering(7)"`)
+}
+
+func TestNodeDeliversBroadcast(t *testing.T) {
+	processors := []models.Processor{{ID: 0, IP: []byte{127, 0, 0, 1}}}
+	node, err := NewNode(Config{ID: 0, Processors: processors, IP: []byte{127, 0, 0, 1}, Port: 9100})
+	assert.NilError(t, err)
+	assert.NilError(t, node.Start(context.Background()))
+	defer node.Stop()
+
+	// let the first iteration settle the transmit window from its initial state
+	time.Sleep(2 * constants.ModuleRunSleepDuration)
+
+	// a single node trusts only itself, so its own broadcast should be delivered right away
+	node.Broadcast(&UrbMessage{Text: "Hello world!"})
+	select {
+	case d := <-node.Deliveries():
+		assert.Equal(t, d.Msg.Text, "Hello world!")
+		assert.Equal(t, d.Identifier, Identifier{ID: 0, Seq: 1})
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast was not delivered")
+	}
+}
+
+func TestNodeCanBeRestarted(t *testing.T) {
+	processors := []models.Processor{{ID: 0, IP: []byte{127, 0, 0, 1}}}
+	node, err := NewNode(Config{ID: 0, Processors: processors, IP: []byte{127, 0, 0, 1}, Port: 9101})
+	assert.NilError(t, err)
+
+	// stopping should release the socket, so that the node can be started again on the same port
+	for i := 0; i < 2; i++ {
+		assert.NilError(t, node.Start(context.Background()))
+		node.Stop()
+	}
+
+	// stopping a stopped node is a no-op
+	node.Stop()
+}
+
+func TestNodeRestartReopensStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssurb-node")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	processors := []models.Processor{{ID: 0, IP: []byte{127, 0, 0, 1}}}
+	node, err := NewNode(Config{ID: 0, Processors: processors, IP: []byte{127, 0, 0, 1}, Port: 9102, DataDir: dir})
+	assert.NilError(t, err)
+
+	broadcast := func(text string, seq int) {
+		assert.NilError(t, node.Start(context.Background()))
+		defer node.Stop()
+		time.Sleep(2 * constants.ModuleRunSleepDuration)
+		node.Broadcast(&UrbMessage{Text: text})
+		select {
+		case d := <-node.Deliveries():
+			assert.Equal(t, d.Identifier, Identifier{ID: 0, Seq: seq})
+		case <-time.After(5 * time.Second):
+			t.Fatal("broadcast was not delivered")
+		}
+	}
+
+	// the store is closed when stopping and reopened when starting again, so the node continues where it left off
+	broadcast("Hello", 1)
+	assert.Assert(t, node.urbModule.Store == nil)
+	broadcast("Again", 2)
+	assert.Assert(t, node.urbModule.Store == nil)
+
+	store, err := OpenStore(dir)
+	assert.NilError(t, err)
+	defer store.Close()
+	mod := &UrbModule{ID: 0, P: []int{0}}
+	mod.Init()
+	assert.NilError(t, mod.Recover(store))
+	assert.Equal(t, mod.Seq, 2)
+	assert.Assert(t, store.Delivered(Identifier{ID: 0, Seq: 2}) || mod.RxObsS[0] >= 2)
+}
+
+func TestNodeStopKeepsPendingDeliveries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssurb-node")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	processors := []models.Processor{{ID: 0, IP: []byte{127, 0, 0, 1}}}
+	node, err := NewNode(Config{ID: 0, Processors: processors, IP: []byte{127, 0, 0, 1}, Port: 9103, DataDir: dir, DeliveryBufferSize: 1})
+	assert.NilError(t, err)
+	assert.NilError(t, node.Start(context.Background()))
+	time.Sleep(2 * constants.ModuleRunSleepDuration)
+
+	// the second delivery is pending on the full channel while the node is stopped, which does not wait for the
+	// application to take it
+	node.Broadcast(&UrbMessage{Text: "First"})
+	node.Broadcast(&UrbMessage{Text: "Second"})
+	time.Sleep(2 * constants.ModuleRunSleepDuration)
+	stopped := make(chan struct{})
+	go func() {
+		node.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not stop with a pending delivery")
+	}
+
+	// nor is the pending delivery dropped, it is published once the node is started again
+	assert.NilError(t, node.Start(context.Background()))
+	defer node.Stop()
+	for _, text := range []string{"First", "Second"} {
+		select {
+		case d := <-node.Deliveries():
+			assert.Equal(t, d.Msg.Text, text)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not delivered", text)
+		}
+	}
+	select {
+	case d := <-node.Deliveries():
+		t.Fatalf("%s was delivered twice", d.Msg.Text)
+	case <-time.After(2 * constants.ModuleRunSleepDuration):
+	}
+}
+
+func TestNodeClusterWithAuthentication(t *testing.T) {
+	processors, keys := generateKeys(t, 3, 9120)
+	params := Params{ModuleRunSleepDuration: 50 * time.Millisecond, HeartbeatInterval: 100 * time.Millisecond}
+
+	// a node without the right key is rejected up front
+	_, err := NewNode(Config{ID: 0, Processors: processors, PrivateKey: keys[1]})
+	assert.Error(t, err, "Public key of processor 0 does not match its private key")
+
+	nodes := []*Node{}
+	for _, p := range processors {
+		node, err := NewNode(Config{ID: p.ID, Processors: processors, IP: []byte{127, 0, 0, 1}, Params: params, PrivateKey: keys[p.ID]})
+		assert.NilError(t, err)
+		assert.NilError(t, node.Start(context.Background()))
+		defer node.Stop()
+		nodes = append(nodes, node)
+	}
+	time.Sleep(4 * params.ModuleRunSleepDuration)
+
+	// a broadcast injected by a host without keys on behalf of processor 2 is never delivered
+	intruder := &UDPTransport{Processors: processors}
+	defer intruder.Close()
+	forged := &models.Message{Type: models.MSG, Sender: 2, Data: &models.MSGData{J: 2, S: 1, Text: "Forged"}}
+	for _, p := range processors {
+		intruder.SendToProcessor(p.ID, forged)
+	}
+
+	nodes[1].Broadcast(&UrbMessage{Text: "Hello authenticated"})
+	for _, node := range nodes {
+		select {
+		case d := <-node.Deliveries():
+			assert.Equal(t, d.Msg.Text, "Hello authenticated")
+			assert.Equal(t, d.Identifier, Identifier{ID: 1, Seq: 1})
+		case <-time.After(10 * time.Second):
+			t.Fatalf("broadcast was not delivered by node %d", node.Config.ID)
+		}
+	}
+	time.Sleep(4 * params.ModuleRunSleepDuration)
+	for _, node := range nodes {
+		assert.Equal(t, len(node.Deliveries()), 0)
+	}
+}
+
+func TestNodeClusterOnIPv6(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	// processors parsed from a hosts file with IPv6 addresses
+	processors := []models.Processor{}
+	for id := 0; id < 3; id++ {
+		processors = append(processors, models.Processor{ID: id, Hostname: "localhost", IPString: "::1", IP: helpers.IPStringToSlice("::1"), UDPPort: 9110 + id})
+	}
+	params := Params{ModuleRunSleepDuration: 50 * time.Millisecond, HeartbeatInterval: 100 * time.Millisecond}
+
+	nodes := []*Node{}
+	for _, p := range processors {
+		node, err := NewNode(Config{ID: p.ID, Processors: processors, IP: net.IPv6loopback, Params: params})
+		assert.NilError(t, err)
+		assert.NilError(t, node.Start(context.Background()))
+		defer node.Stop()
+		nodes = append(nodes, node)
+	}
+	time.Sleep(4 * params.ModuleRunSleepDuration)
+
+	nodes[1].Broadcast(&UrbMessage{Text: "Hello over IPv6"})
+	for _, node := range nodes {
+		select {
+		case d := <-node.Deliveries():
+			assert.Equal(t, d.Msg.Text, "Hello over IPv6")
+			assert.Equal(t, d.Identifier, Identifier{ID: 1, Seq: 1})
+		case <-time.After(10 * time.Second):
+			t.Fatalf("broadcast was not delivered by node %d", node.Config.ID)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ssurb
+
+import "fmt"
+
+// Ordering is the order in which the urb module delivers messages to the application
+type Ordering int
+
+const (
+	// NoOrdering delivers every message as soon as it is acked by all trusted processors
+	NoOrdering Ordering = iota
+	// FIFOOrdering delivers the messages of every sender in the order they were broadcast by it
+	FIFOOrdering
+	// CausalOrdering delivers messages in FIFO order and after all messages their senders had delivered before
+	// broadcasting them
+	CausalOrdering
+	// TotalOrdering delivers all messages in the same order on every processor, as decided by consensus
+	TotalOrdering
+)
+
+var orderingNames = map[Ordering]string{NoOrdering: "none", FIFOOrdering: "fifo", CausalOrdering: "causal", TotalOrdering: "total"}
+
+func (o Ordering) String() string {
+	if name, exists := orderingNames[o]; exists {
+		return name
+	}
+	return fmt.Sprintf("Ordering(%d)", int(o))
+}
+
+// ParseOrdering returns the ordering called name
+func ParseOrdering(name string) (Ordering, error) {
+	for o, n := range orderingNames {
+		if n == name {
+			return o, nil
+		}
+	}
+	return NoOrdering, fmt.Errorf("Unknown ordering %q", name)
+}
+
+// deliverInOrder delivers the records acked by all trusted processors in the order of their sequence numbers per
+// sender. Since all messages of sender j up to RxObsS[j] are obsolete, a record of j is released once all records
+// of j between RxObsS[j] and itself are delivered. Messages that never arrive hold back the ones after them until the
+// receiving window moves past them. In causal ordering, a record is additionally held back until the messages in its
+// vector clock are delivered, which is why senders are passed over until none of them makes progress. Returns the
+// number of records held back
+func (m *UrbModule) deliverInOrder(trusted map[int]bool) int {
+	senders := m.Buffer.Senders()
+
+	// next holds the first sequence number per sender that is neither obsolete nor delivered, and pos the position of
+	// the first record of the sender that was not passed yet
+	next := map[int]int{}
+	pos := map[int]int{}
+	for _, j := range senders {
+		next[j] = m.RxObsS[j] + 1
+	}
+
+	for progress := true; progress; {
+		progress = false
+		for _, j := range senders {
+			records := m.Buffer.Sender(j)
+			for ; pos[j] < len(records); pos[j]++ {
+				r := records[pos[j]]
+				if r.Identifier.Seq < next[j] {
+					// already obsolete or passed, delivering it now would break the order
+					continue
+				} else if r.Identifier.Seq > next[j] {
+					break
+				}
+
+				if !r.Delivered {
+					if !isSubset(trusted, r.RecBy) || (m.Ordering == CausalOrdering && !m.causallyReady(r, next)) {
+						break
+					}
+					m.persistAndDeliver(r.Msg, r.Identifier)
+					r.Delivered = true
+				}
+				next[j]++
+				progress = true
+			}
+		}
+	}
+
+	heldBack := 0
+	for _, r := range m.Buffer.Records() {
+		if r.Identifier.Seq >= next[r.Identifier.ID] && !r.Delivered && isSubset(trusted, r.RecBy) {
+			heldBack++
+		}
+	}
+	return heldBack
+}
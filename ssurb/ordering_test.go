@@ -0,0 +1,89 @@
+package ssurb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// inFIFOOrder returns true if every node delivered the messages of every sender in the order of their sequence numbers
+func inFIFOOrder(sim *Simulator) bool {
+	for _, node := range sim.Nodes {
+		last := map[int]int{}
+		for _, d := range node.Delivered {
+			if d.Identifier.Seq <= last[d.Identifier.ID] {
+				return false
+			}
+			last[d.Identifier.ID] = d.Identifier.Seq
+		}
+	}
+	return true
+}
+
+func TestParseOrdering(t *testing.T) {
+	for _, o := range []Ordering{NoOrdering, FIFOOrdering, CausalOrdering, TotalOrdering} {
+		parsed, err := ParseOrdering(o.String())
+		assert.NilError(t, err)
+		assert.Equal(t, parsed, o)
+	}
+	_, err := ParseOrdering("lifo")
+	assert.Error(t, err, `Unknown ordering "lifo"`)
+}
+
+func TestFIFOHoldsBackMessages(t *testing.T) {
+	mod, r, delivered := bootstrapOrdering(FIFOOrdering)
+	r.TrustedRet = []int{0, 1}
+
+	// messages 2 and 3 of processor 1 are acked by all trusted processors, but message 1 is not
+	for s := 3; s >= 1; s-- {
+		recBy := map[int]bool{0: true, 1: true}
+		if s == 1 {
+			recBy = map[int]bool{1: true}
+		}
+		addRecord(mod, &UrbMessage{}, Identifier{ID: 1, Seq: s}, recBy)
+	}
+	processAndHandOver(mod)
+	assert.Equal(t, len(*delivered), 0)
+	assert.Equal(t, mod.HeldBackCount(), 2)
+
+	// once message 1 is acked, all three are delivered in order
+	mod.Buffer.Get(Identifier{ID: 1, Seq: 1}).RecBy[0] = true
+	processAndHandOver(mod)
+	assert.DeepEqual(t, *delivered, []Identifier{{ID: 1, Seq: 1}, {ID: 1, Seq: 2}, {ID: 1, Seq: 3}})
+	assert.Equal(t, mod.HeldBackCount(), 0)
+
+	// a message that is never acked holds back the next one until the receiving window moves past it
+	addRecord(mod, &UrbMessage{}, Identifier{ID: 1, Seq: 4}, map[int]bool{1: true})
+	addRecord(mod, &UrbMessage{}, Identifier{ID: 1, Seq: 5}, map[int]bool{0: true, 1: true})
+	processAndHandOver(mod)
+	assert.Equal(t, len(*delivered), 3)
+	assert.Equal(t, mod.HeldBackCount(), 1)
+	mod.RxObsS[1] = 4
+	processAndHandOver(mod)
+	assert.Equal(t, (*delivered)[3], Identifier{ID: 1, Seq: 5})
+}
+
+func TestSimulatorFIFOUnderReordering(t *testing.T) {
+	run := func(ordering Ordering) *Simulator {
+		sim := NewSimulator(3)
+		sim.SetOrdering(ordering)
+		sim.SetFaults(NewFaultInjector(7, LinkFaults{Reorder: 0.5, Delay: 2 * time.Second}))
+		sim.Run(time.Second)
+		for i := 0; i < 10; i++ {
+			sim.Broadcast(0, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+			sim.Broadcast(1, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+		}
+		assert.Assert(t, sim.RunUntil(allDelivered(sim, 20), 2*time.Minute))
+		return sim
+	}
+
+	// the faults reorder deliveries unless they are held back
+	assert.Assert(t, !inFIFOOrder(run(NoOrdering)))
+	sim := run(FIFOOrdering)
+	assert.Assert(t, inFIFOOrder(sim))
+	for _, node := range sim.Nodes {
+		assert.Equal(t, len(node.Delivered), 20)
+	}
+}
@@ -0,0 +1,83 @@
+package ssurb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+)
+
+// Params holds the protocol tunables of the modules, zero values fall back to the defaults in constants
+type Params struct {
+	// ModuleRunSleepDuration is the duration the urb module sleeps before one iteration of the do forever loop
+	ModuleRunSleepDuration time.Duration
+	// HeartbeatInterval is the duration the failure detector and reconf modules sleep between sending heartbeats
+	HeartbeatInterval time.Duration
+	// ThetafdW is the threshold used by the theta fd
+	ThetafdW int
+	// BufferUnitSize is the number of messages allowed to be in the buffer for a processor
+	BufferUnitSize int
+	// SnapshotInterval is the number of urb iterations between two snapshots of the persisted state
+	SnapshotInterval int
+}
+
+// Validate returns an error listing all params that are out of range
+func (p Params) Validate() error {
+	problems := []string{}
+	if p.ModuleRunSleepDuration < 0 {
+		problems = append(problems, fmt.Sprintf("ModuleRunSleepDuration must not be negative (0 means default), got %v", p.ModuleRunSleepDuration))
+	}
+	if p.HeartbeatInterval < 0 {
+		problems = append(problems, fmt.Sprintf("HeartbeatInterval must not be negative (0 means default), got %v", p.HeartbeatInterval))
+	}
+	if p.ThetafdW < 0 {
+		problems = append(problems, fmt.Sprintf("ThetafdW must not be negative (0 means default), got %d", p.ThetafdW))
+	}
+	if p.BufferUnitSize < 0 {
+		problems = append(problems, fmt.Sprintf("BufferUnitSize must not be negative (0 means default), got %d", p.BufferUnitSize))
+	}
+	if p.SnapshotInterval < 0 {
+		problems = append(problems, fmt.Sprintf("SnapshotInterval must not be negative (0 means default), got %d", p.SnapshotInterval))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid params: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (p Params) moduleRunSleepDuration() time.Duration {
+	if p.ModuleRunSleepDuration > 0 {
+		return p.ModuleRunSleepDuration
+	}
+	return constants.ModuleRunSleepDuration
+}
+
+func (p Params) heartbeatInterval() time.Duration {
+	if p.HeartbeatInterval > 0 {
+		return p.HeartbeatInterval
+	}
+	return constants.HeartbeatInterval
+}
+
+func (p Params) thetafdW() int {
+	if p.ThetafdW > 0 {
+		return p.ThetafdW
+	}
+	return constants.ThetafdW
+}
+
+func (p Params) bufferUnitSize() int {
+	if p.BufferUnitSize > 0 {
+		return p.BufferUnitSize
+	}
+	return constants.BufferUnitSize
+}
+
+func (p Params) snapshotInterval() int {
+	if p.SnapshotInterval > 0 {
+		return p.SnapshotInterval
+	}
+	return constants.SnapshotInterval
+}
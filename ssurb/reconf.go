@@ -0,0 +1,286 @@
+package ssurb
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+type reconfMetrics struct {
+	Epoch prometheus.Gauge
+}
+
+var sharedReconfMetrics = &reconfMetrics{
+	Epoch: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "membership_epoch",
+		Help: "The epoch of the membership view currently installed",
+	}),
+}
+
+// MaxEpoch is the highest epoch a view can have. Views beyond it are rejected, so that a corrupted epoch can not make
+// the next one overflow
+const MaxEpoch = math.MaxInt32
+
+// ReconfModule keeps track of the membership view, i.e. the set of processors making up the system. A processor
+// proposes a new view with a higher epoch to let processors join or leave, which is sent to all processors of both
+// the old and new view. Every processor installs the highest view it has seen and keeps gossiping it, so that all
+// processors eventually agree on the view even if messages are lost. Concurrent proposals of the same epoch replace
+// each other, so a proposer proposes its changes again on top of a view that replaced its own
+type ReconfModule struct {
+	ID       int
+	Resolver IResolver
+	Params   Params
+	// RequireKeys rejects processors without a valid public key, it must be set if messages are authenticated, since
+	// the messages of such a processor could never be verified
+	RequireKeys bool
+
+	// mux guards the view and the pending changes below
+	mux        sync.Mutex
+	Epoch      int
+	Proposer   int
+	Processors []models.Processor
+
+	// pending holds the changes proposed by this processor, keyed by the id of the processor they change, until a
+	// view of another processor with a higher epoch is installed
+	pending map[int]*change
+
+	// applyMux serializes applying installed views to the other modules, which is done without holding mux.
+	// appliedEpoch and appliedProposer identify the view applied last
+	applyMux        sync.Mutex
+	appliedEpoch    int
+	appliedProposer int
+}
+
+// change is a processor joining, or leaving if Processor is nil, proposed by this processor in the view of Epoch
+type change struct {
+	Processor *models.Processor
+	Epoch     int
+}
+
+// Init initializes the reconf module with the view of epoch 0, which is attributed to the processor with the lowest id
+func (m *ReconfModule) Init(processors []models.Processor) {
+	m.Epoch = 0
+	m.Processors = sortedProcessors(processors)
+	m.Proposer = m.Processors[0].ID
+	m.pending = map[int]*change{}
+	m.appliedEpoch, m.appliedProposer = m.Epoch, m.Proposer
+}
+
+// View returns the epoch and processors of the installed view
+func (m *ReconfModule) View() (int, []models.Processor) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.Epoch, append([]models.Processor{}, m.Processors...)
+}
+
+// Join proposes a new view in which p is part of the system, replacing any processor with the same id
+func (m *ReconfModule) Join(p models.Processor) error {
+	if err := m.validKey(p); err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	m.pending[p.ID] = &change{Processor: &p}
+	m.mux.Unlock()
+
+	return m.propose()
+}
+
+// Leave proposes a new view in which the processor with id is no longer part of the system. A processor can not
+// propose to leave itself, since views are only accepted from processors that are part of them
+func (m *ReconfModule) Leave(id int) error {
+	m.mux.Lock()
+	found := false
+	for _, x := range m.Processors {
+		found = found || x.ID == id
+	}
+	if found && id != m.ID {
+		m.pending[id] = &change{}
+	}
+	m.mux.Unlock()
+
+	if !found {
+		return fmt.Errorf("ID %d is not part of the system", id)
+	} else if id == m.ID {
+		return fmt.Errorf("Processor %d can not propose to leave itself", id)
+	}
+	return m.propose()
+}
+
+// propose installs a view with the next epoch that applies the pending changes to the installed view, and sends it
+// to all processors of the old and new view
+func (m *ReconfModule) propose() error {
+	m.mux.Lock()
+	if len(m.pending) == 0 {
+		m.mux.Unlock()
+		return nil
+	} else if m.Epoch >= MaxEpoch {
+		m.mux.Unlock()
+		return fmt.Errorf("Epoch %d is the last one", m.Epoch)
+	}
+
+	old := m.Processors
+	data := &models.RECONFData{Epoch: m.Epoch + 1, Proposer: m.ID, Processors: m.applyPending()}
+	for _, c := range m.pending {
+		c.Epoch = data.Epoch
+	}
+	m.install(data)
+	m.mux.Unlock()
+	m.apply()
+
+	receivers := map[int]bool{}
+	for _, p := range append(old, data.Processors...) {
+		receivers[p.ID] = true
+	}
+	for id := range receivers {
+		if id != m.ID {
+			m.sendRECONF(id, data)
+		}
+	}
+	return nil
+}
+
+// applyPending returns the installed processors with the pending changes applied, the caller must hold the lock
+func (m *ReconfModule) applyPending() []models.Processor {
+	processors := []models.Processor{}
+	for _, x := range m.Processors {
+		if _, exists := m.pending[x.ID]; !exists {
+			processors = append(processors, x)
+		}
+	}
+	for _, c := range m.pending {
+		if c.Processor != nil {
+			processors = append(processors, *c.Processor)
+		}
+	}
+	return sortedProcessors(processors)
+}
+
+// DoForever starts gossiping the view and runs until ctx is cancelled
+func (m *ReconfModule) DoForever(ctx context.Context) {
+	for {
+		m.Step()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.Params.heartbeatInterval()):
+		}
+	}
+}
+
+// Step sends the installed view to all other processors of the view
+func (m *ReconfModule) Step() {
+	m.mux.Lock()
+	data := &models.RECONFData{Epoch: m.Epoch, Proposer: m.Proposer, Processors: m.Processors}
+	m.mux.Unlock()
+
+	for _, p := range data.Processors {
+		if p.ID != m.ID {
+			m.sendRECONF(p.ID, data)
+		}
+	}
+}
+
+// onRECONF installs the view sent by another processor if it is newer than the installed one. Pending changes that
+// were replaced by a concurrent view of the same epoch are proposed again on top of it, the others are settled once a
+// view with a higher epoch is installed, which was proposed knowing about them
+func (m *ReconfModule) onRECONF(msg *models.Message) {
+	data := msg.Data.(*models.RECONFData)
+	for _, p := range data.Processors {
+		if err := m.validKey(p); err != nil {
+			log.Printf("Ignoring view %d proposed by %d: %v", data.Epoch, data.Proposer, err)
+			return
+		}
+	}
+
+	m.mux.Lock()
+	if !(data.Epoch > m.Epoch || (data.Epoch == m.Epoch && data.Proposer > m.Proposer)) {
+		m.mux.Unlock()
+		return
+	}
+	m.install(data)
+	for id, c := range m.pending {
+		if data.Epoch > c.Epoch {
+			delete(m.pending, id)
+		}
+	}
+	replaced := !reflect.DeepEqual(m.applyPending(), m.Processors)
+	m.mux.Unlock()
+	m.apply()
+
+	if !replaced {
+		return
+	} else if err := m.propose(); err != nil {
+		log.Printf("Could not propose pending changes again. Got error: %v", err)
+	}
+}
+
+// install replaces the view, the caller must hold the lock and call apply once it released it
+func (m *ReconfModule) install(data *models.RECONFData) {
+	m.Epoch = data.Epoch
+	m.Proposer = data.Proposer
+	m.Processors = sortedProcessors(data.Processors)
+
+	log.Printf("installed view %d proposed by %d with processors %v", m.Epoch, m.Proposer, m.Processors)
+	sharedReconfMetrics.Epoch.Set(float64(m.Epoch))
+}
+
+// apply updates the members of all modules to the installed view. It does not hold the lock while doing so, since the
+// other modules take their own locks, which are held while calling into this module. Concurrent calls apply the view
+// installed last, so that an older view never overrides a newer one
+func (m *ReconfModule) apply() {
+	m.applyMux.Lock()
+	defer m.applyMux.Unlock()
+
+	m.mux.Lock()
+	epoch, proposer, processors := m.Epoch, m.Proposer, m.Processors
+	m.mux.Unlock()
+	if epoch == m.appliedEpoch && proposer == m.appliedProposer {
+		return
+	}
+
+	m.Resolver.SetMembers(processors)
+	m.appliedEpoch, m.appliedProposer = epoch, proposer
+}
+
+// validKey returns an error if p has no valid public key while keys are required
+func (m *ReconfModule) validKey(p models.Processor) error {
+	if m.RequireKeys && len(p.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("Processor %d needs a valid public key, since messages are authenticated", p.ID)
+	}
+	return nil
+}
+
+func (m *ReconfModule) sendRECONF(receiverID int, data *models.RECONFData) {
+	message := models.Message{Type: models.RECONF, Sender: m.ID, Data: data}
+	m.Resolver.Send(receiverID, &message)
+}
+
+// sortedProcessors returns a copy of processors sorted by id
+func sortedProcessors(processors []models.Processor) []models.Processor {
+	sorted := append([]models.Processor{}, processors...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
+
+// processorIDs returns the ids of processors
+func processorIDs(processors []models.Processor) []int {
+	ids := []int{}
+	for _, p := range processors {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
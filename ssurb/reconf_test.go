@@ -0,0 +1,276 @@
+package ssurb
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// assertView checks that the given nodes have installed the view with epoch and processor ids P
+func assertView(t *testing.T, sim *Simulator, nodes []int, epoch int, P []int) {
+	for _, id := range nodes {
+		e, processors := sim.Nodes[id].Reconf.View()
+		assert.Equal(t, e, epoch, "node %d", id)
+		assert.DeepEqual(t, processorIDs(processors), P)
+		assert.DeepEqual(t, sim.Nodes[id].Urb.P, P)
+		assert.DeepEqual(t, sim.Nodes[id].Thetafd.Trusted(), P)
+	}
+}
+
+func TestReconfGrowsState(t *testing.T) {
+	sim := NewSimulator(3)
+	node := sim.Nodes[0]
+
+	// a processor with an id not seen before can join
+	assert.NilError(t, node.Reconf.Join(models.Processor{ID: 5}))
+	assert.DeepEqual(t, node.Urb.P, []int{0, 1, 2, 5})
+	assert.Equal(t, node.Urb.TxObsS[5], -1)
+	assert.Equal(t, node.Urb.RxObsS[5], -1)
+	assert.Equal(t, node.Hbfd.HB()[5], 0)
+	assert.Equal(t, node.Thetafd.Vector[5], 0)
+	assert.NilError(t, node.Resolver.Validate(&models.Message{Type: models.HBFDheartbeat, Sender: 5}))
+
+	// once it leaves again, its messages are rejected and its counters are removed, the ones of the urb module once
+	// none of its messages are buffered
+	assert.NilError(t, node.Reconf.Leave(5))
+	assert.DeepEqual(t, node.Urb.P, []int{0, 1, 2})
+	assert.Assert(t, node.Resolver.Validate(&models.Message{Type: models.HBFDheartbeat, Sender: 5}) != nil)
+	assert.DeepEqual(t, node.Hbfd.HB(), map[int]int{0: 0, 1: 0, 2: 0})
+	assert.Assert(t, node.Urb.hasState(5))
+	sim.Run(time.Second)
+	assert.Assert(t, !node.Urb.hasState(5))
+
+	assert.ErrorContains(t, node.Reconf.Leave(5), "not part of the system")
+}
+
+func TestReconfLeave(t *testing.T) {
+	sim := NewSimulator(4)
+	sim.Run(time.Second)
+
+	// a crashed processor stays trusted for a long time, blocking delivery
+	sim.Crash(3)
+	sim.Broadcast(0, &UrbMessage{Text: "foo"})
+	assert.Assert(t, !sim.RunUntil(func() bool { return len(sim.Nodes[0].Delivered) > 0 }, 5*time.Second))
+
+	// once it has left the system, delivery no longer waits for it
+	assert.NilError(t, sim.Nodes[1].Reconf.Leave(3))
+	sim.Network.Flush()
+	delivered := func() bool {
+		for _, id := range []int{0, 1, 2} {
+			if len(sim.Nodes[id].Delivered) != 1 {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Assert(t, sim.RunUntil(delivered, 5*time.Second))
+	assertView(t, sim, []int{0, 1, 2}, 1, []int{0, 1, 2})
+}
+
+func TestReconfJoin(t *testing.T) {
+	sim := NewSimulator(4)
+
+	// processor 3 starts out outside of the system
+	assert.NilError(t, sim.Nodes[0].Reconf.Leave(3))
+	sim.Network.Flush()
+	assertView(t, sim, []int{0, 1, 2, 3}, 1, []int{0, 1, 2})
+	sim.Run(time.Second)
+
+	before := []Identifier{}
+	for i := 1; i <= 3; i++ {
+		sim.Broadcast(0, &UrbMessage{Text: "before"})
+		before = append(before, Identifier{ID: 0, Seq: i})
+	}
+	sim.Run(5 * time.Second)
+
+	// after joining, processor 3 takes part in all broadcasts
+	assert.NilError(t, sim.Nodes[2].Reconf.Join(models.Processor{ID: 3}))
+	sim.Network.Flush()
+	assertView(t, sim, []int{0, 1, 2, 3}, 2, []int{0, 1, 2, 3})
+
+	after := []Identifier{}
+	for i := 4; i <= 6; i++ {
+		sim.Broadcast(0, &UrbMessage{Text: "after"})
+		after = append(after, Identifier{ID: 0, Seq: i})
+	}
+	sim.Broadcast(3, &UrbMessage{Text: "newcomer"})
+	after = append(after, Identifier{ID: 3, Seq: 1})
+	sim.Run(10 * time.Second)
+
+	for _, node := range sim.Nodes {
+		delivered := map[Identifier]int{}
+		for _, d := range node.Delivered {
+			delivered[d.Identifier]++
+		}
+
+		expected := after
+		if node.ID != 3 {
+			expected = append(append([]Identifier{}, before...), after...)
+		}
+		for _, id := range expected {
+			assert.Equal(t, delivered[id], 1, "node %d delivered %v %d times", node.ID, id, delivered[id])
+		}
+		for id, count := range delivered {
+			assert.Equal(t, count, 1, "node %d delivered %v %d times", node.ID, id, count)
+		}
+	}
+}
+
+func TestReconfViewsConverge(t *testing.T) {
+	sim := NewSimulator(3)
+	sim.SetFaults(NewFaultInjector(1, LinkFaults{Loss: 1}))
+
+	// the proposal is lost, but gossip spreads it once the network recovers
+	assert.NilError(t, sim.Nodes[0].Reconf.Join(models.Processor{ID: 3}))
+	sim.Run(time.Second)
+	assertView(t, sim, []int{1, 2}, 0, []int{0, 1, 2})
+
+	sim.faults.Default.Loss = 0
+	sim.Run(2 * time.Second)
+	for _, node := range sim.Nodes {
+		e, processors := node.Reconf.View()
+		assert.Equal(t, e, 1)
+		assert.DeepEqual(t, processorIDs(processors), []int{0, 1, 2, 3})
+	}
+}
+
+func TestReconfLeaveKeepsHalfAckedMessages(t *testing.T) {
+	sim := NewSimulator(4)
+	faults := NewFaultInjector(1, LinkFaults{})
+	sim.SetFaults(faults)
+	sim.Run(time.Second)
+
+	// processors 0 and 1 got the message of processor 3, processor 2 did not and has not acked it yet
+	for _, from := range []int{0, 1, 3} {
+		faults.SetLink(Link{From: from, To: 2}, LinkFaults{Loss: 1})
+	}
+	sim.Broadcast(3, &UrbMessage{Text: "Goodbye"})
+	sim.Run(time.Second)
+	assert.Assert(t, sim.Nodes[0].Urb.Buffer.Get(Identifier{ID: 3, Seq: 1}) != nil)
+	assert.Assert(t, sim.Nodes[2].Urb.Buffer.Get(Identifier{ID: 3, Seq: 1}) == nil)
+
+	// the message is still delivered by the remaining processors after processor 3 left
+	assert.NilError(t, sim.Nodes[0].Reconf.Leave(3))
+	sim.Crash(3)
+	for _, from := range []int{0, 1, 3} {
+		faults.SetLink(Link{From: from, To: 2}, LinkFaults{})
+	}
+	remaining := []int{0, 1, 2}
+	delivered := func() bool {
+		for _, id := range remaining {
+			if len(sim.Nodes[id].Delivered) != 1 {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Assert(t, sim.RunUntil(delivered, 10*time.Second))
+
+	// and its records are trimmed once obsolete, after which the state of processor 3 is removed
+	sim.Run(5 * time.Second)
+	assertView(t, sim, remaining, 1, remaining)
+	for _, id := range remaining {
+		assert.Equal(t, sim.Nodes[id].Delivered[0].Identifier, Identifier{ID: 3, Seq: 1})
+		assert.Equal(t, sim.Nodes[id].Urb.Buffer.Len(), 0, "node %d", id)
+		assert.Assert(t, !sim.Nodes[id].Urb.hasState(3), "node %d", id)
+	}
+}
+
+func TestReconfRejoinAfterRestart(t *testing.T) {
+	sim := NewSimulator(3)
+	sim.Run(time.Second)
+
+	for i := 0; i < 5; i++ {
+		sim.Broadcast(2, &UrbMessage{Text: "before"})
+	}
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 5), 10*time.Second))
+
+	// processor 2 leaves, restarts without any state and joins again before the others removed its state
+	assert.NilError(t, sim.Nodes[0].Reconf.Leave(2))
+	sim.Network.Flush()
+	sim.Crash(2)
+	assert.NilError(t, sim.Restart(2))
+	assert.NilError(t, sim.Nodes[0].Reconf.Join(models.Processor{ID: 2}))
+	sim.Network.Flush()
+	assertView(t, sim, []int{0, 1, 2}, 2, []int{0, 1, 2})
+	for _, id := range []int{0, 1} {
+		assert.Equal(t, sim.Nodes[id].Urb.RxObsS[2], -1, "node %d", id)
+	}
+
+	// its sequence numbers start over, which the others deliver as new messages
+	sim.Run(time.Second)
+	sim.Broadcast(2, &UrbMessage{Text: "after"})
+	assert.Equal(t, sim.Nodes[2].Urb.Seq, 1)
+	delivered := func() bool {
+		for _, node := range sim.Nodes {
+			if len(node.Delivered) == 0 || node.Delivered[len(node.Delivered)-1].Msg.Text != "after" {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Assert(t, sim.RunUntil(delivered, 10*time.Second))
+}
+
+func TestReconfConcurrentProposals(t *testing.T) {
+	sim := NewSimulator(4)
+	sim.Run(time.Second)
+
+	// processors 0 and 2 propose epoch 1 at the same time, the view of 2 wins and 0 proposes its change again
+	assert.NilError(t, sim.Nodes[0].Reconf.Leave(3))
+	assert.NilError(t, sim.Nodes[2].Reconf.Join(models.Processor{ID: 4}))
+	sim.Network.Flush()
+	sim.Run(5 * time.Second)
+	assertView(t, sim, []int{0, 1, 2}, 2, []int{0, 1, 2, 4})
+
+	// a later change of the same processor is not undone
+	assert.NilError(t, sim.Nodes[1].Reconf.Join(models.Processor{ID: 3}))
+	sim.Network.Flush()
+	sim.Run(5 * time.Second)
+	assertView(t, sim, []int{0, 1, 2}, 3, []int{0, 1, 2, 3, 4})
+}
+
+func TestReconfRejectsInvalidViews(t *testing.T) {
+	sim := NewSimulator(3)
+	node := sim.Nodes[0]
+
+	// views must not overflow the epoch and must contain their proposer
+	processors := []models.Processor{{ID: 0}, {ID: 1}}
+	for _, data := range []*models.RECONFData{
+		{Epoch: -1, Proposer: 1, Processors: processors},
+		{Epoch: MaxEpoch + 1, Proposer: 1, Processors: processors},
+		{Epoch: 1, Proposer: 2, Processors: processors},
+	} {
+		node.Resolver.Dispatch(&models.Message{Type: models.RECONF, Sender: 1, Data: data})
+		epoch, _ := node.Reconf.View()
+		assert.Equal(t, epoch, 0, "%+v", data)
+	}
+
+	// a processor can not leave by itself, nor propose beyond the last epoch
+	assert.ErrorContains(t, node.Reconf.Leave(0), "can not propose to leave itself")
+	node.Resolver.Dispatch(&models.Message{Type: models.RECONF, Sender: 1, Data: &models.RECONFData{Epoch: MaxEpoch, Proposer: 1, Processors: processors}})
+	assert.ErrorContains(t, node.Reconf.Leave(1), "is the last one")
+}
+
+func TestReconfRequiresKeys(t *testing.T) {
+	sim := NewSimulator(3)
+	node := sim.Nodes[0]
+	node.Reconf.RequireKeys = true
+	public, _, err := ed25519.GenerateKey(nil)
+	assert.NilError(t, err)
+
+	// without a valid key the messages of a processor could not be verified, so it can not join
+	assert.ErrorContains(t, node.Reconf.Join(models.Processor{ID: 3}), "needs a valid public key")
+	assert.ErrorContains(t, node.Reconf.Join(models.Processor{ID: 3, PublicKey: public[:4]}), "needs a valid public key")
+	node.Resolver.Dispatch(&models.Message{Type: models.RECONF, Sender: 1, Data: &models.RECONFData{Epoch: 1, Proposer: 1,
+		Processors: []models.Processor{{ID: 0, PublicKey: public}, {ID: 1}}}})
+	epoch, _ := node.Reconf.View()
+	assert.Equal(t, epoch, 0)
+
+	assert.NilError(t, node.Reconf.Join(models.Processor{ID: 3, PublicKey: public}))
+	assert.DeepEqual(t, node.Urb.P, []int{0, 1, 2, 3})
+}
@@ -16,24 +16,34 @@ const (
 	HBFD ModuleType = 1
 	// THETAFD refers to ThetafdModule
 	THETAFD ModuleType = 2
+	// RECONF refers to ReconfModule
+	RECONF ModuleType = 3
 )
 
 // IResolver defines what interface functions are available for inter-module communication
 // Also makes it testable..
 type IResolver interface {
-	Hb() []int
+	Hb() map[int]int
 	Trusted() []int
 	UrbBroadcast(*UrbMessage)
 	Dispatch(*models.Message)
+	Send(int, *models.Message)
+	SetMembers([]models.Processor)
+}
+
+// ProcessorSetter is implemented by transports that need to know the addresses of the processors they send to
+type ProcessorSetter interface {
+	SetProcessors([]models.Processor)
 }
 
 // Resolver facilitates inter-module communication
 type Resolver struct {
-	Modules map[ModuleType]interface{}
+	Modules   map[ModuleType]interface{}
+	Transport Transport
 }
 
 // Hb calles the HB funciton in the hbfd module
-func (r *Resolver) Hb() []int {
+func (r *Resolver) Hb() map[int]int {
 	m := r.Modules[HBFD].(*HbfdModule)
 	return m.HB()
 }
@@ -50,8 +60,19 @@ func (r *Resolver) UrbBroadcast(msg *UrbMessage) {
 	m.UrbBroadcast(msg)
 }
 
-// Dispatch routes an incoming message to the correct module
+// Send sends a message to another processor through the transport
+func (r *Resolver) Send(receiverID int, m *models.Message) {
+	r.Transport.Send(receiverID, m)
+}
+
+// Dispatch routes an incoming message to the correct module, messages that do not pass validation are dropped
 func (r *Resolver) Dispatch(m *models.Message) {
+	if err := r.Validate(m); err != nil {
+		sharedValidationMetrics.RejectedCount.WithLabelValues(err.(*ValidationError).Reason).Inc()
+		log.Println(err)
+		return
+	}
+
 	urbModule := r.Modules[URB].(*UrbModule)
 	hbfdModule := r.Modules[HBFD].(*HbfdModule)
 	thetafdModule := r.Modules[THETAFD].(*ThetafdModule)
@@ -67,11 +88,41 @@ func (r *Resolver) Dispatch(m *models.Message) {
 		hbfdModule.onHeartbeat(m.Sender)
 	case models.THETAheartbeat:
 		thetafdModule.onHeartbeat(m.Sender)
-	default:
-		log.Fatalf("Got unrecognized message %v", m)
+	case models.RECONF:
+		if reconfModule, exists := r.Modules[RECONF].(*ReconfModule); exists {
+			reconfModule.onRECONF(m)
+		}
+	}
+}
+
+// SetMembers installs the set of processors making up the system in all modules and the transport
+func (r *Resolver) SetMembers(processors []models.Processor) {
+	P := processorIDs(processors)
+
+	// the urb module goes first, since it samples the receivers trusted before the change
+	r.GetUrbModule().setMembers(P)
+	r.Modules[HBFD].(*HbfdModule).setMembers(P)
+	r.Modules[THETAFD].(*ThetafdModule).setMembers(P)
+
+	if t, ok := r.Transport.(ProcessorSetter); ok {
+		t.SetProcessors(processors)
 	}
 }
 
+// GetReconfModule returns the reconf module, or nil if membership is fixed
+func (r *Resolver) GetReconfModule() *ReconfModule {
+	reconfModule, _ := r.Modules[RECONF].(*ReconfModule)
+	return reconfModule
+}
+
+// SetDeliverer registers the application layer deliverer on the urb module, it may be called while the module runs
+func (r *Resolver) SetDeliverer(d Deliverer) {
+	m := r.Modules[URB].(*UrbModule)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.Deliverer = d
+}
+
 // GetUrbModule is used to get the current isntance of the urb module
 func (r *Resolver) GetUrbModule() *UrbModule {
 	urbModule := r.Modules[URB].(*UrbModule)
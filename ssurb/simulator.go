@@ -0,0 +1,343 @@
+package ssurb
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// VirtualClock is a deterministic clock that only moves when advanced, firing scheduled functions in order
+type VirtualClock struct {
+	mux    sync.Mutex
+	now    time.Duration
+	seq    int
+	timers []virtualTimer
+}
+
+// virtualTimer is a function scheduled to run at a virtual point in time, seq breaks ties in scheduling order
+type virtualTimer struct {
+	at  time.Duration
+	seq int
+	fn  func()
+}
+
+// Now returns the time elapsed since the clock was created
+func (c *VirtualClock) Now() time.Duration {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.now
+}
+
+// AfterFunc schedules fn to run once the clock has been advanced by d
+func (c *VirtualClock) AfterFunc(d time.Duration, fn func()) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.seq++
+	c.timers = append(c.timers, virtualTimer{at: c.now + d, seq: c.seq, fn: fn})
+}
+
+// Advance moves the clock forward by d, running all functions scheduled up to and including the new time
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	target := c.now + d
+
+	for {
+		sort.Slice(c.timers, func(i, j int) bool {
+			if c.timers[i].at == c.timers[j].at {
+				return c.timers[i].seq < c.timers[j].seq
+			}
+			return c.timers[i].at < c.timers[j].at
+		})
+		if len(c.timers) == 0 || c.timers[0].at > target {
+			break
+		}
+
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.at
+
+		// release lock while running, fn is allowed to schedule new functions
+		c.mux.Unlock()
+		t.fn()
+		c.mux.Lock()
+	}
+
+	c.now = target
+	c.mux.Unlock()
+}
+
+// SimNode is a processor run by a Simulator
+type SimNode struct {
+	ID        int
+	Resolver  *Resolver
+	Urb       *UrbModule
+	Hbfd      *HbfdModule
+	Thetafd   *ThetafdModule
+	Reconf    *ReconfModule
+	Delivered []Delivery
+
+	// DataDir is set if the urb state of the processor is persisted
+	DataDir string
+	crashed bool
+}
+
+// Simulator runs a cluster of processors in-process on a MemoryNetwork. Instead of running the do forever loops in
+// goroutines, the steps of all modules are driven by a virtual clock so that a run is deterministic
+type Simulator struct {
+	// Nodes is keyed by processor id
+	Nodes   map[int]*SimNode
+	Network *MemoryNetwork
+	Clock   *VirtualClock
+
+	p        []int
+	faults   *FaultInjector
+	ordering Ordering
+	params   Params
+}
+
+// NewSimulator sets up a cluster of n processors with ids 0..n-1
+func NewSimulator(n int) *Simulator {
+	ids := []int{}
+	for id := 0; id < n; id++ {
+		ids = append(ids, id)
+	}
+	return NewSimulatorWithIDs(ids)
+}
+
+// NewSimulatorWithIDs sets up a cluster of processors with the given ids, which need not be contiguous
+func NewSimulatorWithIDs(ids []int) *Simulator {
+	s := &Simulator{Nodes: map[int]*SimNode{}, Network: NewMemoryNetwork(), Clock: &VirtualClock{}}
+	s.p = append([]int{}, ids...)
+	sort.Ints(s.p)
+
+	for _, id := range s.p {
+		node := &SimNode{ID: id}
+		s.boot(node)
+
+		// crashed processors take no steps
+		s.every(func() time.Duration { return node.Hbfd.Params.heartbeatInterval() }, func() {
+			if !node.crashed {
+				node.Hbfd.Step()
+			}
+		})
+		s.every(func() time.Duration { return node.Thetafd.Params.heartbeatInterval() }, func() {
+			if !node.crashed {
+				node.Thetafd.Step()
+			}
+		})
+		s.every(func() time.Duration { return node.Urb.Params.moduleRunSleepDuration() }, func() {
+			if !node.crashed {
+				node.Urb.Step()
+			}
+		})
+		s.every(func() time.Duration { return node.Reconf.Params.heartbeatInterval() }, func() {
+			if !node.crashed {
+				node.Reconf.Step()
+			}
+		})
+		s.Nodes[id] = node
+	}
+
+	return s
+}
+
+// boot initializes fresh modules for node and attaches it to the network
+func (s *Simulator) boot(node *SimNode) {
+	node.Resolver = &Resolver{Modules: make(map[ModuleType]interface{})}
+	node.Resolver.Transport = s.Network.Attach(node.ID, node.Resolver)
+	if s.faults != nil {
+		node.Resolver.Transport = &FaultyTransport{ID: node.ID, Transport: node.Resolver.Transport, Faults: s.faults}
+	}
+
+	node.Urb = &UrbModule{ID: node.ID, P: s.p, Resolver: node.Resolver, Ordering: s.ordering, Params: s.params}
+	node.Urb.Init()
+	node.Urb.Deliverer = DelivererFunc(func(msg *UrbMessage, id Identifier) {
+		node.Delivered = append(node.Delivered, Delivery{Msg: msg, Identifier: id})
+	})
+	node.Hbfd = &HbfdModule{ID: node.ID, P: s.p, Resolver: node.Resolver, Params: s.params}
+	node.Hbfd.Init()
+	node.Thetafd = &ThetafdModule{ID: node.ID, P: s.p, Resolver: node.Resolver, Params: s.params}
+	node.Thetafd.Init()
+	node.Reconf = &ReconfModule{ID: node.ID, Resolver: node.Resolver, Params: s.params}
+	processors := []models.Processor{}
+	for _, id := range s.p {
+		processors = append(processors, models.Processor{ID: id})
+	}
+	node.Reconf.Init(processors)
+
+	node.Resolver.Modules[URB] = node.Urb
+	node.Resolver.Modules[HBFD] = node.Hbfd
+	node.Resolver.Modules[THETAFD] = node.Thetafd
+	node.Resolver.Modules[RECONF] = node.Reconf
+}
+
+// SetFaults makes all processors send through the fault injector, whose delays are scheduled on the virtual clock
+func (s *Simulator) SetFaults(faults *FaultInjector) {
+	faults.Scheduler = s.Clock
+	s.faults = faults
+	for _, node := range s.Nodes {
+		node.Resolver.Transport = &FaultyTransport{ID: node.ID, Transport: node.Resolver.Transport, Faults: faults}
+	}
+}
+
+// SetOrdering makes all processors deliver messages in the given order
+func (s *Simulator) SetOrdering(ordering Ordering) {
+	s.ordering = ordering
+	for _, node := range s.Nodes {
+		node.Urb.Ordering = ordering
+	}
+}
+
+// SetParams makes all processors use the given tunables, including the intervals their steps are scheduled at
+func (s *Simulator) SetParams(params Params) {
+	s.params = params
+	for _, node := range s.Nodes {
+		node.Urb.Params = params
+		node.Hbfd.Params = params
+		node.Thetafd.Params = params
+		node.Reconf.Params = params
+	}
+}
+
+// Persist makes processor id persist its urb state in dir, recovering any state already stored there
+func (s *Simulator) Persist(id int, dir string) error {
+	node := s.Nodes[id]
+	store, err := OpenStore(dir)
+	if err != nil {
+		return err
+	}
+	if err := node.Urb.Recover(store); err != nil {
+		store.Close()
+		return err
+	}
+
+	node.DataDir = dir
+	return nil
+}
+
+// Crash stops processor id without any cleanup, all of its in-memory state is lost and messages to it are dropped
+func (s *Simulator) Crash(id int) {
+	node := s.Nodes[id]
+	node.crashed = true
+	s.Network.Detach(id)
+	if node.Urb.Store != nil {
+		node.Urb.Store.Close()
+	}
+}
+
+// Restart boots a crashed processor id with fresh modules, which recover from its data dir if persisted
+func (s *Simulator) Restart(id int) error {
+	node := s.Nodes[id]
+	s.boot(node)
+	if node.DataDir != "" {
+		if err := s.Persist(id, node.DataDir); err != nil {
+			return err
+		}
+	}
+
+	node.crashed = false
+	return nil
+}
+
+// InjectTransientFaults corrupts the state of processor id, seed picks the arbitrary values written
+func (s *Simulator) InjectTransientFaults(id int, seed int64, faults ...TransientFault) error {
+	return s.Nodes[id].Resolver.InjectTransientFaults(rand.New(rand.NewSource(seed)), faults...)
+}
+
+// Legal returns true if the state of every processor is legal and consistent with the states of the others, i.e. no
+// processor has made messages obsolete that their sender has not broadcast yet and every running processor trusts
+// all running processors
+func (s *Simulator) Legal() bool {
+	for _, node := range s.Nodes {
+		if !node.Resolver.Legal() {
+			return false
+		}
+	}
+
+	for _, node := range s.Nodes {
+		if node.crashed {
+			continue
+		}
+		trusted := node.Thetafd.Trusted()
+		for _, other := range s.Nodes {
+			if !other.crashed && !contains(trusted, other.ID) {
+				return false
+			}
+		}
+	}
+
+	for _, sender := range s.Nodes {
+		for _, receiver := range s.Nodes {
+			if receiver.Urb.RxObsS[sender.ID] > sender.Urb.Seq {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// IterationsUntilLegal runs the simulation until the state of the system is legal. Returns the number of urb
+// iterations it took, or false if not converged within maxIterations
+func (s *Simulator) IterationsUntilLegal(maxIterations int) (int, bool) {
+	iterations := 0
+	for !s.Legal() {
+		if iterations >= maxIterations {
+			return iterations, false
+		}
+		s.Run(s.iteration())
+		iterations++
+	}
+	return iterations, true
+}
+
+// Broadcast urb-broadcasts msg from processor id and dispatches the resulting messages
+func (s *Simulator) Broadcast(id int, msg *UrbMessage) {
+	s.Nodes[id].Urb.UrbBroadcast(msg)
+	s.Network.Flush()
+}
+
+// Run advances the virtual clock by d
+func (s *Simulator) Run(d time.Duration) {
+	s.Clock.Advance(d)
+}
+
+// RunUntil advances the virtual clock one urb iteration at a time until cond holds or timeout has passed.
+// Returns whether cond holds
+func (s *Simulator) RunUntil(cond func() bool, timeout time.Duration) bool {
+	step := s.iteration()
+	for elapsed := time.Duration(0); !cond(); elapsed += step {
+		if elapsed >= timeout {
+			return false
+		}
+		s.Run(step)
+	}
+	return true
+}
+
+// iteration returns the shortest duration any processor sleeps between two urb iterations
+func (s *Simulator) iteration() time.Duration {
+	d := time.Duration(0)
+	for _, node := range s.Nodes {
+		if sleep := node.Urb.Params.moduleRunSleepDuration(); d == 0 || sleep < d {
+			d = sleep
+		}
+	}
+	return d
+}
+
+// every schedules fn to run right away and then every d(), dispatching all messages sent by fn after each run. d is
+// evaluated after every run, so that the interval follows the params of the current modules
+func (s *Simulator) every(d func() time.Duration, fn func()) {
+	var tick func()
+	tick = func() {
+		fn()
+		s.Network.Flush()
+		s.Clock.AfterFunc(d(), tick)
+	}
+	s.Clock.AfterFunc(0, tick)
+}
@@ -0,0 +1,213 @@
+package ssurb
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+	"gotest.tools/assert"
+)
+
+// allDelivered returns a condition that holds once every node in the simulation has delivered count messages
+func allDelivered(sim *Simulator, count int) func() bool {
+	return func() bool {
+		for _, node := range sim.Nodes {
+			if len(node.Delivered) < count {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// assertDeliveredOnce checks that every node delivered exactly the given identifiers, each of them once
+func assertDeliveredOnce(t *testing.T, sim *Simulator, ids []Identifier) {
+	for _, node := range sim.Nodes {
+		delivered := map[Identifier]int{}
+		for _, d := range node.Delivered {
+			delivered[d.Identifier]++
+		}
+
+		expected := map[Identifier]int{}
+		for _, id := range ids {
+			expected[id] = 1
+		}
+		assert.Assert(t, reflect.DeepEqual(delivered, expected), "node %d delivered %v", node.ID, delivered)
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	clock := &VirtualClock{}
+	fired := []string{}
+
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	clock.AfterFunc(time.Second, func() {
+		fired = append(fired, "a")
+		clock.AfterFunc(time.Second, func() { fired = append(fired, "c") })
+	})
+
+	// nothing should fire before the clock is advanced far enough, ties fire in scheduling order
+	clock.Advance(999 * time.Millisecond)
+	assert.Equal(t, len(fired), 0)
+	clock.Advance(time.Second)
+	assert.Assert(t, reflect.DeepEqual(fired, []string{"a"}))
+	clock.Advance(time.Millisecond)
+	assert.Assert(t, reflect.DeepEqual(fired, []string{"a", "b", "c"}))
+	assert.Equal(t, clock.Now(), 2*time.Second)
+}
+
+func TestMemoryNetwork(t *testing.T) {
+	network := NewMemoryNetwork()
+	r := &recordingResolver{}
+	transport := network.Attach(0, &MockResolver{})
+	network.Attach(1, r)
+
+	// messages are only dispatched when flushing, and messages to unknown processors are dropped
+	transport.Send(1, &models.Message{Type: models.MSGack, Sender: 0, Data: &models.MSGackData{J: 0, S: 1}})
+	transport.Send(2, &models.Message{Type: models.MSGack, Sender: 0, Data: &models.MSGackData{J: 0, S: 2}})
+	assert.Equal(t, network.Pending(), 2)
+	assert.Equal(t, len(r.dispatched), 0)
+	assert.Equal(t, network.Flush(), 1)
+	assert.Equal(t, network.Pending(), 0)
+
+	// the message should have gone through the wire encoding
+	assert.Equal(t, len(r.dispatched), 1)
+	assert.Equal(t, r.dispatched[0].Data.(*models.MSGackData).S, 1)
+}
+
+func TestSimulatorBroadcast(t *testing.T) {
+	sim := NewSimulator(4)
+	sim.Run(time.Second)
+
+	// every processor broadcasts a message, which all processors should deliver exactly once
+	for _, node := range sim.Nodes {
+		sim.Broadcast(node.ID, &UrbMessage{Text: fmt.Sprintf("Hello from %d", node.ID)})
+	}
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 4), 10*time.Second))
+	sim.Run(5 * time.Second)
+	assertDeliveredOnce(t, sim, []Identifier{{ID: 0, Seq: 1}, {ID: 1, Seq: 1}, {ID: 2, Seq: 1}, {ID: 3, Seq: 1}})
+
+	// once acked by everyone, gossip should have made all records obsolete and removed from the buffers
+	for _, node := range sim.Nodes {
+		assert.Equal(t, node.Urb.Buffer.Len(), 0, "node %d", node.ID)
+		assert.Assert(t, reflect.DeepEqual(node.Urb.RxObsS, map[int]int{0: 1, 1: 1, 2: 1, 3: 1}), "node %d has RxObsS %v", node.ID, node.Urb.RxObsS)
+	}
+}
+
+func TestSimulatorBroadcastPayloadAndHeaders(t *testing.T) {
+	sim := NewSimulator(3)
+	sim.Run(time.Second)
+
+	payload := []byte{0, 1, 2, 254, 255}
+	headers := map[string]string{HeaderContentType: "application/octet-stream", HeaderTopic: "foo", HeaderTraceID: "abc"}
+	sim.Broadcast(0, &UrbMessage{Payload: payload, Headers: headers})
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 1), 10*time.Second))
+
+	// payload and headers should arrive untouched at every processor
+	for _, node := range sim.Nodes {
+		msg := node.Delivered[0].Msg
+		assert.Equal(t, msg.Text, "")
+		assert.DeepEqual(t, msg.Payload, payload)
+		assert.DeepEqual(t, msg.Headers, headers)
+	}
+}
+
+func TestSimulatorIsDeterministic(t *testing.T) {
+	run := func() []Delivery {
+		sim := NewSimulator(3)
+		sim.Run(time.Second)
+		for i := 0; i < 5; i++ {
+			sim.Broadcast(i%3, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+		}
+		sim.Run(5 * time.Second)
+		return sim.Nodes[2].Delivered
+	}
+
+	// two runs of the same scenario should deliver the same messages in the same order
+	first := run()
+	second := run()
+	assert.Equal(t, len(first), 5)
+	assert.Equal(t, len(first), len(second))
+	for i := range first {
+		assert.Equal(t, first[i].Identifier, second[i].Identifier)
+		assert.Equal(t, first[i].Msg.Text, second[i].Msg.Text)
+	}
+}
+
+func TestSimulatorSparseIDs(t *testing.T) {
+	sim := NewSimulatorWithIDs([]int{103, 17, 42})
+	sim.Run(time.Second)
+
+	for _, node := range sim.Nodes {
+		assert.Assert(t, reflect.DeepEqual(node.Thetafd.Trusted(), []int{17, 42, 103}), "node %d", node.ID)
+		sim.Broadcast(node.ID, &UrbMessage{Text: fmt.Sprintf("Hello from %d", node.ID)})
+	}
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 3), 10*time.Second))
+	sim.Run(5 * time.Second)
+	assertDeliveredOnce(t, sim, []Identifier{{ID: 17, Seq: 1}, {ID: 42, Seq: 1}, {ID: 103, Seq: 1}})
+
+	for _, node := range sim.Nodes {
+		assert.Equal(t, node.Urb.Buffer.Len(), 0, "node %d", node.ID)
+		assert.Assert(t, reflect.DeepEqual(node.Urb.RxObsS, map[int]int{17: 1, 42: 1, 103: 1}), "node %d has RxObsS %v", node.ID, node.Urb.RxObsS)
+	}
+
+	// messages from ids inside the gaps are rejected
+	err := sim.Nodes[17].Resolver.Validate(&models.Message{Type: models.HBFDheartbeat, Sender: 20})
+	assert.Assert(t, err != nil)
+}
+
+func TestSimulatorParams(t *testing.T) {
+	sim := NewSimulator(3)
+	sim.SetParams(Params{ModuleRunSleepDuration: time.Second})
+	sim.Run(10 * time.Second)
+
+	// processors take steps right away and then at the interval of their own params, which survive a restart
+	assert.Equal(t, sim.iteration(), time.Second)
+	assert.Equal(t, sim.Nodes[0].Urb.iterations, 11)
+	sim.Crash(0)
+	assert.NilError(t, sim.Restart(0))
+	assert.Equal(t, sim.Nodes[0].Urb.Params.ModuleRunSleepDuration, time.Second)
+}
+
+func TestSimulatorRestartWithoutStore(t *testing.T) {
+	sim := NewSimulator(3)
+	faults := NewFaultInjector(1, LinkFaults{})
+	sim.SetFaults(faults)
+	sim.Run(time.Second)
+
+	// node 2 is still trusted but never acks, so node 1 keeps the last records of node 0 buffered
+	faults.SetLink(Link{From: 0, To: 2}, LinkFaults{Loss: 1})
+	faults.SetLink(Link{From: 1, To: 2}, LinkFaults{Loss: 1})
+	for i := 0; i < 3*constants.BufferUnitSize; i++ {
+		sim.Broadcast(0, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+		sim.Run(constants.ModuleRunSleepDuration)
+	}
+	assert.Equal(t, sim.Nodes[1].Urb.maxSeq(0), 3*constants.BufferUnitSize)
+
+	// node 0 loses all of its state, and should catch up with the seq gossiped by the others instead of reusing
+	// sequence numbers they made obsolete
+	sim.Crash(0)
+	assert.NilError(t, sim.Restart(0))
+	faults.SetLink(Link{From: 0, To: 2}, LinkFaults{})
+	faults.SetLink(Link{From: 1, To: 2}, LinkFaults{})
+	sim.Run(time.Second)
+	assert.Assert(t, sim.Nodes[0].Urb.Seq >= 3*constants.BufferUnitSize, "seq is %d", sim.Nodes[0].Urb.Seq)
+
+	sim.Broadcast(0, &UrbMessage{Text: "After restart"})
+	delivered := func() bool {
+		for _, node := range sim.Nodes {
+			found := false
+			for _, d := range node.Delivered {
+				found = found || d.Msg.Text == "After restart"
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Assert(t, sim.RunUntil(delivered, time.Minute))
+}
@@ -0,0 +1,409 @@
+package ssurb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	snapshotFileName = "snapshot.json"
+	walFileName      = "wal.log"
+)
+
+// walEntry is one line of the write-ahead log
+type walEntry struct {
+	// Op is either "broadcast", "deliver", "order" or "skip"
+	Op         string
+	Identifier Identifier
+	// Msg is only set for broadcasts, decisions and skips
+	Msg *UrbMessage `json:",omitempty"`
+}
+
+// urbSnapshot is the persisted state of the urb module
+type urbSnapshot struct {
+	Seq       int
+	RxObsS    map[int]int
+	TxObsS    map[int]int
+	Records   []*BufferRecord
+	Delivered []Identifier
+	// Total is only set in total ordering
+	Total *totalSnapshot `json:",omitempty"`
+}
+
+// totalSnapshot is the persisted state of total ordering
+type totalSnapshot struct {
+	Instance int
+	Last     []Identifier
+	Fresh    bool
+	Queue    []Identifier
+	Ordered  map[int]int
+	Promised ballot
+	Accepted ballot
+	Value    []Identifier
+}
+
+// Store persists the state of the urb module in a directory, so that a restarted processor resumes where it left off
+// instead of starting over at seq 0 and redelivering messages to the application. Broadcasts and deliveries are
+// appended to a write-ahead log as they take effect, which is synced to disk in batches by Sync, and the whole state
+// is snapshotted periodically, after which the log is truncated
+type Store struct {
+	Dir string
+
+	// syncMux serializes syncs, which are done without holding mux so that appending does not wait for the disk
+	syncMux   sync.Mutex
+	mux       sync.Mutex
+	wal       *os.File
+	delivered map[Identifier]bool
+	// dirty is true if entries were appended since the last sync, and unsynced holds the sequence numbers of the
+	// broadcasts among them
+	dirty    bool
+	unsynced map[int]bool
+}
+
+// OpenStore opens the store in dir, creating the directory if needed
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{Dir: dir, wal: wal, delivered: map[Identifier]bool{}, unsynced: map[int]bool{}}, nil
+}
+
+// Close syncs and closes the write-ahead log
+func (s *Store) Close() error {
+	s.syncMux.Lock()
+	defer s.syncMux.Unlock()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.dirty = false
+	if err := s.wal.Sync(); err != nil {
+		s.wal.Close()
+		return err
+	}
+	return s.wal.Close()
+}
+
+// Delivered returns true if the message with identifier id has been delivered to the application
+func (s *Store) Delivered(id Identifier) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.delivered[id]
+}
+
+// LogBroadcast records that msg was broadcast with identifier id, it must not be sent before Synced returns true
+func (s *Store) LogBroadcast(id Identifier, msg *UrbMessage) error {
+	if err := s.append(walEntry{Op: "broadcast", Identifier: id, Msg: msg}); err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.unsynced[id.Seq] = true
+	return nil
+}
+
+// Synced returns true if the broadcast with sequence number seq is synced to disk, so that a restarted processor
+// never reuses it
+func (s *Store) Synced(seq int) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return !s.unsynced[seq]
+}
+
+// LogDeliver records that the message with identifier id is delivered, call it once the message was handed over to
+// the application. A processor crashing before the next sync delivers the message again after restarting
+func (s *Store) LogDeliver(id Identifier) error {
+	s.mux.Lock()
+	s.delivered[id] = true
+	s.mux.Unlock()
+
+	return s.append(walEntry{Op: "deliver", Identifier: id})
+}
+
+// LogOrder records the decision msg of an instance of total ordering, whose batch was queued for delivery
+func (s *Store) LogOrder(msg *UrbMessage) error {
+	return s.append(walEntry{Op: "order", Msg: msg})
+}
+
+// LogSkip records that the instances before the one of the accept or promise msg were given up on in total ordering
+func (s *Store) LogSkip(msg *UrbMessage) error {
+	return s.append(walEntry{Op: "skip", Msg: msg})
+}
+
+// forget drops the delivered identifiers of processor k, whose sequence numbers start over when it rejoins. Take a
+// snapshot right after, so that they are not recovered from the log
+func (s *Store) forget(k int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for id := range s.delivered {
+		if id.ID == k {
+			delete(s.delivered, id)
+		}
+	}
+}
+
+// append writes entry to the log, it is synced to disk by the next Sync
+func (s *Store) append(entry walEntry) error {
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, err := s.wal.Write(append(bytes, '\n')); err != nil {
+		return err
+	}
+	s.dirty = true
+	return nil
+}
+
+// Sync syncs all entries appended so far to disk at once. Appending continues meanwhile, the entries appended during a
+// sync are synced by the next one
+func (s *Store) Sync() error {
+	s.syncMux.Lock()
+	defer s.syncMux.Unlock()
+
+	s.mux.Lock()
+	if !s.dirty {
+		s.mux.Unlock()
+		return nil
+	}
+	s.dirty = false
+	synced := []int{}
+	for seq := range s.unsynced {
+		synced = append(synced, seq)
+	}
+	s.mux.Unlock()
+
+	if err := s.wal.Sync(); err != nil {
+		s.mux.Lock()
+		s.dirty = true
+		s.mux.Unlock()
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, seq := range synced {
+		delete(s.unsynced, seq)
+	}
+	return nil
+}
+
+// Snapshot atomically replaces the snapshot with the state of m and truncates the log. Delivered identifiers that
+// are obsolete according to RxObsS, or of processors the module holds no state of, are dropped, since the module
+// ignores such messages anyway.
+// The caller must hold the lock of m
+func (s *Store) Snapshot(m *UrbModule) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	snapshot := urbSnapshot{Seq: m.Seq, RxObsS: m.RxObsS, TxObsS: m.TxObsS, Records: m.Buffer.Records(), Delivered: []Identifier{}}
+	if m.total != nil {
+		snapshot.Total = m.total.snapshot()
+	}
+	for id := range s.delivered {
+		if rx, exists := m.RxObsS[id.ID]; !exists || id.Seq <= rx {
+			delete(s.delivered, id)
+		} else {
+			snapshot.Delivered = append(snapshot.Delivered, id)
+		}
+	}
+
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first and sync it as well as the directory it is renamed in, so that a crash never
+	// leaves a partial or missing snapshot behind once the log is truncated
+	tmp := filepath.Join(s.Dir, snapshotFileName+".tmp")
+	if err := writeSynced(tmp, bytes); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.Dir, snapshotFileName)); err != nil {
+		return err
+	}
+	if err := syncDir(s.Dir); err != nil {
+		return err
+	}
+
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	s.unsynced = map[int]bool{}
+	return nil
+}
+
+// writeSynced writes bytes to the file name and syncs it to disk
+func writeSynced(name string, bytes []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bytes); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs the directory dir to disk, so that the files renamed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Recover restores the state of m from the snapshot and replays the log on top of it. The caller must hold the lock
+// of m, which must have been initialized
+func (s *Store) Recover(m *UrbModule) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	bytes, err := ioutil.ReadFile(filepath.Join(s.Dir, snapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		var snapshot urbSnapshot
+		if err := json.Unmarshal(bytes, &snapshot); err != nil {
+			return fmt.Errorf("Could not decode snapshot: %v", err)
+		}
+		if snapshot.RxObsS == nil || snapshot.TxObsS == nil {
+			return fmt.Errorf("Snapshot holds no counters")
+		}
+
+		// processors of P without state were pruned after leaving the system before, they start out fresh
+		m.Seq = snapshot.Seq
+		m.RxObsS = snapshot.RxObsS
+		m.TxObsS = snapshot.TxObsS
+		for _, k := range m.P {
+			if _, exists := m.RxObsS[k]; !exists {
+				m.RxObsS[k] = -1
+			}
+		}
+		for k := range m.RxObsS {
+			if _, exists := m.TxObsS[k]; !exists {
+				m.TxObsS[k] = -1
+			}
+		}
+		m.Buffer = NewBuffer(snapshot.Records...)
+		for _, id := range snapshot.Delivered {
+			s.delivered[id] = true
+		}
+		if snapshot.Total != nil {
+			m.total = restoreTotalOrder(snapshot.Total)
+		}
+	}
+
+	if _, err := s.wal.Seek(0, 0); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(s.wal)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last entry may be torn if the processor crashed while writing it
+			log.Printf("Skipping malformed wal entry: %v", err)
+			continue
+		}
+
+		switch entry.Op {
+		case "broadcast":
+			m.Seq = max(m.Seq, entry.Identifier.Seq)
+			if m.Buffer.Get(entry.Identifier) == nil {
+				m.Buffer.Add(&BufferRecord{Msg: entry.Msg, Identifier: entry.Identifier, RecBy: map[int]bool{m.ID: true}})
+			}
+			// the promises and accepted messages broadcast since the snapshot restore what this processor promised
+			if o, err := decodePaxosMessage(entry.Msg); m.Ordering == TotalOrdering && err == nil && o != nil {
+				if m.total == nil {
+					m.total = newTotalOrder()
+				}
+				m.total.recall(o)
+			}
+		case "deliver":
+			s.delivered[entry.Identifier] = true
+			if r := m.Buffer.Get(entry.Identifier); r != nil {
+				r.Delivered = true
+			}
+			if m.total != nil {
+				m.total.dequeue(entry.Identifier)
+			}
+		case "order", "skip":
+			o, err := decodePaxosMessage(entry.Msg)
+			if err != nil || o == nil {
+				log.Printf("Skipping malformed %s wal entry: %v", entry.Op, err)
+				continue
+			}
+			if m.total == nil {
+				m.total = newTotalOrder()
+			}
+			if entry.Op == "skip" {
+				m.total.skipTo(o.Instance, o.Ordered)
+			} else if o.Instance == m.total.instance {
+				m.total.apply(o.Value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// own records trimmed after the snapshot are not in the buffer anymore, since they were acked by all trusted
+	// receivers. Catch up with the receivers, otherwise the transmit window check would reset TxObsS to seq and
+	// discard the records that are still buffered
+	lo := m.Seq
+	for m.Buffer.Get(Identifier{ID: m.ID, Seq: lo}) != nil {
+		lo--
+	}
+	for k := range m.TxObsS {
+		m.TxObsS[k] = max(m.TxObsS[k], lo)
+	}
+
+	// the hb failure detector starts over, so retransmissions are scheduled based on its new values. In total
+	// ordering, the records are urb-delivered to the ordering again, which skips the ones ordered before
+	for _, r := range m.Buffer.Records() {
+		if r.RecBy == nil {
+			r.RecBy = map[int]bool{}
+		}
+		if m.Ordering == TotalOrdering {
+			r.Delivered = false
+		}
+		r.PrevHB = map[int]int{}
+		for _, k := range m.P {
+			r.PrevHB[k] = -1
+		}
+	}
+
+	log.Printf("recovered seq %d, %d buffered records and %d delivered identifiers from %s", m.Seq, m.Buffer.Len(), len(s.delivered), s.Dir)
+	return nil
+}
@@ -0,0 +1,185 @@
+package ssurb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ssurb")
+	assert.NilError(t, err)
+	return dir
+}
+
+func TestStoreRecover(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	mod, _ := bootstrap()
+	mod.Init()
+	store, err := OpenStore(dir)
+	assert.NilError(t, err)
+	assert.NilError(t, mod.Recover(store))
+
+	// state in the snapshot as well as in the log after it should be recovered
+	mod.UrbBroadcast(&UrbMessage{Text: "foo"})
+	mod.mux.Lock()
+	mod.RxObsS[2] = 4
+	assert.NilError(t, store.LogDeliver(Identifier{ID: 2, Seq: 3}))
+	assert.NilError(t, store.LogDeliver(Identifier{ID: 2, Seq: 5}))
+	assert.NilError(t, store.Snapshot(mod))
+	mod.mux.Unlock()
+	mod.UrbBroadcast(&UrbMessage{Text: "bar"})
+	assert.NilError(t, store.LogDeliver(Identifier{ID: 0, Seq: 2}))
+	store.Close()
+
+	// a torn entry at the end of the log is skipped
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NilError(t, err)
+	wal.WriteString(`{"Op": "deli`)
+	wal.Close()
+
+	recovered, _ := bootstrap()
+	recovered.Init()
+	store, err = OpenStore(dir)
+	assert.NilError(t, err)
+	defer store.Close()
+	assert.NilError(t, recovered.Recover(store))
+
+	assert.Equal(t, recovered.Seq, 2)
+	assert.Equal(t, recovered.RxObsS[2], 4)
+	assert.Equal(t, recovered.Buffer.Len(), 2)
+	assert.Equal(t, recovered.Buffer.Get(Identifier{ID: 0, Seq: 2}).Msg.Text, "bar")
+	assert.Assert(t, recovered.Buffer.Get(Identifier{ID: 0, Seq: 2}).Delivered)
+	assert.DeepEqual(t, recovered.Buffer.Get(Identifier{ID: 0, Seq: 1}).PrevHB, constMap(recovered.P, -1))
+
+	// obsolete deliveries are dropped when snapshotting, the rest is remembered
+	assert.Assert(t, !store.Delivered(Identifier{ID: 2, Seq: 3}))
+	assert.Assert(t, store.Delivered(Identifier{ID: 2, Seq: 5}))
+	assert.Assert(t, store.Delivered(Identifier{ID: 0, Seq: 2}))
+}
+
+func TestStoreRecoversTotalOrder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := OpenStore(dir)
+	assert.NilError(t, err)
+	mod, _ := bootstrap()
+	mod.Ordering = TotalOrdering
+	mod.Init()
+	assert.NilError(t, mod.Recover(store))
+
+	// the batches decided and the ballots promised before the snapshot as well as after it should be recovered
+	mod.total = newTotalOrder()
+	mod.total.apply([]Identifier{{ID: 2, Seq: 1}, {ID: 2, Seq: 2}})
+	mod.total.promised = ballot{Round: 1, ID: 1}
+	assert.NilError(t, store.Snapshot(mod))
+	assert.NilError(t, store.LogDeliver(Identifier{ID: 2, Seq: 1}))
+	second := &paxosMessage{Phase: phaseDecided, Instance: 2, Value: []Identifier{{ID: 0, Seq: 1}}}
+	assert.NilError(t, store.LogOrder(second.encode()))
+	assert.NilError(t, store.LogDeliver(Identifier{ID: 2, Seq: 2}))
+
+	// as should skipping to an instance once the queue is empty, and the batch accepted in it
+	skipped := &paxosMessage{Phase: phaseAccept, Instance: 5, Ballot: ballot{Round: 1, ID: 1}, Ordered: map[int]int{0: 3, 2: 5}}
+	assert.NilError(t, store.LogDeliver(Identifier{ID: 0, Seq: 1}))
+	assert.NilError(t, store.LogSkip(skipped.encode()))
+	accepted := &paxosMessage{Phase: phaseAccepted, Instance: 5, Ballot: ballot{Round: 2, ID: 1}, Value: []Identifier{{ID: 2, Seq: 6}}}
+	assert.NilError(t, store.LogBroadcast(Identifier{ID: 0, Seq: 1}, accepted.encode()))
+	store.Close()
+
+	recovered, _ := bootstrap()
+	recovered.Ordering = TotalOrdering
+	recovered.Init()
+	store, err = OpenStore(dir)
+	assert.NilError(t, err)
+	defer store.Close()
+	assert.NilError(t, recovered.Recover(store))
+
+	total := recovered.total
+	assert.Equal(t, total.instance, 5)
+	assert.Equal(t, len(total.queue), 0)
+	assert.DeepEqual(t, total.ordered, map[int]int{0: 3, 2: 5})
+	assert.Equal(t, total.promised, ballot{Round: 2, ID: 1})
+	assert.Equal(t, total.accepted, ballot{Round: 2, ID: 1})
+	assert.DeepEqual(t, total.value, []Identifier{{ID: 2, Seq: 6}})
+	assert.Assert(t, !total.fresh)
+}
+
+func TestSimulatorRecoversCrashedNode(t *testing.T) {
+	sim := NewSimulator(3)
+	for _, node := range sim.Nodes {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		assert.NilError(t, sim.Persist(node.ID, dir))
+	}
+	sim.Run(time.Second)
+
+	ids := []Identifier{}
+	broadcast := func(id int) {
+		sim.Broadcast(id, &UrbMessage{Text: "foo"})
+		ids = append(ids, Identifier{ID: id, Seq: sim.Nodes[id].Urb.Seq})
+	}
+
+	// let node 1 crash in the middle of a stream of broadcasts, some of which it has delivered
+	for i := 0; i < 5; i++ {
+		broadcast(0)
+		broadcast(1)
+		sim.Run(constants.ModuleRunSleepDuration)
+	}
+	assert.Assert(t, sim.RunUntil(func() bool { return len(sim.Nodes[1].Delivered) >= 6 }, 10*time.Second))
+	broadcast(0)
+	sim.Run(constants.ModuleRunSleepDuration)
+	sim.Crash(1)
+
+	// the others keep broadcasting while node 1 is down
+	for i := 0; i < 3; i++ {
+		broadcast(0)
+		broadcast(2)
+		sim.Run(time.Second)
+	}
+
+	// after restarting, node 1 resumes its sequence numbers and delivers the rest without redelivering anything
+	assert.NilError(t, sim.Restart(1))
+	assert.Equal(t, sim.Nodes[1].Urb.Seq, 5)
+	broadcast(1)
+	assert.Equal(t, ids[len(ids)-1], Identifier{ID: 1, Seq: 6})
+
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, len(ids)), 60*time.Second))
+	sim.Run(10 * time.Second)
+	assertDeliveredOnce(t, sim, ids)
+}
+
+func TestStoreSyncsInBatches(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store, err := OpenStore(dir)
+	assert.NilError(t, err)
+	defer store.Close()
+
+	// broadcasts are not synced until the next sync, which syncs all entries appended before at once
+	assert.NilError(t, store.LogBroadcast(Identifier{ID: 0, Seq: 1}, &UrbMessage{Text: "foo"}))
+	assert.NilError(t, store.LogBroadcast(Identifier{ID: 0, Seq: 2}, &UrbMessage{Text: "bar"}))
+	assert.NilError(t, store.LogDeliver(Identifier{ID: 0, Seq: 1}))
+	assert.Assert(t, !store.Synced(1))
+	assert.Assert(t, !store.Synced(2))
+	assert.NilError(t, store.Sync())
+	assert.Assert(t, store.Synced(1))
+	assert.Assert(t, store.Synced(2))
+
+	// a snapshot covers the broadcasts appended before as well
+	assert.NilError(t, store.LogBroadcast(Identifier{ID: 0, Seq: 3}, &UrbMessage{Text: "baz"}))
+	mod, _ := bootstrap()
+	mod.Init()
+	assert.NilError(t, store.Snapshot(mod))
+	assert.Assert(t, store.Synced(3))
+	_, err = os.Stat(filepath.Join(dir, snapshotFileName+".tmp"))
+	assert.Assert(t, os.IsNotExist(err))
+}
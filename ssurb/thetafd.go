@@ -1,11 +1,12 @@
 package ssurb
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
-	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -14,36 +15,47 @@ type thetaFdMetrics struct {
 	TrustedMessagesCount prometheus.Gauge
 }
 
+var sharedThetaFdMetrics = &thetaFdMetrics{
+	TrustedMessagesCount: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "theta_fd_trusted_count",
+		Help: "The total number of trusted processors",
+	}),
+}
+
 // ThetafdModule models a theta failure detector
 type ThetafdModule struct {
 	ID       int
 	P        []int
 	Resolver IResolver
+	Params   Params
 
-	Vector  []int
+	// mux guards P and Vector, which are updated from the server goroutines
+	mux sync.Mutex
+	// Vector is keyed by processor id
+	Vector  map[int]int
 	Metrics *thetaFdMetrics
 }
 
 // Init initializes the thetafd module
 func (m *ThetafdModule) Init() {
-	for i := 0; i < len(m.P); i++ {
-		m.Vector = append(m.Vector, 0)
+	m.Vector = map[int]int{}
+	for _, id := range m.P {
+		m.Vector[id] = 0
 	}
 
-	m.Metrics = &thetaFdMetrics{
-		TrustedMessagesCount: promauto.NewGauge(prometheus.GaugeOpts{
-			Name: "theta_fd_trusted_count",
-			Help: "The total number of trusted processors",
-		}),
-	}
+	// metrics are registered once and shared by all module instances
+	m.Metrics = sharedThetaFdMetrics
 }
 
 // Trusted returns the set of processor IDs that are below the threshold ThetafdW
 func (m *ThetafdModule) Trusted() []int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
 	trusted := []int{}
-	for idx, x := range m.Vector {
-		if x < constants.ThetafdW {
-			trusted = append(trusted, idx)
+	for _, id := range m.P {
+		if x, exists := m.Vector[id]; exists && x < m.Params.thetafdW() {
+			trusted = append(trusted, id)
 		}
 	}
 
@@ -51,21 +63,56 @@ func (m *ThetafdModule) Trusted() []int {
 	return trusted
 }
 
-// DoForever starts the algorithm and runs forever
-func (m *ThetafdModule) DoForever() {
+// DoForever starts the algorithm and runs until ctx is cancelled
+func (m *ThetafdModule) DoForever(ctx context.Context) {
 	for {
-		for _, id := range m.P {
-			if id != m.ID {
-				m.sendHeartbeat(id)
-			}
+		m.Step()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.Params.heartbeatInterval()):
 		}
+	}
+}
 
-		time.Sleep(time.Second * 1)
+// Step runs one iteration of the do forever loop
+func (m *ThetafdModule) Step() {
+	m.mux.Lock()
+	P := m.P
+	m.mux.Unlock()
+
+	for _, id := range P {
+		if id != m.ID {
+			m.sendHeartbeat(id)
+		}
 	}
 }
 
+// setMembers replaces the set of processors. Counters of the ones joining start over, also if they were part of the
+// system before, and the ones of the processors leaving are removed
+func (m *ThetafdModule) setMembers(P []int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for _, k := range P {
+		if !contains(m.P, k) {
+			m.Vector[k] = 0
+		}
+	}
+	for k := range m.Vector {
+		if !contains(P, k) {
+			delete(m.Vector, k)
+		}
+	}
+	m.P = P
+}
+
 // onHearbeat is called by the resolver when a new heartbeat message was received from another processor
 func (m *ThetafdModule) onHeartbeat(senderID int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
 	m.Vector[senderID] = 0
 	for idx := range m.Vector {
 		if idx == senderID || idx == m.ID {
@@ -79,5 +126,5 @@ func (m *ThetafdModule) onHeartbeat(senderID int) {
 // sendHeartbeat sends a heartbeat to another processor to indicate that this processor is alive
 func (m *ThetafdModule) sendHeartbeat(receiverID int) {
 	message := models.Message{Type: models.THETAheartbeat, Sender: m.ID, Data: nil}
-	go SendToProcessor(receiverID, &message)
+	m.Resolver.Send(receiverID, &message)
 }
@@ -0,0 +1,57 @@
+package ssurb
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+	"gotest.tools/assert"
+)
+
+func TestThetafdTrusted(t *testing.T) {
+	mod := ThetafdModule{ID: 0, P: []int{0, 1, 2}}
+	mod.Init()
+	assert.Assert(t, reflect.DeepEqual(mod.Trusted(), []int{0, 1, 2}))
+
+	// only hearing from processor 1 should eventually make processor 2 suspected
+	var wg sync.WaitGroup
+	for i := 0; i < constants.ThetafdW; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mod.onHeartbeat(1)
+			mod.Trusted()
+		}()
+	}
+	wg.Wait()
+
+	assert.Assert(t, reflect.DeepEqual(mod.Vector, map[int]int{0: 0, 1: 0, 2: constants.ThetafdW}))
+	assert.Assert(t, reflect.DeepEqual(mod.Trusted(), []int{0, 1}))
+}
+
+func TestThetafdTrustedSparseIDs(t *testing.T) {
+	mod := ThetafdModule{ID: 17, P: []int{17, 42, 103}}
+	mod.Init()
+	assert.Assert(t, reflect.DeepEqual(mod.Trusted(), []int{17, 42, 103}))
+
+	// Trusted returns processor ids, not positions in P
+	for i := 0; i < constants.ThetafdW; i++ {
+		mod.onHeartbeat(103)
+	}
+	assert.Assert(t, reflect.DeepEqual(mod.Vector, map[int]int{17: 0, 42: constants.ThetafdW, 103: 0}))
+	assert.Assert(t, reflect.DeepEqual(mod.Trusted(), []int{17, 103}))
+}
+
+func TestThetafdConfiguredW(t *testing.T) {
+	mod := ThetafdModule{ID: 0, P: []int{0, 1}, Params: Params{ThetafdW: 3}}
+	mod.Init()
+
+	// processor 1 is suspected after only 3 heartbeats from processor 0
+	for i := 0; i < 2; i++ {
+		mod.onHeartbeat(0)
+	}
+	assert.Assert(t, reflect.DeepEqual(mod.Trusted(), []int{0, 1}))
+	mod.onHeartbeat(0)
+	assert.Assert(t, reflect.DeepEqual(mod.Trusted(), []int{0}))
+}
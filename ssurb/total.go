@@ -0,0 +1,714 @@
+package ssurb
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+)
+
+// Headers of the consensus messages of total ordering. They are reserved and stripped from messages of the
+// application, which would otherwise be taken for consensus messages
+const (
+	// HeaderTotalOrder lists the messages of a batch, e.g. "1:4,3:2"
+	HeaderTotalOrder = "total-order"
+	// HeaderTotalOrderPhase holds the phase of a consensus message, i.e. prepare, promise, accept or accepted
+	HeaderTotalOrderPhase = "total-order-phase"
+	// HeaderTotalOrderInstance holds the instance of consensus a message belongs to, e.g. "7"
+	HeaderTotalOrderInstance = "total-order-instance"
+	// HeaderTotalOrderBallot holds the ballot of a consensus message as its round and the id of its coordinator,
+	// e.g. "3:1"
+	HeaderTotalOrderBallot = "total-order-ballot"
+	// HeaderTotalOrderPromised holds the highest ballot the sender of a promise promised, e.g. "4:2". It is higher than
+	// the ballot of the promise if the prepare was refused
+	HeaderTotalOrderPromised = "total-order-promised"
+	// HeaderTotalOrderAccepted holds the ballot under which the sender of a promise accepted the batch it lists, e.g.
+	// "2:0"
+	HeaderTotalOrderAccepted = "total-order-accepted"
+	// HeaderTotalOrderPrevious lists the batch decided in the instance before the one of an accept, e.g. "1:4,3:2"
+	HeaderTotalOrderPrevious = "total-order-previous"
+	// HeaderTotalOrderOrdered holds the highest sequence number per sender put in order before the instance of an
+	// accept or promise, e.g. "1:4,3:2". It lets processors that are behind skip to that instance
+	HeaderTotalOrderOrdered = "total-order-ordered"
+)
+
+// Phases of consensus messages
+const (
+	phasePrepare  = "prepare"
+	phasePromise  = "promise"
+	phaseAccept   = "accept"
+	phaseAccepted = "accepted"
+	// phaseDecided is only logged by the store, it is never broadcast
+	phaseDecided = "decided"
+)
+
+// ballot is a ballot of consensus, given by a round and the id of the processor coordinating it. Ballots are ordered
+// by round and then by id, and the zero ballot is lower than every ballot of a coordinator, whose rounds start at 1
+type ballot struct {
+	Round int
+	ID    int
+}
+
+// less returns true if b is lower than other
+func (b ballot) less(other ballot) bool {
+	return b.Round < other.Round || (b.Round == other.Round && b.ID < other.ID)
+}
+
+func (b ballot) String() string {
+	return fmt.Sprintf("%d:%d", b.Round, b.ID)
+}
+
+// decodeBallot decodes a ballot encoded by String, the empty string is the zero ballot
+func decodeBallot(s string) (ballot, error) {
+	if s == "" {
+		return ballot{}, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return ballot{}, fmt.Errorf("Malformed ballot %q", s)
+	}
+	round, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return ballot{}, fmt.Errorf("Malformed ballot %q: %v", s, err)
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ballot{}, fmt.Errorf("Malformed ballot %q: %v", s, err)
+	}
+	return ballot{Round: round, ID: id}, nil
+}
+
+// paxosMessage is a message of consensus on the batch of messages put in order by an instance. A coordinator
+// prepares its ballot, acceptors answer with a promise reporting the batch they accepted in their current instance,
+// the coordinator asks them to accept a batch and they announce it as accepted. Accepts additionally carry the batch
+// decided in the instance before, and accepts and promises the messages put in order before their instance
+type paxosMessage struct {
+	Phase    string
+	Instance int
+	Ballot   ballot
+	Promised ballot
+	Accepted ballot
+	Value    []Identifier
+	Previous []Identifier
+	Ordered  map[int]int
+
+	// record is the buffer record carrying the message
+	record *BufferRecord
+}
+
+// decodePaxosMessage returns the consensus message carried by msg, or nil if msg is a message of the application
+func decodePaxosMessage(msg *UrbMessage) (*paxosMessage, error) {
+	phase, exists := msg.Headers[HeaderTotalOrderPhase]
+	if !exists {
+		return nil, nil
+	}
+	switch phase {
+	case phasePrepare, phasePromise, phaseAccept, phaseAccepted, phaseDecided:
+	default:
+		return nil, fmt.Errorf("Unknown phase %q", phase)
+	}
+
+	o := &paxosMessage{Phase: phase}
+	var err error
+	if o.Instance, err = strconv.Atoi(msg.Headers[HeaderTotalOrderInstance]); err != nil || o.Instance < 1 {
+		return nil, fmt.Errorf("Malformed instance %q", msg.Headers[HeaderTotalOrderInstance])
+	}
+	if o.Ballot, err = decodeBallot(msg.Headers[HeaderTotalOrderBallot]); err != nil {
+		return nil, err
+	}
+	if o.Promised, err = decodeBallot(msg.Headers[HeaderTotalOrderPromised]); err != nil {
+		return nil, err
+	}
+	if o.Accepted, err = decodeBallot(msg.Headers[HeaderTotalOrderAccepted]); err != nil {
+		return nil, err
+	}
+	if o.Value, err = decodeIdentifiers(msg.Headers[HeaderTotalOrder]); err != nil {
+		return nil, err
+	}
+	if previous, exists := msg.Headers[HeaderTotalOrderPrevious]; exists {
+		if o.Previous, err = decodeIdentifiers(previous); err != nil {
+			return nil, err
+		}
+	}
+	if o.Ordered, err = decodeVectorClock(msg.Headers[HeaderTotalOrderOrdered]); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// encode returns the urb message carrying o, fields that are not set are not encoded
+func (o *paxosMessage) encode() *UrbMessage {
+	msg := &UrbMessage{Headers: map[string]string{
+		HeaderTotalOrderPhase:    o.Phase,
+		HeaderTotalOrderInstance: strconv.Itoa(o.Instance),
+	}}
+	if o.Ballot != (ballot{}) {
+		msg.Headers[HeaderTotalOrderBallot] = o.Ballot.String()
+	}
+	if o.Promised != (ballot{}) {
+		msg.Headers[HeaderTotalOrderPromised] = o.Promised.String()
+	}
+	if o.Accepted != (ballot{}) {
+		msg.Headers[HeaderTotalOrderAccepted] = o.Accepted.String()
+	}
+	if len(o.Value) > 0 {
+		msg.Headers[HeaderTotalOrder] = encodeIdentifiers(o.Value)
+	}
+	if o.Previous != nil {
+		msg.Headers[HeaderTotalOrderPrevious] = encodeIdentifiers(o.Previous)
+	}
+	if ordered := encodeVectorClock(o.Ordered); ordered != "" {
+		msg.Headers[HeaderTotalOrderOrdered] = ordered
+	}
+	return msg
+}
+
+// totalOrder is the state of total ordering. The urb-delivered messages are put in order in batches, one per instance
+// of consensus, following Paxos. Every processor is an acceptor. The processor coordinating the highest ballot
+// proposes batches, and the trusted processor with the lowest id prepares a higher ballot once it suspects that
+// coordinator. All consensus messages are urb-broadcast, and a batch is decided in an instance once a majority of the
+// processors announced it as accepted under the same ballot.
+//
+// The invariant keeping the order identical at every processor is that at most one batch is decided per instance:
+// once a batch is decided under ballot b, the batch of every accept of a higher ballot of that instance is the same.
+// A coordinator only sends accepts after a majority of the processors promised its ballot, and proposes the batch
+// accepted under the highest ballot these promises report, or a new one if they report none. Acceptors never accept
+// under a ballot lower than the highest one they promised, and only accept in the first instance they have not decided,
+// so a promise reports everything its sender accepted that a later accept may conflict with. Any two majorities
+// intersect, so the promises of a higher ballot report the decided batch. Every processor delivers the decided batches
+// instance by instance, so all processors deliver the same messages in the same order.
+//
+// A processor that is behind learns the decisions it missed from the accepted messages and from the batch decided in
+// the instance before, carried by every accept. It skips instances whose consensus messages were given up on, see
+// catchUp, and the batches of skipped instances are given up on as well. Skipping never changes the order of the
+// messages delivered, only leaves some out. Acceptors persist their state along with the urb state. One that restarts
+// without it may accept against its promises from before, which is why the data dir should be kept across restarts
+type totalOrder struct {
+	// pending holds the urb-delivered messages that are not ordered yet
+	pending map[Identifier]*UrbMessage
+	// queue holds the messages of the decided batches that are not delivered yet
+	queue []Identifier
+	// ordered holds the highest sequence number per sender that was put in order. Batches hold the messages of every
+	// sender by their sequence numbers, so lower ones are ordered already or given up on
+	ordered map[int]int
+	// instance is the first instance that is not decided here, last holds the batch decided in the one before
+	instance int
+	last     []Identifier
+	// fresh is true until an instance is decided or skipped, since this processor started without state
+	fresh bool
+
+	// decided holds the batches of later instances known to be decided, and reports the accepts and promises of later
+	// instances, which tell what is ordered before them
+	decided map[int][]Identifier
+	reports []*paxosMessage
+	// accepteds holds the senders of the accepted messages of the current and later instances by ballot, and values
+	// the batches they accepted
+	accepteds map[int]map[ballot]map[int]bool
+	values    map[int]map[ballot][]Identifier
+
+	// promised is the highest ballot this processor promised, accepted and value the ballot and batch it accepted in
+	// the current instance. accepts holds the accept of the highest ballot of the current and later instances
+	promised ballot
+	accepted ballot
+	value    []Identifier
+	accepts  map[int]*paxosMessage
+	// outbox holds the consensus messages waiting for space in the transmit window
+	outbox []*UrbMessage
+
+	// seen is the highest ballot seen and quiet the number of iterations since a consensus message of its coordinator
+	// was urb-delivered. prepared is the ballot this processor coordinates, promises holds the promises answering its
+	// prepare and proposed the last instance it sent an accept in
+	seen     ballot
+	quiet    int
+	prepared ballot
+	promises map[int]*paxosMessage
+	proposed int
+}
+
+// newTotalOrder returns the state of total ordering before any instance was decided
+func newTotalOrder() *totalOrder {
+	t := &totalOrder{pending: map[Identifier]*UrbMessage{}, ordered: map[int]int{}, fresh: true,
+		promises: map[int]*paxosMessage{}}
+	t.advance(1)
+	return t
+}
+
+// see records that ballot b was seen
+func (t *totalOrder) see(b ballot) {
+	if t.seen.less(b) {
+		t.seen, t.quiet = b, 0
+	}
+}
+
+// advance moves on to instance, dropping what is known of the ones before
+func (t *totalOrder) advance(instance int) {
+	t.instance = instance
+	t.accepted, t.value = ballot{}, nil
+
+	decided := map[int][]Identifier{}
+	for k, batch := range t.decided {
+		if k >= instance {
+			decided[k] = batch
+		}
+	}
+	t.decided = decided
+	reports := []*paxosMessage{}
+	for _, o := range t.reports {
+		if o.Instance > instance {
+			reports = append(reports, o)
+		}
+	}
+	t.reports = reports
+	accepteds, values, accepts := map[int]map[ballot]map[int]bool{}, map[int]map[ballot][]Identifier{}, map[int]*paxosMessage{}
+	for k := range t.accepteds {
+		if k >= instance {
+			accepteds[k], values[k] = t.accepteds[k], t.values[k]
+		}
+	}
+	for k, o := range t.accepts {
+		if k >= instance {
+			accepts[k] = o
+		}
+	}
+	t.accepteds, t.values, t.accepts = accepteds, values, accepts
+}
+
+// apply queues the batch decided in the current instance and moves on to the next one
+func (t *totalOrder) apply(batch []Identifier) {
+	t.queue = append(t.queue, batch...)
+	t.last = batch
+	t.fresh = false
+	t.advance(t.instance + 1)
+}
+
+// skipTo gives up on the instances before instance, continuing as if the messages in ordered were put in order by
+// them. The messages they put in order are given up on as well
+func (t *totalOrder) skipTo(instance int, ordered map[int]int) {
+	for j, s := range ordered {
+		t.ordered[j] = max(t.ordered[j], s)
+	}
+	for id := range t.pending {
+		if id.Seq <= t.ordered[id.ID] {
+			delete(t.pending, id)
+		}
+	}
+	t.last = nil
+	t.fresh = false
+	t.advance(instance)
+}
+
+// recall restores the acceptor state from the promise or accepted message o this processor broadcast before
+// restarting
+func (t *totalOrder) recall(o *paxosMessage) {
+	switch o.Phase {
+	case phasePromise:
+		if t.promised.less(o.Promised) {
+			t.promised = o.Promised
+		}
+	case phaseAccepted:
+		if t.promised.less(o.Ballot) {
+			t.promised = o.Ballot
+		}
+		if o.Instance == t.instance {
+			t.accepted, t.value = o.Ballot, o.Value
+		}
+	}
+	t.see(t.promised)
+}
+
+// dequeue removes the messages up to the delivered message id from the queue, the ones before it were skipped
+func (t *totalOrder) dequeue(id Identifier) {
+	for i, queued := range t.queue {
+		if queued != id {
+			continue
+		}
+		for _, skipped := range t.queue[:i+1] {
+			t.ordered[skipped.ID] = max(t.ordered[skipped.ID], skipped.Seq)
+		}
+		t.queue = t.queue[i+1:]
+		return
+	}
+}
+
+// orderedBefore returns the highest sequence number per sender put in order before the current instance, including
+// the queued messages
+func (t *totalOrder) orderedBefore() map[int]int {
+	ordered := map[int]int{}
+	for id, seq := range t.ordered {
+		ordered[id] = seq
+	}
+	for _, id := range t.queue {
+		ordered[id.ID] = max(ordered[id.ID], id.Seq)
+	}
+	return ordered
+}
+
+// snapshot returns the state of t that is persisted, i.e. the decided batches, what they put in order and the state
+// of the acceptor
+func (t *totalOrder) snapshot() *totalSnapshot {
+	return &totalSnapshot{Instance: t.instance, Last: t.last, Fresh: t.fresh, Queue: t.queue, Ordered: t.ordered,
+		Promised: t.promised, Accepted: t.accepted, Value: t.value}
+}
+
+// restoreTotalOrder returns the state of total ordering persisted in s, the consensus messages and the messages not
+// ordered yet are urb-delivered again
+func restoreTotalOrder(s *totalSnapshot) *totalOrder {
+	t := newTotalOrder()
+	t.instance, t.last, t.fresh, t.queue = max(s.Instance, 1), s.Last, s.Fresh, s.Queue
+	if s.Ordered != nil {
+		t.ordered = s.Ordered
+	}
+	t.promised, t.accepted, t.value = s.Promised, s.Accepted, s.Value
+	t.see(t.promised)
+	return t
+}
+
+// deliverInTotalOrder urb-delivers the records acked by all trusted processors to the total ordering, takes part in
+// consensus on the batches and delivers the messages of the decided ones. Returns the number of messages waiting to
+// be ordered
+func (m *UrbModule) deliverInTotalOrder(trusted map[int]bool) int {
+	if m.total == nil {
+		m.total = newTotalOrder()
+	}
+	t := m.total
+	t.quiet++
+
+	for _, r := range m.Buffer.Records() {
+		if r.Delivered || !isSubset(trusted, r.RecBy) {
+			continue
+		}
+		r.Delivered = true
+
+		o, err := decodePaxosMessage(r.Msg)
+		if err != nil {
+			log.Printf("Ignoring consensus message %v. Got error: %v", r.Identifier, err)
+		} else if o != nil {
+			o.record = r
+			m.receive(o, r.Identifier.ID)
+		} else if r.Identifier.Seq > t.ordered[r.Identifier.ID] {
+			t.pending[r.Identifier] = r.Msg
+		}
+	}
+
+	m.decide()
+	m.accept()
+	m.coordinate(trusted)
+	m.flush()
+
+	return len(t.pending)
+}
+
+// receive processes the consensus message o urb-delivered from sender. Acceptors answer a prepare with a promise
+// right away, raising their promised ballot if it is higher
+func (m *UrbModule) receive(o *paxosMessage, sender int) {
+	t := m.total
+	t.see(o.Ballot)
+	t.see(o.Promised)
+	if sender == t.seen.ID {
+		t.quiet = 0
+	}
+
+	switch o.Phase {
+	case phasePrepare:
+		if t.promised.less(o.Ballot) {
+			t.promised = o.Ballot
+		}
+		promise := &paxosMessage{Phase: phasePromise, Instance: t.instance, Ballot: o.Ballot, Promised: t.promised,
+			Accepted: t.accepted, Value: t.value, Ordered: t.orderedBefore()}
+		t.outbox = append(t.outbox, promise.encode())
+	case phasePromise:
+		if o.Ballot == t.prepared {
+			t.promises[sender] = o
+		}
+		if o.Instance > t.instance {
+			t.reports = append(t.reports, o)
+		}
+	case phaseAccept:
+		if o.Previous != nil && o.Instance-1 >= t.instance {
+			t.decided[o.Instance-1] = o.Previous
+		}
+		if previous := t.accepts[o.Instance]; o.Instance >= t.instance && (previous == nil || previous.Ballot.less(o.Ballot)) {
+			t.accepts[o.Instance] = o
+		}
+		if o.Instance > t.instance {
+			t.reports = append(t.reports, o)
+		}
+	case phaseAccepted:
+		if o.Instance < t.instance {
+			return
+		}
+		if t.accepteds[o.Instance] == nil {
+			t.accepteds[o.Instance], t.values[o.Instance] = map[ballot]map[int]bool{}, map[ballot][]Identifier{}
+		}
+		if t.accepteds[o.Instance][o.Ballot] == nil {
+			t.accepteds[o.Instance][o.Ballot] = map[int]bool{}
+		}
+		t.accepteds[o.Instance][o.Ballot][sender] = true
+		t.values[o.Instance][o.Ballot] = o.Value
+	}
+}
+
+// decide delivers the batches decided instance by instance, skipping the instances that will never be decided here,
+// see catchUp
+func (m *UrbModule) decide() {
+	t := m.total
+	for {
+		m.deliverOrdered()
+
+		if batch, decided := m.decision(t.instance); decided {
+			t.apply(batch)
+			if m.Store != nil {
+				decision := &paxosMessage{Phase: phaseDecided, Instance: t.instance - 1, Value: batch}
+				if err := m.Store.LogOrder(decision.encode()); err != nil {
+					log.Printf("Could not log decision of instance %d. Got error: %v", t.instance-1, err)
+				}
+			}
+			continue
+		}
+
+		o := m.catchUp()
+		if o == nil {
+			return
+		}
+		log.Printf("Skipping to instance %d after the %s of %d, from instance %d", o.Instance, o.Phase, o.record.Identifier.ID, t.instance)
+		t.skipTo(o.Instance, o.Ordered)
+		if m.Store != nil {
+			if err := m.Store.LogSkip(o.record.Msg); err != nil {
+				log.Printf("Could not log skipping to instance %d. Got error: %v", o.Instance, err)
+			}
+		}
+	}
+}
+
+// decision returns the batch decided in instance k, if it is known. It is decided once a majority of the processors
+// accepted it under the same ballot, or once an accept of the instance after carries it
+func (m *UrbModule) decision(k int) ([]Identifier, bool) {
+	t := m.total
+	if batch, exists := t.decided[k]; exists {
+		return batch, true
+	}
+	for b, senders := range t.accepteds[k] {
+		if m.majority(senders) {
+			return t.values[k][b], true
+		}
+	}
+	return nil, false
+}
+
+// catchUp returns the accept or promise of a later instance to skip to, if the current instance will never be
+// decided here. No processor skips while messages are queued. A processor that has not decided any instance since it
+// started without state skips to the latest instance it knows of, unless it knows of an accept or accepted message of
+// the current one. Others skip to the earliest instance whose accept or promise follows everything its sender
+// broadcast before that is not urb-delivered yet, which is the case once the consensus messages of the current
+// instance were given up on by the receiving window or while this processor was cut off from a majority. An
+// accept following another one of the same coordinator carries the decision of the instance before, so a processor
+// only skips an instance it would still decide if the coordinator changed while it was more than one instance behind
+func (m *UrbModule) catchUp() *paxosMessage {
+	t := m.total
+	if len(t.queue) > 0 || (t.fresh && (t.accepts[t.instance] != nil || len(t.accepteds[t.instance]) > 0)) {
+		return nil
+	}
+
+	var next *paxosMessage
+	for _, o := range t.reports {
+		if t.fresh {
+			if next == nil || o.Instance > next.Instance {
+				next = o
+			}
+		} else if m.givenUp(o.record) && (next == nil || o.Instance < next.Instance) {
+			next = o
+		}
+	}
+	return next
+}
+
+// givenUp returns true if all messages the sender of r broadcast before it are urb-delivered or obsolete, so that the
+// ones that are not urb-delivered never will be
+func (m *UrbModule) givenUp(r *BufferRecord) bool {
+	k := r.Identifier.ID
+	rx, exists := m.RxObsS[k]
+	if !exists {
+		return false
+	}
+	for s := rx + 1; s < r.Identifier.Seq; s++ {
+		if r := m.Buffer.Get(Identifier{ID: k, Seq: s}); r == nil || !r.Delivered {
+			return false
+		}
+	}
+	return true
+}
+
+// majority returns true if ids holds more than half of the processors
+func (m *UrbModule) majority(ids map[int]bool) bool {
+	count := 0
+	for _, k := range m.P {
+		if ids[k] {
+			count++
+		}
+	}
+	return 2*count > len(m.P)
+}
+
+// accept accepts the accept of the current instance with the highest ballot, unless a higher ballot was promised
+func (m *UrbModule) accept() {
+	t := m.total
+	o := t.accepts[t.instance]
+	if o == nil || o.Ballot.less(t.promised) || o.Ballot == t.accepted {
+		return
+	}
+
+	t.promised, t.accepted, t.value = o.Ballot, o.Ballot, o.Value
+	accepted := &paxosMessage{Phase: phaseAccepted, Instance: t.instance, Ballot: o.Ballot, Value: o.Value}
+	t.outbox = append(t.outbox, accepted.encode())
+}
+
+// lowestTrusted returns the trusted processor with the lowest id
+func lowestTrusted(trusted map[int]bool) int {
+	lowest := -1
+	for id := range trusted {
+		if lowest == -1 || id < lowest {
+			lowest = id
+		}
+	}
+	return lowest
+}
+
+// coordinate proposes the next batch if this processor coordinates the highest ballot seen. The trusted processor
+// with the lowest id prepares a higher ballot if the coordinator of the highest one is not trusted and sent no
+// consensus message for constants.CoordinatorTimeout iterations, so that a coordinator that is only suspected keeps
+// coordinating until another one prepared, and two processors suspecting each other do not keep preempting each
+// other's ballots. A coordinator prepares again if no majority promised its ballot by then, as its prepare may have
+// been ignored, e.g. when it restarted without its state. Batches are proposed once a majority promised the ballot,
+// one per instance, after this processor decided the instances the promises report
+func (m *UrbModule) coordinate(trusted map[int]bool) {
+	t := m.total
+	promised := map[int]bool{}
+	for id := range t.promises {
+		promised[id] = true
+	}
+	coordinating := t.prepared == t.seen && t.prepared != (ballot{})
+	other := t.seen != (ballot{}) && t.seen.ID != m.ID
+	if !coordinating && (m.ID != lowestTrusted(trusted) ||
+		(other && (trusted[t.seen.ID] || t.quiet < constants.CoordinatorTimeout))) {
+		return
+	}
+
+	if !coordinating || (!m.majority(promised) && t.quiet >= constants.CoordinatorTimeout) {
+		t.prepared = ballot{Round: t.seen.Round + 1, ID: m.ID}
+		t.seen, t.quiet = t.prepared, 0
+		t.promises, t.proposed = map[int]*paxosMessage{}, 0
+		prepare := &paxosMessage{Phase: phasePrepare, Instance: t.instance, Ballot: t.prepared}
+		t.outbox = append(t.outbox, prepare.encode())
+		return
+	}
+	if !m.majority(promised) || t.proposed >= t.instance {
+		return
+	}
+
+	// the batch accepted under the highest ballot may already be decided
+	var batch []Identifier
+	highest := ballot{}
+	for _, o := range t.promises {
+		if o.Instance > t.instance {
+			return
+		} else if o.Instance == t.instance && highest.less(o.Accepted) {
+			highest, batch = o.Accepted, o.Value
+		}
+	}
+	if batch == nil {
+		if batch = m.batch(); len(batch) == 0 {
+			return
+		}
+	}
+
+	t.proposed = t.instance
+	accept := &paxosMessage{Phase: phaseAccept, Instance: t.instance, Ballot: t.prepared, Value: batch,
+		Previous: t.last, Ordered: t.orderedBefore()}
+	t.outbox = append(t.outbox, accept.encode())
+}
+
+// batch returns the urb-delivered messages that are not put in order yet. The messages of every sender are listed by
+// their sequence numbers, up to the first one that is missing, see missing
+func (m *UrbModule) batch() []Identifier {
+	t := m.total
+	proposed := t.orderedBefore()
+	bySender := map[int][]int{}
+	senders := []int{}
+	for id := range t.pending {
+		if _, exists := bySender[id.ID]; !exists {
+			senders = append(senders, id.ID)
+		}
+		bySender[id.ID] = append(bySender[id.ID], id.Seq)
+	}
+	sort.Ints(senders)
+
+	batch := []Identifier{}
+	for _, j := range senders {
+		seqs := bySender[j]
+		sort.Ints(seqs)
+		for _, s := range seqs {
+			if s <= proposed[j] {
+				continue
+			} else if m.missing(j, proposed[j]+1, s) {
+				break
+			}
+			batch = append(batch, Identifier{ID: j, Seq: s})
+			proposed[j] = s
+		}
+	}
+	return batch
+}
+
+// missing returns true if a message processor j broadcast with a sequence number from lo up to hi, exclusively, may
+// still be urb-delivered as a message of the application. Messages that are obsolete without being urb-delivered were
+// given up on, and consensus messages are never put in order
+func (m *UrbModule) missing(j, lo, hi int) bool {
+	for s := max(lo, m.RxObsS[j]+1); s < hi; s++ {
+		r := m.Buffer.Get(Identifier{ID: j, Seq: s})
+		if r == nil || !r.Delivered {
+			return true
+		}
+		if _, consensus := r.Msg.Headers[HeaderTotalOrderPhase]; !consensus {
+			return true
+		}
+	}
+	return false
+}
+
+// flush broadcasts the consensus messages of the outbox while the transmit window has space
+func (m *UrbModule) flush() {
+	t := m.total
+	for len(t.outbox) > 0 && m.availableSpace() {
+		m.broadcast(t.outbox[0])
+		t.outbox = t.outbox[1:]
+	}
+}
+
+// deliverOrdered delivers the messages at the head of the queue that are urb-delivered. A message that is obsolete
+// without being urb-delivered was given up on by the receiving window and is skipped, as are the messages of
+// processors that left and whose state was pruned
+func (m *UrbModule) deliverOrdered() {
+	t := m.total
+	for len(t.queue) > 0 {
+		id := t.queue[0]
+		if msg, exists := t.pending[id]; exists {
+			m.persistAndDeliver(msg, id)
+		} else if rx, exists := m.RxObsS[id.ID]; id.Seq > t.ordered[id.ID] && exists && id.Seq > rx {
+			return
+		}
+
+		t.queue = t.queue[1:]
+		if id.Seq > t.ordered[id.ID] {
+			t.ordered[id.ID] = id.Seq
+		}
+		for pending := range t.pending {
+			if pending.ID == id.ID && pending.Seq <= t.ordered[id.ID] {
+				delete(t.pending, pending)
+			}
+		}
+	}
+}
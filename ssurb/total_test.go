@@ -0,0 +1,597 @@
+package ssurb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+	"gotest.tools/assert"
+)
+
+// deliveryOrder returns the identifiers delivered by processor id in the order they were delivered in
+func deliveryOrder(sim *Simulator, id int) []Identifier {
+	ids := []Identifier{}
+	for _, d := range sim.Nodes[id].Delivered {
+		ids = append(ids, d.Identifier)
+	}
+	return ids
+}
+
+// coordinator returns the processor coordinating the highest ballot processor id has seen
+func coordinator(sim *Simulator, id int) int {
+	return sim.Nodes[id].Urb.total.seen.ID
+}
+
+// inTotalOrder returns true if all given processors delivered the same messages in the same order
+func inTotalOrder(sim *Simulator, ids ...int) bool {
+	for _, id := range ids[1:] {
+		if fmt.Sprint(deliveryOrder(sim, id)) != fmt.Sprint(deliveryOrder(sim, ids[0])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPaxosMessageEncoding(t *testing.T) {
+	o := &paxosMessage{Phase: phaseAccept, Instance: 7, Ballot: ballot{Round: 3, ID: 1},
+		Value: []Identifier{{ID: 1, Seq: 4}, {ID: 3, Seq: 2}}, Previous: []Identifier{{ID: 2, Seq: 9}},
+		Ordered: map[int]int{1: 3, 3: 1}}
+	msg := o.encode()
+	assert.DeepEqual(t, msg.Headers, map[string]string{HeaderTotalOrderPhase: "accept", HeaderTotalOrderInstance: "7",
+		HeaderTotalOrderBallot: "3:1", HeaderTotalOrder: "1:4,3:2", HeaderTotalOrderPrevious: "2:9",
+		HeaderTotalOrderOrdered: "1:3,3:1"})
+	decoded, err := decodePaxosMessage(msg)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded.encode(), msg)
+
+	// a promise reports the ballot promised and the batch accepted, the previous batch is only encoded if it is known
+	o = &paxosMessage{Phase: phasePromise, Instance: 2, Ballot: ballot{Round: 1, ID: 0}, Promised: ballot{Round: 2, ID: 4},
+		Accepted: ballot{Round: 1, ID: 2}, Value: []Identifier{{ID: 1, Seq: 1}}}
+	msg = o.encode()
+	assert.Equal(t, msg.Headers[HeaderTotalOrderPromised], "2:4")
+	assert.Equal(t, msg.Headers[HeaderTotalOrderAccepted], "1:2")
+	decoded, err = decodePaxosMessage(msg)
+	assert.NilError(t, err)
+	assert.Equal(t, decoded.Promised, o.Promised)
+	assert.Equal(t, decoded.Accepted, o.Accepted)
+	assert.Assert(t, decoded.Previous == nil)
+
+	decoded, err = decodePaxosMessage(&UrbMessage{Text: "Hello"})
+	assert.NilError(t, err)
+	assert.Assert(t, decoded == nil)
+	_, err = decodePaxosMessage(&UrbMessage{Headers: map[string]string{HeaderTotalOrderPhase: "commit"}})
+	assert.Error(t, err, `Unknown phase "commit"`)
+	_, err = decodePaxosMessage(&UrbMessage{Headers: map[string]string{HeaderTotalOrderPhase: "accept", HeaderTotalOrderInstance: "0"}})
+	assert.Error(t, err, `Malformed instance "0"`)
+	_, err = decodePaxosMessage(&UrbMessage{Headers: map[string]string{HeaderTotalOrderPhase: "accept",
+		HeaderTotalOrderInstance: "1", HeaderTotalOrderBallot: "3"}})
+	assert.Error(t, err, `Malformed ballot "3"`)
+}
+
+// consensus returns a function adding a record of a consensus message to the buffer of mod acked by all processors,
+// and one returning the consensus message mod broadcast with sequence number seq
+func consensus(mod *UrbModule) (func(*paxosMessage, Identifier), func(int) *paxosMessage) {
+	add := func(o *paxosMessage, id Identifier) { addRecord(mod, o.encode(), id, listToMap(mod.P)) }
+	sent := func(seq int) *paxosMessage {
+		r := mod.Buffer.Get(Identifier{ID: mod.ID, Seq: seq})
+		if r == nil {
+			return nil
+		}
+		o, _ := decodePaxosMessage(r.Msg)
+		return o
+	}
+	return add, sent
+}
+
+// ackAll marks all records in the buffer of mod as acked by all processors
+func ackAll(mod *UrbModule) {
+	for _, r := range mod.Buffer.Records() {
+		r.RecBy = listToMap(mod.P)
+	}
+}
+
+func TestTotalOrderDecidesBatches(t *testing.T) {
+	mod, r, delivered := bootstrapOrdering(TotalOrdering)
+	r.TrustedRet = mod.P
+	add, sent := consensus(mod)
+	b := ballot{Round: 1, ID: 0}
+
+	// processor 0 is the trusted processor with the lowest id and prepares the first ballot
+	addRecord(mod, &UrbMessage{Text: "Hello"}, Identifier{ID: 2, Seq: 1}, listToMap(mod.P))
+	addRecord(mod, &UrbMessage{Text: "World"}, Identifier{ID: 1, Seq: 1}, listToMap(mod.P))
+	processAndHandOver(mod)
+	assert.DeepEqual(t, sent(1).encode(), (&paxosMessage{Phase: phasePrepare, Instance: 1, Ballot: b}).encode())
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.DeepEqual(t, sent(2).encode(), (&paxosMessage{Phase: phasePromise, Instance: 1, Ballot: b, Promised: b}).encode())
+
+	// it proposes the messages it urb-delivered once a majority promised its ballot
+	promise := &paxosMessage{Phase: phasePromise, Instance: 1, Ballot: b, Promised: b}
+	add(promise, Identifier{ID: 1, Seq: 2})
+	add(promise, Identifier{ID: 2, Seq: 2})
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.Equal(t, mod.Seq, 2)
+	add(promise, Identifier{ID: 3, Seq: 1})
+	processAndHandOver(mod)
+	assert.DeepEqual(t, sent(3).Value, []Identifier{{ID: 1, Seq: 1}, {ID: 2, Seq: 1}})
+	assert.Assert(t, sent(3).Previous == nil)
+
+	// and delivers them once a majority accepted them
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.DeepEqual(t, sent(4).encode(), (&paxosMessage{Phase: phaseAccepted, Instance: 1, Ballot: b,
+		Value: []Identifier{{ID: 1, Seq: 1}, {ID: 2, Seq: 1}}}).encode())
+	assert.Equal(t, len(*delivered), 0)
+	accepted := &paxosMessage{Phase: phaseAccepted, Instance: 1, Ballot: b, Value: sent(3).Value}
+	add(accepted, Identifier{ID: 1, Seq: 3})
+	add(accepted, Identifier{ID: 2, Seq: 3})
+	add(accepted, Identifier{ID: 3, Seq: 2})
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.DeepEqual(t, *delivered, []Identifier{{ID: 1, Seq: 1}, {ID: 2, Seq: 1}})
+	assert.Equal(t, mod.HeldBackCount(), 0)
+
+	// the next batch needs no prepare, and its accept carries the batch decided before
+	addRecord(mod, &UrbMessage{Text: "Again"}, Identifier{ID: 2, Seq: 4}, listToMap(mod.P))
+	processAndHandOver(mod)
+	assert.DeepEqual(t, sent(5).encode(), (&paxosMessage{Phase: phaseAccept, Instance: 2, Ballot: b,
+		Value: []Identifier{{ID: 2, Seq: 4}}, Previous: []Identifier{{ID: 1, Seq: 1}, {ID: 2, Seq: 1}},
+		Ordered: map[int]int{1: 1, 2: 1}}).encode())
+}
+
+func TestTotalOrderAdoptsAcceptedBatch(t *testing.T) {
+	mod, r, delivered := bootstrapOrdering(TotalOrdering)
+	add, sent := consensus(mod)
+	old, b := ballot{Round: 1, ID: 1}, ballot{Round: 2, ID: 0}
+
+	// processor 1 coordinated until it crashed, and processor 0 accepted its batch
+	r.TrustedRet = []int{0, 2, 3, 4, 5}
+	addRecord(mod, &UrbMessage{Text: "Hello"}, Identifier{ID: 2, Seq: 1}, listToMap(mod.P))
+	addRecord(mod, &UrbMessage{Text: "World"}, Identifier{ID: 3, Seq: 1}, listToMap(mod.P))
+	add(&paxosMessage{Phase: phaseAccept, Instance: 1, Ballot: old, Value: []Identifier{{ID: 2, Seq: 1}}}, Identifier{ID: 1, Seq: 1})
+	processAndHandOver(mod)
+	assert.Equal(t, sent(1).Phase, phaseAccepted)
+
+	// processor 0 takes over once processor 1 sent nothing for a while
+	for i := 0; i < constants.CoordinatorTimeout; i++ {
+		assert.Assert(t, sent(2) == nil)
+		processAndHandOver(mod)
+	}
+	assert.DeepEqual(t, sent(2).encode(), (&paxosMessage{Phase: phasePrepare, Instance: 1, Ballot: b}).encode())
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.Equal(t, sent(3).Accepted, old)
+
+	// the batch may have been decided, so it is proposed again instead of the messages processor 0 urb-delivered
+	add(&paxosMessage{Phase: phasePromise, Instance: 1, Ballot: b, Promised: b, Accepted: old, Value: []Identifier{{ID: 2, Seq: 1}}}, Identifier{ID: 2, Seq: 2})
+	add(&paxosMessage{Phase: phasePromise, Instance: 1, Ballot: b, Promised: b}, Identifier{ID: 3, Seq: 2})
+	add(&paxosMessage{Phase: phasePromise, Instance: 1, Ballot: b, Promised: b}, Identifier{ID: 4, Seq: 1})
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.Equal(t, sent(4).Ballot, b)
+	assert.DeepEqual(t, sent(4).Value, []Identifier{{ID: 2, Seq: 1}})
+
+	// the batches accepted under lower ballots are not decided, even by a majority
+	accepted := &paxosMessage{Phase: phaseAccepted, Instance: 1, Ballot: old, Value: []Identifier{{ID: 2, Seq: 1}}}
+	add(accepted, Identifier{ID: 1, Seq: 2})
+	add(accepted, Identifier{ID: 2, Seq: 3})
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.Equal(t, len(*delivered), 0)
+	accepted = &paxosMessage{Phase: phaseAccepted, Instance: 1, Ballot: b, Value: []Identifier{{ID: 2, Seq: 1}}}
+	add(accepted, Identifier{ID: 3, Seq: 3})
+	add(accepted, Identifier{ID: 4, Seq: 2})
+	add(accepted, Identifier{ID: 5, Seq: 1})
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.DeepEqual(t, *delivered, []Identifier{{ID: 2, Seq: 1}})
+	assert.DeepEqual(t, sent(6).Value, []Identifier{{ID: 3, Seq: 1}})
+}
+
+func TestTotalOrderKeepsPromises(t *testing.T) {
+	mod, r, _ := bootstrapOrdering(TotalOrdering)
+	r.TrustedRet = mod.P
+	add, sent := consensus(mod)
+	high := ballot{Round: 3, ID: 2}
+	addRecord(mod, &UrbMessage{Text: "Hello"}, Identifier{ID: 2, Seq: 1}, listToMap(mod.P))
+
+	// processor 0 promises the ballot of processor 2 and leaves coordinating to it while it trusts it
+	add(&paxosMessage{Phase: phasePrepare, Instance: 1, Ballot: high}, Identifier{ID: 2, Seq: 2})
+	processAndHandOver(mod)
+	assert.Equal(t, sent(1).Promised, high)
+	assert.Equal(t, mod.Seq, 1)
+
+	// accepts and prepares of lower ballots are refused, a promise reports the higher ballot instead
+	add(&paxosMessage{Phase: phaseAccept, Instance: 1, Ballot: ballot{Round: 2, ID: 1}, Value: []Identifier{{ID: 1, Seq: 1}}}, Identifier{ID: 1, Seq: 1})
+	processAndHandOver(mod)
+	assert.Equal(t, mod.Seq, 1)
+	add(&paxosMessage{Phase: phasePrepare, Instance: 1, Ballot: ballot{Round: 1, ID: 1}}, Identifier{ID: 1, Seq: 2})
+	processAndHandOver(mod)
+	assert.Equal(t, sent(2).Ballot, ballot{Round: 1, ID: 1})
+	assert.Equal(t, sent(2).Promised, high)
+	add(&paxosMessage{Phase: phaseAccept, Instance: 1, Ballot: high, Value: []Identifier{{ID: 2, Seq: 1}}}, Identifier{ID: 2, Seq: 3})
+	processAndHandOver(mod)
+	assert.Equal(t, sent(3).Phase, phaseAccepted)
+	assert.Equal(t, sent(3).Ballot, high)
+
+	// once processor 2 is suspected and sent nothing for a while, processor 0 prepares a higher ballot
+	r.TrustedRet = []int{0, 1, 3, 4, 5}
+	for i := 1; i < constants.CoordinatorTimeout; i++ {
+		processAndHandOver(mod)
+		assert.Equal(t, mod.Seq, 3)
+	}
+	processAndHandOver(mod)
+	assert.DeepEqual(t, sent(4).encode(), (&paxosMessage{Phase: phasePrepare, Instance: 1, Ballot: ballot{Round: 4, ID: 0}}).encode())
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.Equal(t, sent(5).Accepted, high)
+}
+
+func TestTotalOrderCatchesUp(t *testing.T) {
+	mod, r, delivered := bootstrapOrdering(TotalOrdering)
+	r.TrustedRet = mod.P
+	add, sent := consensus(mod)
+	b := ballot{Round: 1, ID: 1}
+
+	// a processor that has not decided any instance skips to the latest one it knows of
+	add(&paxosMessage{Phase: phaseAccept, Instance: 5, Ballot: b, Value: []Identifier{{ID: 2, Seq: 3}},
+		Previous: []Identifier{{ID: 1, Seq: 3}}, Ordered: map[int]int{1: 3, 2: 2}}, Identifier{ID: 1, Seq: 1})
+	addRecord(mod, &UrbMessage{Text: "Before"}, Identifier{ID: 2, Seq: 2}, listToMap(mod.P))
+	addRecord(mod, &UrbMessage{Text: "After"}, Identifier{ID: 2, Seq: 3}, listToMap(mod.P))
+	processAndHandOver(mod)
+	assert.Equal(t, mod.total.instance, 5)
+	assert.DeepEqual(t, mod.total.ordered, map[int]int{1: 3, 2: 2})
+	assert.Equal(t, mod.HeldBackCount(), 1)
+	assert.Equal(t, sent(1).Phase, phaseAccepted)
+
+	// a processor that is one instance behind learns its decision from the accept of the next one
+	add(&paxosMessage{Phase: phaseAccept, Instance: 6, Ballot: b, Value: []Identifier{{ID: 2, Seq: 4}},
+		Previous: []Identifier{{ID: 2, Seq: 3}}, Ordered: map[int]int{1: 3, 2: 3}}, Identifier{ID: 1, Seq: 2})
+	ackAll(mod)
+	processAndHandOver(mod)
+	assert.DeepEqual(t, *delivered, []Identifier{{ID: 2, Seq: 3}})
+	assert.Equal(t, mod.total.instance, 6)
+
+	// other processors only skip once the consensus messages before were given up on
+	add(&paxosMessage{Phase: phaseAccept, Instance: 9, Ballot: b, Ordered: map[int]int{2: 8}}, Identifier{ID: 1, Seq: 4})
+	processAndHandOver(mod)
+	assert.Equal(t, mod.total.instance, 6)
+	mod.RxObsS[1] = 3
+	processAndHandOver(mod)
+	assert.Equal(t, mod.total.instance, 9)
+	assert.Equal(t, mod.total.ordered[2], 8)
+}
+
+func TestTotalOrderWaitsForTransmitWindow(t *testing.T) {
+	mod, r, _ := bootstrapOrdering(TotalOrdering)
+	r.TrustedRet = []int{0, 1, 2}
+	addRecord(mod, &UrbMessage{Text: "Hello"}, Identifier{ID: 2, Seq: 1}, listToMap(mod.P))
+
+	// the transmit window is full, so the prepare has to wait until receivers catch up
+	mod.TxObsS = constMap(mod.P, 0)
+	mod.Seq = constants.BufferUnitSize
+	processAndHandOver(mod)
+	assert.Equal(t, mod.Buffer.Len(), 1)
+	assert.Equal(t, mod.Seq, constants.BufferUnitSize)
+
+	mod.TxObsS = constMap(mod.P, 1)
+	processAndHandOver(mod)
+	assert.Equal(t, mod.Seq, constants.BufferUnitSize+1)
+	assert.Equal(t, mod.Buffer.Get(Identifier{ID: 0, Seq: mod.Seq}).Msg.Headers[HeaderTotalOrderPhase], phasePrepare)
+}
+
+func TestSimulatorTotalOrderUnderReordering(t *testing.T) {
+	run := func(ordering Ordering) *Simulator {
+		sim := NewSimulator(3)
+		sim.SetOrdering(ordering)
+		sim.SetFaults(NewFaultInjector(7, LinkFaults{Reorder: 0.5, Delay: 2 * time.Second}))
+		sim.Run(time.Second)
+		for i := 0; i < 10; i++ {
+			for id := range sim.Nodes {
+				sim.Broadcast(id, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+			}
+			sim.Run(100 * time.Millisecond)
+		}
+		assert.Assert(t, sim.RunUntil(allDelivered(sim, 30), 2*time.Minute))
+		return sim
+	}
+
+	// the faults make processors deliver concurrent messages in different orders unless they are ordered
+	assert.Assert(t, !inTotalOrder(run(NoOrdering), 0, 1, 2))
+	sim := run(TotalOrdering)
+	assert.Assert(t, inTotalOrder(sim, 0, 1, 2))
+	for _, node := range sim.Nodes {
+		assert.Equal(t, len(node.Delivered), 30)
+	}
+}
+
+func TestSimulatorTotalOrderSurvivesCoordinatorCrash(t *testing.T) {
+	sim := NewSimulator(3)
+	sim.SetOrdering(TotalOrdering)
+	sim.SetFaults(NewFaultInjector(7, LinkFaults{Reorder: 0.5, Delay: time.Second}))
+	sim.Run(time.Second)
+	broadcast := func(from int) {
+		for i := 0; i < 5; i++ {
+			for id := from; id < len(sim.Nodes); id++ {
+				sim.Broadcast(id, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+			}
+			sim.Run(100 * time.Millisecond)
+		}
+	}
+
+	// processor 0 coordinates until it crashes, then processor 1 takes over
+	broadcast(0)
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 15), time.Minute))
+	broadcast(0)
+	sim.Crash(0)
+	broadcast(1)
+
+	// the messages processor 0 broadcast right before crashing may be lost, but all others are delivered
+	survivorsDelivered := func() bool {
+		for _, id := range []int{1, 2} {
+			count := 0
+			for _, d := range sim.Nodes[id].Delivered {
+				if d.Identifier.ID != 0 {
+					count++
+				}
+			}
+			if count < 20 {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Assert(t, sim.RunUntil(survivorsDelivered, 2*time.Minute))
+	sim.Run(10 * time.Second)
+	assert.Equal(t, coordinator(sim, 2), 1)
+	assert.Assert(t, inTotalOrder(sim, 1, 2))
+	assert.DeepEqual(t, deliveryOrder(sim, 0), deliveryOrder(sim, 1)[:len(sim.Nodes[0].Delivered)])
+}
+
+func TestSimulatorTotalOrderSurvivesFalseSuspicion(t *testing.T) {
+	sim := NewSimulator(3)
+	sim.SetOrdering(TotalOrdering)
+	sim.SetParams(Params{ThetafdW: 3})
+	faults := NewFaultInjector(7, LinkFaults{Reorder: 0.5, Delay: time.Second})
+	sim.SetFaults(faults)
+	sim.Run(time.Second)
+	broadcast := func(count int) {
+		for i := 0; i < count; i++ {
+			for id := range sim.Nodes {
+				sim.Broadcast(id, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+			}
+			sim.Run(100 * time.Millisecond)
+		}
+	}
+	broadcast(3)
+
+	// processor 1 no longer hears from processor 0 and suspects it, while processor 2 keeps trusting it and relays
+	// its messages, so processor 1 prepares a higher ballot and processor 0 stops coordinating
+	faults.SetLink(Link{From: 0, To: 1}, LinkFaults{Loss: 1})
+	sim.Run(10 * time.Second)
+	assert.Assert(t, !contains(sim.Nodes[1].Thetafd.Trusted(), 0))
+	assert.Assert(t, contains(sim.Nodes[2].Thetafd.Trusted(), 0))
+	broadcast(3)
+	others := func() bool { return len(sim.Nodes[1].Delivered) == 18 && len(sim.Nodes[2].Delivered) == 18 }
+	assert.Assert(t, sim.RunUntil(others, 2*time.Minute))
+	assert.Equal(t, coordinator(sim, 1), 1)
+	assert.Equal(t, coordinator(sim, 2), 1)
+
+	// processor 0 trusts processor 1, so it leaves coordinating to it once the link heals
+	faults.SetLink(Link{From: 0, To: 1}, LinkFaults{})
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 18), 2*time.Minute))
+	assert.Equal(t, coordinator(sim, 0), 1)
+	sim.Run(10 * time.Second)
+	broadcast(3)
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 27), 2*time.Minute))
+	assert.Assert(t, inTotalOrder(sim, 0, 1, 2))
+	for _, node := range sim.Nodes {
+		assert.Equal(t, len(node.Delivered), 27)
+		assert.Equal(t, coordinator(sim, node.ID), 1, "node %d", node.ID)
+	}
+}
+
+func TestSimulatorTotalOrderSurvivesRestart(t *testing.T) {
+	run := func(id int, persist bool) {
+		sim := NewSimulator(3)
+		sim.SetOrdering(TotalOrdering)
+		sim.SetFaults(NewFaultInjector(7, LinkFaults{Reorder: 0.5, Delay: time.Second}))
+		if persist {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			assert.NilError(t, sim.Persist(id, dir))
+		}
+		sim.Run(time.Second)
+		ids := []Identifier{}
+		broadcast := func() {
+			for i := 0; i < 5; i++ {
+				for _, node := range sim.Nodes {
+					sim.Broadcast(node.ID, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+					ids = append(ids, Identifier{ID: node.ID, Seq: node.Urb.Seq})
+				}
+				sim.Run(100 * time.Millisecond)
+			}
+		}
+
+		broadcast()
+		assert.Assert(t, sim.RunUntil(allDelivered(sim, 15), time.Minute))
+		sim.Crash(id)
+		assert.NilError(t, sim.Restart(id))
+		sim.Run(10 * time.Second)
+
+		// the restarted processor catches up with the decisions of the others and delivers in the same order,
+		// without delivering anything twice
+		broadcast()
+		assert.Assert(t, sim.RunUntil(allDelivered(sim, 30), 2*time.Minute), "restarted %d, persisted %t", id, persist)
+		sim.Run(10 * time.Second)
+		assert.Assert(t, inTotalOrder(sim, 0, 1, 2), "restarted %d, persisted %t", id, persist)
+		if persist {
+			assertDeliveredOnce(t, sim, ids)
+		}
+	}
+
+	// with and without its state, both the coordinator and another processor
+	for _, persist := range []bool{true, false} {
+		run(0, persist)
+		run(2, persist)
+	}
+}
+
+func TestSimulatorTotalOrderAfterJoin(t *testing.T) {
+	sim := NewSimulator(4)
+	sim.SetOrdering(TotalOrdering)
+
+	// processor 3 starts out outside of the system while the others order messages
+	assert.NilError(t, sim.Nodes[0].Reconf.Leave(3))
+	sim.Network.Flush()
+	sim.Run(time.Second)
+	for i := 0; i < 3; i++ {
+		for _, id := range []int{0, 1, 2} {
+			sim.Broadcast(id, &UrbMessage{Text: fmt.Sprintf("Before %d", i)})
+		}
+		sim.Run(100 * time.Millisecond)
+	}
+	sim.Run(5 * time.Second)
+
+	// after joining, it catches up with the decisions of the others
+	assert.NilError(t, sim.Nodes[2].Reconf.Join(models.Processor{ID: 3}))
+	sim.Network.Flush()
+	sim.Run(time.Second)
+	for i := 0; i < 3; i++ {
+		for _, node := range sim.Nodes {
+			sim.Broadcast(node.ID, &UrbMessage{Text: fmt.Sprintf("After %d", i)})
+		}
+		sim.Run(100 * time.Millisecond)
+	}
+	joined := func() bool { return len(sim.Nodes[3].Delivered) == 12 }
+	assert.Assert(t, sim.RunUntil(joined, time.Minute))
+	sim.Run(10 * time.Second)
+	for _, id := range []int{0, 1, 2} {
+		assert.Equal(t, len(sim.Nodes[id].Delivered), 21, "node %d", id)
+		assert.DeepEqual(t, deliveryOrder(sim, id)[9:], deliveryOrder(sim, 3))
+	}
+}
+
+func TestSimulatorTotalOrderSurvivesCoordinatorCrashAfterPartialAccept(t *testing.T) {
+	sim := NewSimulator(3)
+	sim.SetOrdering(TotalOrdering)
+	faults := NewFaultInjector(7, LinkFaults{})
+	sim.SetFaults(faults)
+	sim.Run(time.Second)
+	for id := range sim.Nodes {
+		sim.Broadcast(id, &UrbMessage{Text: "Message 0"})
+	}
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 3), time.Minute))
+
+	// everything sent to processor 1 is slow, so processor 2 accepts the next batch of processor 0 before processor 1
+	// does, and processor 0 crashes in between
+	faults.SetLink(Link{From: 0, To: 1}, LinkFaults{Delay: 3 * time.Second})
+	faults.SetLink(Link{From: 2, To: 1}, LinkFaults{Delay: 3 * time.Second})
+	for id := range sim.Nodes {
+		sim.Broadcast(id, &UrbMessage{Text: "Message 1"})
+	}
+	ahead := func() bool {
+		first, second := sim.Nodes[1].Urb.total, sim.Nodes[2].Urb.total
+		return second.accepted != (ballot{}) && (first.instance < second.instance || first.accepted == (ballot{}))
+	}
+	assert.Assert(t, sim.RunUntil(ahead, time.Minute))
+	batch := sim.Nodes[2].Urb.total.value
+	sim.Crash(0)
+
+	// processor 1 takes over and learns the batch from the promise of processor 2, which may have decided it
+	for _, id := range []int{1, 2} {
+		sim.Broadcast(id, &UrbMessage{Text: "Message 2"})
+	}
+	survivors := func() bool { return len(sim.Nodes[1].Delivered) == 8 && len(sim.Nodes[2].Delivered) == 8 }
+	assert.Assert(t, sim.RunUntil(survivors, 2*time.Minute))
+	assert.Equal(t, coordinator(sim, 1), 1)
+	assert.Equal(t, coordinator(sim, 2), 1)
+	assert.Assert(t, inTotalOrder(sim, 1, 2))
+	assert.DeepEqual(t, deliveryOrder(sim, 0), deliveryOrder(sim, 1)[:len(sim.Nodes[0].Delivered)])
+	assert.Assert(t, strings.Contains(fmt.Sprint(deliveryOrder(sim, 1)), strings.Trim(fmt.Sprint(batch), "[]")))
+}
+
+func TestSimulatorTotalOrderSurvivesPartition(t *testing.T) {
+	sim := NewSimulator(5)
+	sim.SetOrdering(TotalOrdering)
+	sim.SetParams(Params{ThetafdW: 3})
+	faults := NewFaultInjector(7, LinkFaults{})
+	sim.SetFaults(faults)
+	sim.Run(time.Second)
+	for id := range sim.Nodes {
+		sim.Broadcast(id, &UrbMessage{Text: "Message 0"})
+	}
+	assert.Assert(t, sim.RunUntil(allDelivered(sim, 5), time.Minute))
+
+	// processors 0 and 1 are cut off from the others and only trust each other. Processor 0 keeps coordinating, but
+	// its batches are never accepted by a majority, while processor 2 prepares a higher ballot with processors 3 and 4
+	minority, majority := []int{0, 1}, []int{2, 3, 4}
+	partition := func(link LinkFaults) {
+		for _, i := range minority {
+			for _, j := range majority {
+				faults.SetLink(Link{From: i, To: j}, link)
+				faults.SetLink(Link{From: j, To: i}, link)
+			}
+		}
+	}
+	partition(LinkFaults{Loss: 1})
+	sim.Run(10 * time.Second)
+	assert.DeepEqual(t, sim.Nodes[0].Thetafd.Trusted(), minority)
+	assert.DeepEqual(t, sim.Nodes[2].Thetafd.Trusted(), majority)
+	for id := range sim.Nodes {
+		sim.Broadcast(id, &UrbMessage{Text: "Message 1"})
+	}
+	delivered := func() bool {
+		for _, id := range majority {
+			if len(sim.Nodes[id].Delivered) != 8 {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Assert(t, sim.RunUntil(delivered, time.Minute))
+	sim.Run(10 * time.Second)
+	for _, id := range minority {
+		assert.Equal(t, len(sim.Nodes[id].Delivered), 5, "node %d", id)
+	}
+
+	// the messages the minority broadcast meanwhile are urb-delivered by the minority only, so they are never put in
+	// order. Once the partition heals, the minority skips to the instances decided by the majority and all processors
+	// deliver the messages broadcast afterwards in the same order
+	partition(LinkFaults{})
+	sim.Run(10 * time.Second)
+	for id := range sim.Nodes {
+		sim.Broadcast(id, &UrbMessage{Text: "Message 2"})
+	}
+	healed := func() bool {
+		for id, node := range sim.Nodes {
+			if len(node.Delivered) != map[bool]int{true: 10, false: 13}[id < 2] {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Assert(t, sim.RunUntil(healed, 2*time.Minute))
+	sim.Run(10 * time.Second)
+	assert.Assert(t, inTotalOrder(sim, 0, 1))
+	assert.Assert(t, inTotalOrder(sim, 2, 3, 4))
+	minorityDelivered := map[Identifier]bool{}
+	for _, id := range deliveryOrder(sim, 0) {
+		minorityDelivered[id] = true
+	}
+	common := []Identifier{}
+	for _, id := range deliveryOrder(sim, 2) {
+		if minorityDelivered[id] {
+			common = append(common, id)
+		}
+	}
+	assert.DeepEqual(t, deliveryOrder(sim, 0), common)
+	for id := range sim.Nodes {
+		assert.Equal(t, coordinator(sim, id), 2, "node %d", id)
+	}
+}
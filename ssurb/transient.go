@@ -0,0 +1,253 @@
+package ssurb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// TransientFault is a kind of corruption of the state of a running processor
+type TransientFault string
+
+const (
+	// CorruptSeq sets the sequence number of the urb module to an arbitrary value
+	CorruptSeq TransientFault = "seq"
+	// CorruptRxObsS sets the receiver-side obsolete counters to arbitrary values
+	CorruptRxObsS TransientFault = "rxObsS"
+	// CorruptTxObsS sets the sender-side obsolete counters to arbitrary values
+	CorruptTxObsS TransientFault = "txObsS"
+	// DuplicateRecord adds a record to the buffer whose identifier is already buffered
+	DuplicateRecord TransientFault = "duplicateRecord"
+	// NilMessageRecord adds a record without message to the buffer
+	NilMessageRecord TransientFault = "nilMessageRecord"
+	// CorruptPrevHB sets the sampled hb failure detector values of all records to arbitrary values
+	CorruptPrevHB TransientFault = "prevHB"
+	// ScrambleVector sets the counters of the theta failure detector to arbitrary values, including negative ones and
+	// ones above the threshold for processors that are alive
+	ScrambleVector TransientFault = "vector"
+)
+
+// TransientFaults holds all kinds of transient faults that can be injected
+var TransientFaults = []TransientFault{
+	CorruptSeq, CorruptRxObsS, CorruptTxObsS, DuplicateRecord, NilMessageRecord, CorruptPrevHB, ScrambleVector,
+}
+
+type transientMetrics struct {
+	InjectedCount         *prometheus.CounterVec
+	ConvergenceIterations prometheus.Gauge
+}
+
+var sharedTransientMetrics = &transientMetrics{
+	InjectedCount: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "transient_fault_injected_count",
+		Help: "The amount of transient faults injected into the state of this processor",
+	}, []string{"fault_type"}),
+	ConvergenceIterations: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "transient_fault_convergence_iterations",
+		Help: "The number of urb iterations it took to get back to a legal state after the last injection",
+	}),
+}
+
+// InjectTransientFaults corrupts the live state of the modules according to faults, picking arbitrary values from rng.
+// Nothing is corrupted if any of the faults is unknown
+func (r *Resolver) InjectTransientFaults(rng *rand.Rand, faults ...TransientFault) error {
+	for _, f := range faults {
+		if !containsFault(TransientFaults, f) {
+			return fmt.Errorf("Unknown transient fault %q", f)
+		}
+	}
+
+	urbModule := r.GetUrbModule()
+	thetafdModule := r.Modules[THETAFD].(*ThetafdModule)
+	for _, f := range faults {
+		if f == ScrambleVector {
+			thetafdModule.corrupt(rng)
+		} else {
+			urbModule.corrupt(rng, f)
+		}
+
+		log.Printf("injected transient fault %s", f)
+		sharedTransientMetrics.InjectedCount.WithLabelValues(string(f)).Inc()
+	}
+
+	return nil
+}
+
+// Legal returns true if the state of all modules is legal, i.e. no recovery action is pending
+func (r *Resolver) Legal() bool {
+	urbModule := r.GetUrbModule()
+	thetafdModule := r.Modules[THETAFD].(*ThetafdModule)
+
+	urbModule.mux.Lock()
+	defer urbModule.mux.Unlock()
+
+	return urbModule.legal() && thetafdModule.legal()
+}
+
+// MeasureConvergence polls the state of a running processor after every urb iteration until it is legal. Returns the
+// number of iterations it took, or false if not converged within maxIterations or before ctx is cancelled
+func (r *Resolver) MeasureConvergence(ctx context.Context, maxIterations int) (int, bool) {
+	start := r.GetUrbModule().IterationCount()
+
+	for !r.Legal() {
+		iterations := r.GetUrbModule().IterationCount() - start
+		if iterations >= maxIterations {
+			log.Printf("state not legal after %d iterations", iterations)
+			return iterations, false
+		}
+
+		select {
+		case <-ctx.Done():
+			return iterations, false
+		case <-time.After(r.GetUrbModule().Params.moduleRunSleepDuration() / 5):
+		}
+	}
+
+	iterations := r.GetUrbModule().IterationCount() - start
+	log.Printf("state legal after %d iterations", iterations)
+	sharedTransientMetrics.ConvergenceIterations.Set(float64(iterations))
+	return iterations, true
+}
+
+// corrupt injects a transient fault into the state of the urb module
+func (m *UrbModule) corrupt(rng *rand.Rand, f TransientFault) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	switch f {
+	case CorruptSeq:
+		m.Seq = m.arbitrary(rng)
+	case CorruptRxObsS:
+		for k := range m.RxObsS {
+			m.RxObsS[k] = m.arbitrary(rng)
+		}
+	case CorruptTxObsS:
+		for k := range m.TxObsS {
+			m.TxObsS[k] = m.arbitrary(rng)
+		}
+	case DuplicateRecord:
+		var r BufferRecord
+		if records := m.Buffer.Records(); len(records) > 0 {
+			r = *records[rng.Intn(len(records))]
+		} else {
+			r = BufferRecord{Msg: &UrbMessage{}, Identifier: m.arbitraryIdentifier(rng), RecBy: map[int]bool{}, PrevHB: m.arbitraryHB(rng)}
+			m.Buffer.Add(&r)
+		}
+		m.Buffer.Add(&r)
+	case NilMessageRecord:
+		m.Buffer.Add(&BufferRecord{Msg: nil, Identifier: m.arbitraryIdentifier(rng), RecBy: map[int]bool{}, PrevHB: m.arbitraryHB(rng)})
+	case CorruptPrevHB:
+		for _, r := range m.Buffer.Records() {
+			r.PrevHB = m.arbitraryHB(rng)
+		}
+	}
+}
+
+// legal returns true if none of the recovery paths of the do forever loop would have to act, the caller must hold the lock
+func (m *UrbModule) legal() bool {
+	hb := m.Resolver.Hb()
+	identifiers := map[Identifier]bool{}
+	seqs := map[int]bool{}
+
+	// lines 18-19, no records without message or with the same identifier
+	for _, r := range m.Buffer.Records() {
+		if r.Msg == nil || identifiers[r.Identifier] {
+			return false
+		}
+		identifiers[r.Identifier] = true
+		if r.Identifier.ID == m.ID {
+			seqs[r.Identifier.Seq] = true
+		}
+
+		// prevHB must be a sample of the hb failure detector
+		for _, k := range m.P {
+			if x, exists := r.PrevHB[k]; !exists || x > hb[k] {
+				return false
+			}
+		}
+	}
+
+	// line 20, seq is within the transmit window and all its messages are buffered
+	mS := m.minTxObsS()
+	if m.Seq < mS || m.Seq > mS+m.Params.bufferUnitSize() {
+		return false
+	}
+	for s := mS + 1; s <= m.Seq; s++ {
+		if !seqs[s] {
+			return false
+		}
+	}
+
+	// line 21, the receiving window of every sender is not larger than bufferUnitSize
+	for _, k := range m.P {
+		if m.RxObsS[k] < m.maxSeq(k)-m.Params.bufferUnitSize() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// arbitraryIdentifier returns an identifier of an arbitrary processor and sequence number
+func (m *UrbModule) arbitraryIdentifier(rng *rand.Rand) Identifier {
+	return Identifier{ID: m.P[rng.Intn(len(m.P))], Seq: m.arbitrary(rng)}
+}
+
+// arbitraryHB returns arbitrary hb failure detector values
+func (m *UrbModule) arbitraryHB(rng *rand.Rand) map[int]int {
+	hb := map[int]int{}
+	for _, k := range m.P {
+		hb[k] = m.arbitrary(rng)
+	}
+	return hb
+}
+
+// corrupt scrambles the counters of the theta failure detector
+func (m *ThetafdModule) corrupt(rng *rand.Rand) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	w := m.Params.thetafdW()
+	for _, id := range m.P {
+		m.Vector[id] = rng.Intn(4*w) - w
+	}
+}
+
+// legal returns true if the counters of the theta failure detector are ones its heartbeats can lead to, i.e. none is
+// negative and the counter of this processor is zero, so that it trusts itself. Whether the counters of the processors
+// that are alive stay below the threshold can only be told with knowledge of the others, see Simulator.Legal
+func (m *ThetafdModule) legal() bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.Vector[m.ID] != 0 {
+		return false
+	}
+	for _, x := range m.Vector {
+		if x < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// arbitrary returns an arbitrary value of a counter, which may be far outside of what is legal for the buffer unit size
+// of the module
+func (m *UrbModule) arbitrary(rng *rand.Rand) int {
+	unit := m.Params.bufferUnitSize()
+	return rng.Intn(10*unit) - unit
+}
+
+func containsFault(s []TransientFault, f TransientFault) bool {
+	for _, x := range s {
+		if x == f {
+			return true
+		}
+	}
+	return false
+}
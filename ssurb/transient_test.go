@@ -0,0 +1,100 @@
+package ssurb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+	"gotest.tools/assert"
+)
+
+func TestInjectUnknownTransientFault(t *testing.T) {
+	sim := NewSimulator(3)
+	err := sim.InjectTransientFaults(0, 1, CorruptSeq, TransientFault("foo"))
+	assert.Error(t, err, "Unknown transient fault \"foo\"")
+}
+
+func TestTransientFaultsFollowParams(t *testing.T) {
+	sim := NewSimulator(3)
+	sim.SetParams(Params{BufferUnitSize: 2})
+
+	// corrupted counters range around the buffer unit size of the node instead of the default one
+	for seed := int64(0); seed < 20; seed++ {
+		assert.NilError(t, sim.InjectTransientFaults(0, seed, CorruptSeq, CorruptRxObsS))
+		urb := sim.Nodes[0].Urb
+		assert.Assert(t, urb.Seq >= -2 && urb.Seq < 18, "seq %d", urb.Seq)
+		for k, rx := range urb.RxObsS {
+			assert.Assert(t, rx >= -2 && rx < 18, "rxObsS[%d] %d", k, rx)
+		}
+	}
+}
+
+func TestLegalState(t *testing.T) {
+	sim := NewSimulator(3)
+
+	// the initial state is not legal until the first iteration has set up the transmit window
+	assert.Assert(t, !sim.Nodes[0].Resolver.Legal())
+	sim.Run(time.Second)
+	assert.Assert(t, sim.Nodes[0].Resolver.Legal())
+	assert.Assert(t, sim.Legal())
+
+	// a receiver that made messages obsolete that were never broadcast is inconsistent with the sender
+	sim.Nodes[1].Urb.RxObsS[0] = 5
+	assert.Assert(t, sim.Nodes[1].Resolver.Legal())
+	assert.Assert(t, !sim.Legal())
+
+	// a record without message is illegal
+	sim.Nodes[0].Urb.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 1, Seq: 1}, PrevHB: map[int]int{0: 0, 1: 0, 2: 0}})
+	assert.Assert(t, !sim.Nodes[0].Resolver.Legal())
+
+	// a theta failure detector suspecting a processor that is alive is inconsistent with it
+	sim = NewSimulator(3)
+	sim.Run(time.Second)
+	sim.Nodes[2].Thetafd.Vector[0] = constants.ThetafdW
+	assert.Assert(t, sim.Nodes[2].Resolver.Legal())
+	assert.Assert(t, !sim.Legal())
+	sim.Crash(0)
+	assert.Assert(t, sim.Legal())
+
+	// and one not trusting itself or holding negative counters is illegal
+	sim.Nodes[2].Thetafd.Vector[2] = 1
+	assert.Assert(t, !sim.Nodes[2].Resolver.Legal())
+	sim.Nodes[2].Thetafd.Vector[2] = 0
+	sim.Nodes[2].Thetafd.Vector[1] = -1
+	assert.Assert(t, !sim.Nodes[2].Resolver.Legal())
+}
+
+func TestConvergenceAfterTransientFaults(t *testing.T) {
+	// inject every kind of fault on its own as well as all of them at once
+	cases := [][]TransientFault{TransientFaults}
+	for _, f := range TransientFaults {
+		cases = append(cases, []TransientFault{f})
+	}
+
+	for _, f := range cases {
+		sim := NewSimulator(3)
+		sim.Run(time.Second)
+		for i := 0; i < 5; i++ {
+			sim.Broadcast(i%3, &UrbMessage{Text: fmt.Sprintf("Message %d", i)})
+		}
+		sim.Run(constants.ModuleRunSleepDuration)
+
+		for _, node := range sim.Nodes {
+			assert.NilError(t, sim.InjectTransientFaults(node.ID, int64(node.ID), f...))
+		}
+		assert.Assert(t, !sim.Legal(), "legal after %s", f)
+
+		// every fault should be recovered from within a bounded number of iterations
+		iterations, converged := sim.IterationsUntilLegal(100)
+		assert.Assert(t, converged, "did not converge after %s, %d iterations", f, iterations)
+
+		// and the system should keep delivering new messages afterwards
+		before := len(sim.Nodes[2].Delivered)
+		sim.Broadcast(0, &UrbMessage{Text: "After fault"})
+		delivered := func() bool {
+			return len(sim.Nodes[2].Delivered) > before
+		}
+		assert.Assert(t, sim.RunUntil(delivered, time.Minute), "no delivery after %s", f)
+	}
+}
@@ -0,0 +1,113 @@
+package ssurb
+
+import (
+	"log"
+	"sync"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+// Transport is used by the modules to send messages to other processors
+type Transport interface {
+	Send(receiverID int, msg *models.Message)
+}
+
+// envelope is a packed message queued on a MemoryNetwork
+type envelope struct {
+	senderID   int
+	receiverID int
+	payload    []byte
+}
+
+// MemoryNetwork routes messages between resolvers living in the same process. Sent messages are queued and only
+// dispatched when Flush is called, which makes the message exchange deterministic
+type MemoryNetwork struct {
+	mux       sync.Mutex
+	resolvers map[int]IResolver
+	queue     []envelope
+}
+
+// NewMemoryNetwork returns an empty network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{resolvers: map[int]IResolver{}}
+}
+
+// Attach connects the resolver of processor id to the network and returns the transport it should send through
+func (n *MemoryNetwork) Attach(id int, r IResolver) Transport {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.resolvers[id] = r
+	return &memoryTransport{network: n, senderID: id}
+}
+
+// Detach disconnects processor id from the network, messages to it are dropped from now on
+func (n *MemoryNetwork) Detach(id int) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	delete(n.resolvers, id)
+}
+
+// Pending returns the number of queued messages
+func (n *MemoryNetwork) Pending() int {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	return len(n.queue)
+}
+
+// Flush dispatches all queued messages in the order they were sent, including messages sent while flushing.
+// Returns the number of dispatched messages
+func (n *MemoryNetwork) Flush() int {
+	count := 0
+	for {
+		n.mux.Lock()
+		if len(n.queue) == 0 {
+			n.mux.Unlock()
+			return count
+		}
+		e := n.queue[0]
+		n.queue = n.queue[1:]
+		r, exists := n.resolvers[e.receiverID]
+		n.mux.Unlock()
+
+		if !exists {
+			continue
+		}
+
+		msg, err := helpers.Unpack(e.payload)
+		if err != nil {
+			log.Printf("Could not unpack message from %d to %d. Got error: %v\n", e.senderID, e.receiverID, err)
+			continue
+		}
+		r.Dispatch(msg)
+		count++
+	}
+}
+
+// enqueue adds a packed message to the queue
+func (n *MemoryNetwork) enqueue(e envelope) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.queue = append(n.queue, e)
+}
+
+// memoryTransport is the transport of one processor attached to a MemoryNetwork
+type memoryTransport struct {
+	network  *MemoryNetwork
+	senderID int
+}
+
+// Send packs msg, just like it would be before being sent over the wire, and queues it on the network
+func (t *memoryTransport) Send(receiverID int, msg *models.Message) {
+	payload, err := helpers.Pack(msg)
+	if err != nil {
+		log.Printf("Could not pack message %v. Got error: %v\n", msg, err)
+		return
+	}
+
+	t.network.enqueue(envelope{senderID: t.senderID, receiverID: receiverID, payload: payload})
+}
@@ -1,15 +1,20 @@
 package ssurb
 
 import (
+	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
 
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
@@ -19,16 +24,25 @@ type clientMetrics struct {
 	ConnError      string
 	PackError      string
 	WriteError     string
+	OversizeError  string
+	EncryptError   string
+	ResolveError   string
+	QueueFullError string
 	FatalSendError string
 
-	ErrorCount *prometheus.CounterVec
-	MsgCount   *prometheus.CounterVec
+	ErrorCount    *prometheus.CounterVec
+	MsgCount      *prometheus.CounterVec
+	DatagramCount *prometheus.CounterVec
 }
 
 var metrics = &clientMetrics{
 	ConnError:      "conn_error",
 	PackError:      "pack_error",
 	WriteError:     "write_error",
+	OversizeError:  "oversize_error",
+	EncryptError:   "encrypt_error",
+	ResolveError:   "resolve_error",
+	QueueFullError: "queue_full_error",
 	FatalSendError: "fatal_send_error",
 
 	ErrorCount: promauto.NewCounterVec(prometheus.CounterOpts{
@@ -39,61 +53,342 @@ var metrics = &clientMetrics{
 		Name: "udp_client_msg_count",
 		Help: "The amount messages sent by this client",
 	}, []string{"receiver_id"}),
+	DatagramCount: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "udp_client_datagram_count",
+		Help: "The amount of datagrams sent by this client, each holding one or more messages or a fragment of one",
+	}, []string{"receiver_id"}),
+}
+
+// fragmentID is the id of the last fragmented message, starting at an arbitrary value so that ids are not reused
+// right after a restart. Only access it atomically
+var fragmentID = rand.New(rand.NewSource(time.Now().UnixNano())).Uint64()
+
+// UDPTransport sends messages to other processors over UDP through one long-lived socket. Messages are queued per
+// receiver and sent in order by one goroutine per receiver, so that a slow or unreachable receiver does not hold up
+// the others. Messages queued for the same receiver close together, such as the gossip, data messages and acks of one
+// urb iteration, are batched into as few datagrams as fit the buffer of the server. The socket and the goroutines
+// are started on demand and stopped by Close
+type UDPTransport struct {
+	// Processors holds the addresses of all processors that messages can be sent to, guarded by mux
+	Processors []models.Processor
+	// QueueSize bounds the number of messages waiting to be sent to each receiver, further messages are dropped.
+	// Defaults to constants.SendQueueSize
+	QueueSize int
+	// BatchDelay is how long messages are collected before being sent in a batch. Defaults to constants.BatchDelay
+	BatchDelay time.Duration
+	// Auth optionally signs all datagrams, it is kept up to date with the processors
+	Auth *Authenticator
+	// Keyring optionally encrypts all datagrams, after they are signed
+	Keyring *Keyring
+
+	// mux guards Processors, conn and queues
+	mux    sync.Mutex
+	conn   *net.UDPConn
+	queues map[int]chan *models.Message
+
+	// workers keeps track of the goroutines draining the queues
+	workers sync.WaitGroup
+	// inflight keeps track of messages being sent, so that they can be drained on shutdown
+	inflight sync.WaitGroup
+}
+
+// Send queues msg to be sent to the processor with id receiverID, dropping it if the queue of the receiver is full
+func (t *UDPTransport) Send(receiverID int, msg *models.Message) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	queue, exists := t.queues[receiverID]
+	if !exists {
+		if t.queues == nil {
+			t.queues = map[int]chan *models.Message{}
+		}
+		size := t.QueueSize
+		if size <= 0 {
+			size = constants.SendQueueSize
+		}
+		queue = make(chan *models.Message, size)
+		t.queues[receiverID] = queue
+
+		t.workers.Add(1)
+		go t.work(receiverID, queue)
+	}
+
+	t.inflight.Add(1)
+	select {
+	case queue <- msg:
+	default:
+		t.inflight.Done()
+		metrics.ErrorCount.WithLabelValues(metrics.QueueFullError, strconv.Itoa(receiverID)).Inc()
+	}
+}
+
+// work sends all messages of the queue of receiverID until it is closed
+func (t *UDPTransport) work(receiverID int, queue chan *models.Message) {
+	defer t.workers.Done()
+
+	for msg := range queue {
+		msgs := t.collect(queue, msg)
+		t.SendToProcessor(receiverID, msgs...)
+		for range msgs {
+			t.inflight.Done()
+		}
+	}
+}
+
+// collect returns msg together with the messages added to queue within the batch delay, bounded by its capacity
+func (t *UDPTransport) collect(queue chan *models.Message, msg *models.Message) []*models.Message {
+	delay := t.BatchDelay
+	if delay <= 0 {
+		delay = constants.BatchDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	msgs := []*models.Message{msg}
+	for len(msgs) < cap(queue) {
+		select {
+		case next, ok := <-queue:
+			if !ok {
+				return msgs
+			}
+			msgs = append(msgs, next)
+		case <-timer.C:
+			return msgs
+		}
+	}
+	return msgs
+}
+
+// Close sends all queued messages, then stops all goroutines and closes the socket. The transport can still be used
+// afterwards, which starts them again
+func (t *UDPTransport) Close() {
+	t.mux.Lock()
+	for _, queue := range t.queues {
+		close(queue)
+	}
+	t.queues = nil
+	t.mux.Unlock()
+
+	t.workers.Wait()
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// socket returns the socket used for sending, opening it if needed. It is not bound to any address, so that messages
+// can be sent to both IPv4 and IPv6 addresses
+func (t *UDPTransport) socket() (*net.UDPConn, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.conn == nil {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+	return t.conn, nil
+}
+
+// SetProcessors replaces the addresses of the processors that messages can be sent to
+func (t *UDPTransport) SetProcessors(processors []models.Processor) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.Processors = processors
+	if t.Auth != nil {
+		if err := t.Auth.SetProcessors(processors); err != nil {
+			log.Printf("Messages from some processors will be rejected: %v", err)
+		}
+	}
 }
 
-// SendToProcessor is a wrapper around send, intended to be called from modules
-func SendToProcessor(receiverID int, msg *models.Message) {
-	// don't send messages during unit testing
-	if helpers.IsUnitTesting() {
+// Drain blocks until all queued messages have been sent
+func (t *UDPTransport) Drain() {
+	t.inflight.Wait()
+}
+
+// SendToProcessor is a wrapper around write that batches msgs into datagrams and retries on failure, blocking until
+// all of them are sent or dropped
+func (t *UDPTransport) SendToProcessor(receiverID int, msgs ...*models.Message) {
+	p, exists := t.processor(receiverID)
+	if !exists {
+		log.Printf("Fatal error when sending %d messages to %d, no such processor", len(msgs), receiverID)
+		metrics.ErrorCount.WithLabelValues(metrics.FatalSendError, strconv.Itoa(receiverID)).Inc()
 		return
 	}
 
-	addr := net.UDPAddr{IP: helpers.Processors[receiverID].IP, Port: 4000 + receiverID}
+	// signatures and encryption must fit in the buffer of the server as well
+	size := constants.ServerBufferSize
+	if t.Auth != nil {
+		size -= helpers.SignatureOverhead
+	}
+	if t.Keyring != nil {
+		size -= helpers.EncryptionOverhead
+	}
+	datagrams, count := encode(msgs, receiverID, size)
+	if t.Auth != nil {
+		for i := range datagrams {
+			datagrams[i] = t.Auth.Sign(datagrams[i])
+		}
+	}
+	if t.Keyring != nil {
+		datagrams = t.encrypt(datagrams, receiverID)
+	}
+	if len(datagrams) == 0 {
+		return
+	}
 
-	// try for a maximum of ten times to send packet
+	// try for a maximum of ten times to send all datagrams
 	tries := 0
-	sent := false
-	for !sent && tries < 10 {
+	for len(datagrams) > 0 && tries < 10 {
 		tries++
-		err := send(&addr, msg, receiverID)
+		conn, err := t.socket()
 		if err != nil {
-			log.Printf("Got error when sending %v to %d: %v, retrying..", msg, receiverID, err)
-			time.Sleep(time.Millisecond * 10)
+			metrics.ErrorCount.WithLabelValues(metrics.ConnError, strconv.Itoa(receiverID)).Inc()
+		} else if p.IP == nil {
+			err = fmt.Errorf("Address of %s is not resolved", p.Hostname)
 		} else {
-			metrics.MsgCount.WithLabelValues(strconv.Itoa(receiverID)).Inc()
-			sent = true
+			var n int
+			n, err = write(conn, &net.UDPAddr{IP: p.IP, Port: p.GetUDPPort()}, datagrams, receiverID)
+			datagrams = datagrams[n:]
+		}
+		if err != nil {
+			log.Printf("Got error when sending %d messages to %d: %v, retrying..", count, receiverID, err)
+
+			// the address of a processor given by hostname may have changed
+			if p.IPString == "" {
+				p = t.resolve(p)
+			}
+			time.Sleep(time.Millisecond * 10)
 		}
 	}
 
-	if !sent {
-		log.Printf("Fatal error when sending %v to %d, not re-trying..", msg, receiverID)
+	if len(datagrams) > 0 {
+		log.Printf("Fatal error when sending %d messages to %d, not re-trying..", count, receiverID)
 		metrics.ErrorCount.WithLabelValues(metrics.FatalSendError, strconv.Itoa(receiverID)).Inc()
+	} else {
+		metrics.MsgCount.WithLabelValues(strconv.Itoa(receiverID)).Add(float64(count))
 	}
 }
 
-// Send is used to send payload over UDP to a destIP:destPort
-func send(addr *net.UDPAddr, msg *models.Message, receiverID int) error {
-	// construct connection to server
-	conn, err := net.DialUDP("udp", nil, addr)
+// encrypt encrypts datagrams, dropping the ones that could not be encrypted
+func (t *UDPTransport) encrypt(datagrams [][]byte, receiverID int) [][]byte {
+	encrypted := [][]byte{}
+	for _, datagram := range datagrams {
+		e, err := t.Keyring.Encrypt(datagram)
+		if err != nil {
+			log.Printf("Could not encrypt datagram to %d: %v", receiverID, err)
+			metrics.ErrorCount.WithLabelValues(metrics.EncryptError, strconv.Itoa(receiverID)).Inc()
+			continue
+		}
+		encrypted = append(encrypted, e)
+	}
+	return encrypted
+}
+
+// processor returns the processor with id
+func (t *UDPTransport) processor(id int) (models.Processor, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for _, p := range t.Processors {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return models.Processor{}, false
+}
+
+// resolve looks up the address of p by its hostname again, and returns p with the new address
+func (t *UDPTransport) resolve(p models.Processor) models.Processor {
+	ip, err := helpers.ResolveHostname(p.Hostname)
 	if err != nil {
-		metrics.ErrorCount.WithLabelValues(metrics.ConnError, strconv.Itoa(receiverID)).Inc()
-		return err
+		log.Printf("Could not resolve %s of processor %d: %v", p.Hostname, p.ID, err)
+		metrics.ErrorCount.WithLabelValues(metrics.ResolveError, strconv.Itoa(p.ID)).Inc()
+		return p
 	}
+	p.IP = ip
 
-	// prepare payload
+	// processors may be shared with others, so it is copied before being updated
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	processors := append([]models.Processor{}, t.Processors...)
+	for i := range processors {
+		if processors[i].ID == p.ID && processors[i].IPString == "" {
+			processors[i].IP = ip
+		}
+	}
+	t.Processors = processors
+	return p
+}
+
+// encode packs msgs and batches them into datagrams of at most size bytes, fragmenting messages that are too large to
+// fit on their own. Messages that cannot be packed are dropped, the number of messages left is returned along with the
+// datagrams
+func encode(msgs []*models.Message, receiverID int, size int) ([][]byte, int) {
+	payloads := [][]byte{}
+	fragments := [][]byte{}
+	count := 0
+	for _, msg := range msgs {
+		payload, err := pack(msg, receiverID)
+		if err != nil {
+			log.Printf("Dropping %v: %v", msg, err)
+			continue
+		} else if len(payload) <= size {
+			payloads = append(payloads, payload)
+		} else if datagrams, err := fragment(payload, receiverID, size); err != nil {
+			log.Printf("Dropping %v: %v", msg, err)
+			continue
+		} else {
+			fragments = append(fragments, datagrams...)
+		}
+		count++
+	}
+
+	return append(helpers.Batch(payloads, size), fragments...), count
+}
+
+// pack packs msg, failing if it exceeds the max message size
+func pack(msg *models.Message, receiverID int) ([]byte, error) {
 	payload, err := helpers.Pack(msg)
 	if err != nil {
 		metrics.ErrorCount.WithLabelValues(metrics.PackError, strconv.Itoa(receiverID)).Inc()
-		return err
+		return nil, err
+	} else if len(payload) > constants.MaxMessageSize {
+		metrics.ErrorCount.WithLabelValues(metrics.OversizeError, strconv.Itoa(receiverID)).Inc()
+		return nil, fmt.Errorf("Message of size %d exceeds max size of %d bytes", len(payload), constants.MaxMessageSize)
+	}
+	return payload, nil
+}
+
+// fragment splits payload into fragments of at most size bytes if it is larger
+func fragment(payload []byte, receiverID int, size int) ([][]byte, error) {
+	if len(payload) <= size {
+		return [][]byte{payload}, nil
 	}
 
-	// write payload over socket
-	_, err = conn.Write(payload)
+	fragments, err := helpers.Fragment(payload, atomic.AddUint64(&fragmentID, 1), size)
 	if err != nil {
-		metrics.ErrorCount.WithLabelValues(metrics.WriteError, strconv.Itoa(receiverID)).Inc()
-		return err
+		metrics.ErrorCount.WithLabelValues(metrics.PackError, strconv.Itoa(receiverID)).Inc()
+		return nil, err
 	}
-	conn.Close()
+	return fragments, nil
+}
 
-	return nil
+// write writes datagrams over conn to addr in order, returning the number of datagrams written
+func write(conn *net.UDPConn, addr *net.UDPAddr, datagrams [][]byte, receiverID int) (int, error) {
+	for i, datagram := range datagrams {
+		if _, err := conn.WriteToUDP(datagram, addr); err != nil {
+			metrics.ErrorCount.WithLabelValues(metrics.WriteError, strconv.Itoa(receiverID)).Inc()
+			return i, err
+		}
+		metrics.DatagramCount.WithLabelValues(strconv.Itoa(receiverID)).Inc()
+	}
+	return len(datagrams), nil
 }
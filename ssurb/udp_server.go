@@ -1,55 +1,104 @@
 package ssurb
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
 )
 
 type serverMetrics struct {
 	ListenError   string
 	ReadError     string
 	OversizeError string
+	FragmentError string
+	BatchError    string
 	UnpackError   string
 
-	ErrorCount *prometheus.CounterVec
-	MsgCount   *prometheus.CounterVec
+	UnencryptedRejection    string
+	UnknownKeyRejection     string
+	DecryptRejection        string
+	UnsignedRejection       string
+	UnknownSignerRejection  string
+	BadSignatureRejection   string
+	ReplayedRejection       string
+	SenderMismatchRejection string
+
+	ErrorCount    *prometheus.CounterVec
+	MsgCount      *prometheus.CounterVec
+	RejectedCount *prometheus.CounterVec
+}
+
+var sharedServerMetrics = &serverMetrics{
+	ListenError:   "listen_error",
+	ReadError:     "read_error",
+	OversizeError: "oversize_error",
+	FragmentError: "fragment_error",
+	BatchError:    "batch_error",
+	UnpackError:   "unpack_error",
+
+	UnencryptedRejection:    "unencrypted",
+	UnknownKeyRejection:     "unknown_key",
+	DecryptRejection:        "decrypt_failed",
+	UnsignedRejection:       "unsigned",
+	UnknownSignerRejection:  "unknown_signer",
+	BadSignatureRejection:   "bad_signature",
+	ReplayedRejection:       "replayed",
+	SenderMismatchRejection: "sender_mismatch",
+
+	ErrorCount: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "udp_server_error_count",
+		Help: "The amount of errors emitted by the udp server",
+	}, []string{"error_type"}),
+	MsgCount: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "udp_server_msg_count",
+		Help: "The amount messages received by this server",
+	}, []string{"sender_id"}),
+	RejectedCount: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "udp_server_rejected_count",
+		Help: "The amount of packets rejected by this server since they could not be decrypted or authenticated",
+	}, []string{"reason"}),
 }
 
 // Server models a server that listens on IP:Port for UDP packets
 type Server struct {
+	ID       int
 	Port     int
 	IP       net.IP
 	Resolver IResolver
 	Conn     *net.UDPConn
 
+	// Faults is optional and injects faults on all received messages before they are dispatched
+	Faults *FaultInjector
+	// Keyring is optional and rejects all datagrams that are not encrypted with one of its keys
+	Keyring *Keyring
+	// Auth is optional and rejects all datagrams that are not signed by a known processor, as well as messages
+	// claiming to be sent by any other processor than the signer
+	Auth *Authenticator
+
+	// reassembler collects the fragments of messages larger than the buffer
+	reassembler *helpers.Reassembler
+
 	Metrics *serverMetrics
-	Count   int
+	// Count is the number of received packets, only access it atomically
+	Count int64
 }
 
 // Start starts the server and binds it to IP:PORT
 func (s *Server) Start() error {
-	s.Metrics = &serverMetrics{
-		ListenError:   "listen_error",
-		ReadError:     "read_error",
-		OversizeError: "oversize_error",
-		UnpackError:   "unpack_error",
-
-		ErrorCount: promauto.NewCounterVec(prometheus.CounterOpts{
-			Name: "udp_server_error_count",
-			Help: "The amount of errors emitted by the udp server",
-		}, []string{"error_type"}),
-		MsgCount: promauto.NewCounterVec(prometheus.CounterOpts{
-			Name: "udp_server_msg_count",
-			Help: "The amount messages received by this server",
-		}, []string{"sender_id"}),
-	}
+	// metrics are registered once and shared by all servers
+	s.Metrics = sharedServerMetrics
+	s.reassembler = helpers.NewReassembler(constants.ReassemblyTimeout, constants.MaxMessageSize)
 
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.IP, Port: s.Port})
 	if err != nil {
@@ -59,38 +108,143 @@ func (s *Server) Start() error {
 
 	log.Printf("UDP Server listening on %s\n", conn.LocalAddr().String())
 	s.Conn = conn
-	s.Count = 0
+	atomic.StoreInt64(&s.Count, 0)
 	return nil
 }
 
-// Listen tells the server to start listening for packets on IP:PORT
-func (s *Server) Listen() error {
+// Listen tells the server to start listening for packets on IP:PORT until ctx is cancelled. The socket is closed and
+// all messages being handled are drained before returning. Returns nil if stopped through ctx, otherwise the read error
+func (s *Server) Listen(ctx context.Context) error {
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
 	defer s.Conn.Close()
 
+	// close the socket once ctx is cancelled to unblock the pending read
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Conn.Close()
+		case <-stop:
+		}
+	}()
+
 	for {
-		buf := make([]byte, constants.ServerBufferSize)
-		n, _, err := s.Conn.ReadFromUDP(buf)
+		// read one byte more than allowed to detect datagrams that would be truncated
+		buf := make([]byte, constants.ServerBufferSize+1)
+		n, addr, err := s.Conn.ReadFromUDP(buf)
 
 		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("UDP Server on %s stopped\n", s.Conn.LocalAddr().String())
+				return nil
+			}
 			s.Metrics.ErrorCount.WithLabelValues(s.Metrics.ReadError).Inc()
-			log.Fatal(err)
-		} else if n > len(buf) {
+			return err
+		} else if n > constants.ServerBufferSize {
 			s.Metrics.ErrorCount.WithLabelValues(s.Metrics.OversizeError).Inc()
-			log.Fatalf("Got oversized message of size %d, max is %d", n, constants.ServerBufferSize)
+			log.Printf("Got oversized message of size %d, max is %d", n, constants.ServerBufferSize)
+			continue
 		}
 
 		// handle message in other goroutine and serve next client
-		go func(s *Server, bytes []byte) {
-			s.Count++
-
-			msg, err := helpers.Unpack(bytes)
-			if err != nil {
-				s.Metrics.ErrorCount.WithLabelValues(s.Metrics.UnpackError).Inc()
-				log.Printf("Could not unpack message. Got error: %v\n", err)
-			} else {
-				s.Metrics.MsgCount.WithLabelValues(strconv.Itoa(msg.Sender)).Inc()
-				s.Resolver.Dispatch(msg)
+		handlers.Add(1)
+		go func(s *Server, bytes []byte, source string) {
+			defer handlers.Done()
+			atomic.AddInt64(&s.Count, 1)
+
+			// decrypt and authenticate the datagram before looking at its content
+			var err error
+			if s.Keyring != nil {
+				if bytes, err = s.Keyring.Decrypt(bytes); err != nil {
+					s.reject(err, source)
+					return
+				}
+			}
+			signer := -1
+			if s.Auth != nil {
+				if signer, bytes, err = s.Auth.Verify(bytes); err != nil {
+					s.reject(err, source)
+					return
+				}
+				source = fmt.Sprintf("%s/%d", source, signer)
+			}
+
+			// wait for all fragments of a large message before unpacking it
+			if helpers.IsFragment(bytes) {
+				payload, err := s.reassembler.Add(source, bytes)
+				if err != nil {
+					s.Metrics.ErrorCount.WithLabelValues(s.Metrics.FragmentError).Inc()
+					log.Printf("Could not reassemble message. Got error: %v\n", err)
+					return
+				} else if payload == nil {
+					return
+				}
+				bytes = payload
 			}
-		}(s, buf[0:n])
+
+			// a batch holds several messages to the same receiver
+			if helpers.IsBatch(bytes) {
+				payloads, err := helpers.Unbatch(bytes)
+				if err != nil {
+					s.Metrics.ErrorCount.WithLabelValues(s.Metrics.BatchError).Inc()
+					log.Printf("Could not unbatch messages. Got error: %v\n", err)
+					return
+				}
+				for _, payload := range payloads {
+					s.handle(payload, signer)
+				}
+				return
+			}
+
+			s.handle(bytes, signer)
+		}(s, buf[0:n], addr.String())
 	}
 }
+
+// handle unpacks a message and dispatches it, signer is the processor that signed the message if authenticated
+func (s *Server) handle(bytes []byte, signer int) {
+	msg, err := helpers.Unpack(bytes)
+	if err != nil {
+		s.Metrics.ErrorCount.WithLabelValues(s.Metrics.UnpackError).Inc()
+		log.Printf("Could not unpack message. Got error: %v\n", err)
+		return
+	} else if s.Auth != nil && msg.Sender != signer {
+		s.Metrics.RejectedCount.WithLabelValues(s.Metrics.SenderMismatchRejection).Inc()
+		log.Printf("Rejected message from %d signed by %d\n", msg.Sender, signer)
+		return
+	}
+
+	s.Metrics.MsgCount.WithLabelValues(strconv.Itoa(msg.Sender)).Inc()
+	s.dispatch(msg)
+}
+
+// reject records a datagram from source that could not be decrypted or authenticated
+func (s *Server) reject(err error, source string) {
+	reasons := map[error]string{
+		helpers.ErrUnencrypted:   s.Metrics.UnencryptedRejection,
+		helpers.ErrUnknownKey:    s.Metrics.UnknownKeyRejection,
+		helpers.ErrDecrypt:       s.Metrics.DecryptRejection,
+		helpers.ErrUnsigned:      s.Metrics.UnsignedRejection,
+		helpers.ErrUnknownSigner: s.Metrics.UnknownSignerRejection,
+		helpers.ErrBadSignature:  s.Metrics.BadSignatureRejection,
+		helpers.ErrReplayed:      s.Metrics.ReplayedRejection,
+	}
+	reason := reasons[err]
+
+	s.Metrics.RejectedCount.WithLabelValues(reason).Inc()
+	log.Printf("Rejected datagram from %s: %v\n", source, err)
+}
+
+// dispatch hands over a received message to the resolver, through the fault injector if one is set
+func (s *Server) dispatch(msg *models.Message) {
+	if s.Faults == nil {
+		s.Resolver.Dispatch(msg)
+		return
+	}
+
+	s.Faults.Inject(Link{From: msg.Sender, To: s.ID}, func() {
+		s.Resolver.Dispatch(msg)
+	})
+}
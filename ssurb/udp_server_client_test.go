@@ -1,12 +1,19 @@
 package ssurb
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/helpers"
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
 	"gotest.tools/assert"
@@ -28,18 +35,39 @@ func constructClient() (*net.Conn, error) {
 		}
 	}
 
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", ipString, PORT))
+	conn, err := net.Dial("udp", net.JoinHostPort(ipString, strconv.Itoa(PORT)))
 	return &conn, err
 }
 
+// newClientConn opens a socket to send messages from
+func newClientConn(t testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", nil)
+	assert.NilError(t, err)
+	return conn
+}
+
+// send packs msg and writes it over conn to addr, fragmenting it if it does not fit in the buffer of the server. Unlike
+// UDPTransport, it neither batches, signs nor encrypts the message
+func send(conn *net.UDPConn, addr *net.UDPAddr, msg *models.Message, receiverID int) error {
+	payload, err := pack(msg, receiverID)
+	if err != nil {
+		return err
+	}
+	datagrams, err := fragment(payload, receiverID, constants.ServerBufferSize)
+	if err != nil {
+		return err
+	}
+	_, err = write(conn, addr, datagrams, receiverID)
+	return err
+}
+
 func TestSend(t *testing.T) {
 	// first check that server can be created and started
 	server := &Server{IP: IP, Port: PORT, Resolver: &r}
-	go func(t *testing.T, s *Server) {
-		err := server.Start()
-		assert.NilError(t, err)
-		server.Listen()
-	}(t, server)
+	assert.NilError(t, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
 
 	// then check that it is possible to connect to started server
 	clientConn, err := constructClient()
@@ -54,21 +82,23 @@ func TestSend(t *testing.T) {
 	}
 
 	// finally check that it is possible to send message
+	conn := newClientConn(t)
+	defer conn.Close()
 	addr := &net.UDPAddr{IP: IP, Port: PORT}
-	msg := models.Message{Type: models.MSG, Sender: 0, Data: map[string]interface{}{"foo": "bar"}}
-	err = send(addr, &msg, 1)
+	msg := models.Message{Type: models.MSG, Sender: 0, Data: &models.MSGData{J: 0, S: 1, Text: "foo"}}
+	err = send(conn, addr, &msg, 1)
 	assert.NilError(t, err)
-	send(addr, &msg, 1)
+	send(conn, addr, &msg, 1)
 	assert.NilError(t, err)
-	send(addr, &msg, 1)
+	send(conn, addr, &msg, 1)
 	assert.NilError(t, err)
-	send(addr, &msg, 1)
+	send(conn, addr, &msg, 1)
 	assert.NilError(t, err)
 
 	messagesDelivered := false
 	tries := 0
 	for !messagesDelivered && tries < 5 {
-		messagesDelivered = server.Count == 4
+		messagesDelivered = atomic.LoadInt64(&server.Count) == 4
 		if !messagesDelivered {
 			log.Println("Messages not delivered yet, sleeping 2s..")
 			time.Sleep(2 * time.Second)
@@ -77,3 +107,295 @@ func TestSend(t *testing.T) {
 	}
 	assert.Assert(t, messagesDelivered)
 }
+
+func TestListenStopsOnCancel(t *testing.T) {
+	server := &Server{IP: IP, Port: PORT + 1, Resolver: &r}
+	assert.NilError(t, server.Start())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- server.Listen(ctx)
+	}()
+
+	// cancelling the context should close the socket and make Listen return without error
+	cancel()
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+
+	// the port should be free to bind again
+	server = &Server{IP: IP, Port: PORT + 1, Resolver: &r}
+	assert.NilError(t, server.Start())
+	server.Conn.Close()
+}
+
+// chanResolver passes all dispatched messages on to a channel
+type chanResolver struct {
+	MockResolver
+	dispatched chan *models.Message
+}
+
+func (r *chanResolver) Dispatch(msg *models.Message) { r.dispatched <- msg }
+
+func TestSendLargeMessage(t *testing.T) {
+	resolver := &chanResolver{dispatched: make(chan *models.Message, 1)}
+	server := &Server{IP: IP, Port: PORT + 2, Resolver: resolver}
+	assert.NilError(t, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
+
+	conn := newClientConn(t)
+	defer conn.Close()
+
+	// a message way larger than the server buffer is fragmented and reassembled
+	text := strings.Repeat("0123456789", 5000)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: PORT + 2}
+	msg := models.Message{Type: models.MSG, Sender: 0, Data: &models.MSGData{J: 0, S: 1, Text: text}}
+	assert.NilError(t, send(conn, addr, &msg, 1))
+
+	select {
+	case received := <-resolver.dispatched:
+		assert.Equal(t, received.Data.(*models.MSGData).Text, text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("large message not delivered")
+	}
+
+	// messages larger than the max size are refused by the sender
+	msg.Data = &models.MSGData{J: 0, S: 2, Text: strings.Repeat("0", constants.MaxMessageSize)}
+	assert.ErrorContains(t, send(conn, addr, &msg, 1), "exceeds max size")
+}
+
+func TestUDPTransportResolvesHostname(t *testing.T) {
+	resolver := &chanResolver{dispatched: make(chan *models.Message, 1)}
+	server := &Server{IP: IP, Port: PORT + 3, Resolver: resolver}
+	assert.NilError(t, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
+
+	// the first lookup fails, the retry resolves the hostname
+	lookups := 0
+	helpers.LookupIP = func(host string) ([]net.IP, error) {
+		lookups++
+		if lookups == 1 {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+	}
+	defer func() { helpers.LookupIP = net.LookupIP }()
+
+	transport := &UDPTransport{Processors: []models.Processor{{ID: 1, Hostname: "node1.test", UDPPort: PORT + 3}}}
+	msg := models.Message{Type: models.MSGack, Sender: 0, Data: &models.MSGackData{J: 0, S: 1}}
+	transport.SendToProcessor(1, &msg)
+	assert.Equal(t, lookups, 2)
+	assert.DeepEqual(t, transport.Processors[0].IP, []byte{127, 0, 0, 1})
+
+	select {
+	case received := <-resolver.dispatched:
+		assert.Equal(t, received.Data.(*models.MSGackData).S, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered to the resolved address")
+	}
+}
+
+// skipWithoutIPv6 skips the test if no socket can be bound to the IPv6 loopback address
+func skipWithoutIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	conn.Close()
+}
+
+func TestServerIsDualStack(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	// a server bound to all addresses receives messages sent over both IPv4 and IPv6
+	resolver := &chanResolver{dispatched: make(chan *models.Message, 2)}
+	server := &Server{Port: PORT + 4, Resolver: resolver}
+	assert.NilError(t, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
+
+	conn := newClientConn(t)
+	defer conn.Close()
+	for i, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		msg := models.Message{Type: models.MSGack, Sender: 0, Data: &models.MSGackData{J: 0, S: i}}
+		assert.NilError(t, send(conn, &net.UDPAddr{IP: ip, Port: PORT + 4}, &msg, 1))
+
+		select {
+		case received := <-resolver.dispatched:
+			assert.Equal(t, received.Data.(*models.MSGackData).S, i)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message sent to %v not delivered", ip)
+		}
+	}
+}
+
+func TestUDPTransportQueues(t *testing.T) {
+	resolver := &chanResolver{dispatched: make(chan *models.Message, 200)}
+	server := &Server{IP: IP, Port: PORT + 5, Resolver: resolver}
+	assert.NilError(t, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
+
+	processors := []models.Processor{{ID: 1, IP: []byte{127, 0, 0, 1}, UDPPort: PORT + 5}, {ID: 2, IP: []byte{127, 0, 0, 1}, UDPPort: PORT + 6}}
+	transport := &UDPTransport{Processors: processors}
+
+	// all messages to a receiver are sent by the same goroutine over the same socket, nothing listens on PORT + 6
+	for i := 0; i < 100; i++ {
+		transport.Send(1, &models.Message{Type: models.MSGack, Sender: 0, Data: &models.MSGackData{J: 0, S: i}})
+		transport.Send(2, &models.Message{Type: models.MSGack, Sender: 0, Data: &models.MSGackData{J: 0, S: i}})
+	}
+	transport.Drain()
+	assert.Assert(t, transport.conn != nil)
+	assert.Equal(t, len(transport.queues), 2)
+	receive(t, resolver, 100)
+
+	// messages queued together are batched into fewer datagrams
+	assert.Assert(t, atomic.LoadInt64(&server.Count) < 100, "%d datagrams received", atomic.LoadInt64(&server.Count))
+
+	// closing stops all goroutines, the transport can be used again afterwards
+	transport.Close()
+	assert.Assert(t, transport.conn == nil)
+	transport.Send(1, &models.Message{Type: models.HBFDheartbeat, Sender: 0})
+	transport.Close()
+	receive(t, resolver, 1)
+}
+
+// receive waits for n messages to be dispatched to resolver
+func receive(t *testing.T, resolver *chanResolver, n int) []*models.Message {
+	msgs := []*models.Message{}
+	for len(msgs) < n {
+		select {
+		case msg := <-resolver.dispatched:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d out of %d messages dispatched", len(msgs), n)
+		}
+	}
+	return msgs
+}
+
+func TestUDPTransportBatchesIteration(t *testing.T) {
+	resolver := &chanResolver{dispatched: make(chan *models.Message, 100)}
+	server := &Server{IP: IP, Port: PORT + 9, Resolver: resolver}
+	assert.NilError(t, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
+
+	transport := &UDPTransport{Processors: []models.Processor{{ID: 1, IP: []byte{127, 0, 0, 1}, UDPPort: PORT + 9}}, BatchDelay: 50 * time.Millisecond}
+	defer transport.Close()
+
+	// one urb iteration sends gossip, the unacked messages and acks of received messages to every processor, along
+	// with one message too large to be batched
+	sent := []*models.Message{{Type: models.GOSSIP, Sender: 0, Data: &models.GOSSIPData{SeqJ: 20, TxObsSJ: 20}}}
+	for i := 1; i <= 20; i++ {
+		sent = append(sent, &models.Message{Type: models.MSG, Sender: 0, Data: &models.MSGData{J: 0, S: i, Text: "Hello world!"}})
+		sent = append(sent, &models.Message{Type: models.MSGack, Sender: 0, Data: &models.MSGackData{J: 1, S: i}})
+	}
+	sent = append(sent, &models.Message{Type: models.MSG, Sender: 0, Data: &models.MSGData{J: 0, S: 21, Text: strings.Repeat("a", 3000)}})
+	for _, msg := range sent {
+		transport.Send(1, msg)
+	}
+	transport.Drain()
+
+	// batched messages keep their order, the large one is reassembled independently
+	batched := []*models.Message{}
+	for _, msg := range receive(t, resolver, len(sent)) {
+		if data, ok := msg.Data.(*models.MSGData); ok && data.S == 21 {
+			assert.DeepEqual(t, msg, sent[len(sent)-1])
+		} else {
+			batched = append(batched, msg)
+		}
+	}
+	assert.DeepEqual(t, batched, sent[:len(sent)-1])
+
+	// 41 small messages fit in a single datagram, the large one takes 3 fragments
+	assert.Equal(t, atomic.LoadInt64(&server.Count), int64(4))
+}
+
+func TestUDPTransportQueueIsBounded(t *testing.T) {
+	// sending to a hostname that never resolves keeps the goroutine of the receiver busy retrying
+	helpers.LookupIP = func(host string) ([]net.IP, error) {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	defer func() { helpers.LookupIP = net.LookupIP }()
+
+	transport := &UDPTransport{Processors: []models.Processor{{ID: 1, Hostname: "node1.test"}}, QueueSize: 3}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		transport.Send(1, &models.Message{Type: models.HBFDheartbeat, Sender: 0})
+	}
+	assert.Equal(t, runtime.NumGoroutine()-before, 1)
+
+	// at most one message is being sent while the queue is full, all others are dropped without blocking
+	transport.mux.Lock()
+	queued := len(transport.queues[1])
+	transport.mux.Unlock()
+	assert.Assert(t, queued == 3 || queued == 2, "%d messages queued", queued)
+	transport.Close()
+}
+
+// legacySend sends msg the way the transport did before reusing its socket, i.e. dialing a new socket in a new
+// goroutine for every message
+func legacySend(inflight *sync.WaitGroup, addr *net.UDPAddr, msg *models.Message) {
+	inflight.Add(1)
+	go func() {
+		defer inflight.Done()
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		payload, _ := helpers.Pack(msg)
+		conn.Write(payload)
+	}()
+}
+
+// benchmarkSend reports the throughput of sending b.N messages to a local server and the number of goroutines
+// running once all of them are handed over to sendFn, drain must block until all messages are sent
+func benchmarkSend(b *testing.B, port int, sendFn func(msg *models.Message), drain func()) {
+	server := &Server{IP: IP, Port: port, Resolver: &MockResolver{}}
+	assert.NilError(b, server.Start())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Listen(ctx)
+
+	msg := &models.Message{Type: models.MSG, Sender: 0, Data: &models.MSGData{J: 0, S: 1, Text: "Hello world!"}}
+	before := runtime.NumGoroutine()
+	b.ResetTimer()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		sendFn(msg)
+	}
+	goroutines := runtime.NumGoroutine() - before
+	drain()
+
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "msgs/s")
+	b.ReportMetric(float64(goroutines), "goroutines")
+}
+
+func BenchmarkSendDialPerMessage(b *testing.B) {
+	var inflight sync.WaitGroup
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: PORT + 7}
+	benchmarkSend(b, PORT+7, func(msg *models.Message) { legacySend(&inflight, addr, msg) }, inflight.Wait)
+}
+
+func BenchmarkSendUDPTransport(b *testing.B) {
+	transport := &UDPTransport{Processors: []models.Processor{{ID: 1, IP: []byte{127, 0, 0, 1}, UDPPort: PORT + 8}}, QueueSize: b.N}
+	defer transport.Close()
+	benchmarkSend(b, PORT+8, func(msg *models.Message) { transport.Send(1, msg) }, transport.Drain)
+}
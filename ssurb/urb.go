@@ -1,7 +1,9 @@
 package ssurb
 
 import (
+	"context"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,15 +12,73 @@ import (
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+)
 
-	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+// Well-known keys of UrbMessage.Headers
+const (
+	// HeaderContentType is the media type of the payload
+	HeaderContentType = "content-type"
+	// HeaderTopic is the application topic the message belongs to
+	HeaderTopic = "topic"
+	// HeaderTraceID is used to follow a message through the system
+	HeaderTraceID = "trace-id"
 )
 
-var mux sync.Mutex
+// reservedHeaders are the keys of UrbMessage.Headers set by the urb module itself to order messages
+var reservedHeaders = []string{HeaderVectorClock, HeaderTotalOrder, HeaderTotalOrderPhase, HeaderTotalOrderInstance,
+	HeaderTotalOrderBallot, HeaderTotalOrderPromised, HeaderTotalOrderAccepted, HeaderTotalOrderPrevious,
+	HeaderTotalOrderOrdered}
+
+// ReservedHeader returns true if key is set by the urb module itself and must not be set by the application
+func ReservedHeader(key string) bool {
+	for _, reserved := range reservedHeaders {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
+}
 
-// UrbMessage is the type of the actual message that is sent from the app
+// withoutReservedHeaders returns headers without the reserved ones, copying them only if any are present so that the
+// headers of the caller are left untouched
+func withoutReservedHeaders(headers map[string]string) map[string]string {
+	for key := range headers {
+		if ReservedHeader(key) {
+			stripped := map[string]string{}
+			for k, v := range headers {
+				if !ReservedHeader(k) {
+					stripped[k] = v
+				}
+			}
+			return stripped
+		}
+	}
+	return headers
+}
+
+// UrbMessage is the type of the actual message that is sent from the app. Text, Payload and Headers are all optional
+// and carried unchanged to every processor delivering the message
 type UrbMessage struct {
-	Text string
+	Text    string
+	Payload []byte
+	Headers map[string]string
+}
+
+// Deliverer is implemented by the application layer to receive every message that is urb-delivered by the module.
+// Deliver is called once per message identifier if the module has a Store. Without one, a message is delivered again
+// if it is received after the buffer was flushed to recover from stale info, or after a restart. Deliver is called by
+// the do forever loop after it released the lock of the module, so blocking holds back the next iteration but not the
+// processing of messages received meanwhile
+type Deliverer interface {
+	Deliver(msg *UrbMessage, id Identifier)
+}
+
+// DelivererFunc is an adapter that allows an ordinary function to be used as a Deliverer
+type DelivererFunc func(msg *UrbMessage, id Identifier)
+
+// Deliver calls f(msg, id)
+func (f DelivererFunc) Deliver(msg *UrbMessage, id Identifier) {
+	f(msg, id)
 }
 
 type urbMetrics struct {
@@ -29,6 +89,32 @@ type urbMetrics struct {
 
 	// Throughput
 	MessageDeliveryTime prometheus.Gauge
+
+	// Ordering
+	HeldBackMessages prometheus.Gauge
+}
+
+var sharedUrbMetrics = &urbMetrics{
+	BroadcastedMessagesCount: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "urb_broadcasted_messages_count",
+		Help: "The total number of broadcasted messages",
+	}),
+	DeliveredMessagesCount: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "urb_delivered_messages_count",
+		Help: "The total number of delivered messages",
+	}),
+	DeliveredByteCount: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "urb_delivered_bytes_count",
+		Help: "The total number of delivered bytes",
+	}),
+	MessageDeliveryTime: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "urb_message_delivery_time",
+		Help: "Total time taken from broadcast to delivery of a message (throughput)",
+	}),
+	HeldBackMessages: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "urb_held_back_messages",
+		Help: "The number of messages acked by all trusted processors but held back to deliver them in order",
+	}),
 }
 
 // UrbModule models the URB algorithm in the paper
@@ -36,11 +122,32 @@ type UrbModule struct {
 	ID       int
 	P        []int
 	Resolver IResolver
+	Params   Params
+
+	// Deliverer receives all delivered messages, may be nil
+	Deliverer Deliverer
+	// Ordering is the order messages are delivered in
+	Ordering Ordering
 
+	// Store optionally persists the state of the module, so that it survives restarts
+	Store *Store
+
+	// mux guards all module state below
+	mux    sync.Mutex
 	Seq    int
 	Buffer *Buffer
-	RxObsS []int
-	TxObsS []int
+	// RxObsS and TxObsS are keyed by processor id
+	RxObsS map[int]int
+	TxObsS map[int]int
+
+	// iterations counts the iterations of the do forever loop
+	iterations int
+	// heldBack is the number of messages held back by the last iteration to deliver them in order
+	heldBack int
+	// total is the state of total ordering, created on first use
+	total *totalOrder
+	// deliveries holds the messages delivered while holding the lock, which are handed over once it is released
+	deliveries []Delivery
 
 	// Metrics stuff
 	Metrics         *urbMetrics
@@ -50,34 +157,19 @@ type UrbModule struct {
 // Init initializes the urb module
 func (m *UrbModule) Init() {
 	m.Seq = 0
-	m.Buffer = &Buffer{Records: []*BufferRecord{}}
-	m.RxObsS = []int{}
-	m.TxObsS = []int{}
-
-	for i := 0; i < len(m.P); i++ {
-		m.RxObsS = append(m.RxObsS, -1)
-		m.TxObsS = append(m.TxObsS, -1)
-	}
-
-	// init metrics
-	m.Metrics = &urbMetrics{
-		BroadcastedMessagesCount: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "urb_broadcasted_messages_count",
-			Help: "The total number of broadcasted messages",
-		}),
-		DeliveredMessagesCount: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "urb_delivered_messages_count",
-			Help: "The total number of delivered messages",
-		}),
-		DeliveredByteCount: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "urb_delivered_bytes_count",
-			Help: "The total number of delivered bytes",
-		}),
-		MessageDeliveryTime: promauto.NewGauge(prometheus.GaugeOpts{
-			Name: "urb_message_delivery_time",
-			Help: "Total time taken from broadcast to delivery of a message (throughput)",
-		}),
+	m.Buffer = NewBuffer()
+	m.total = nil
+	m.deliveries = nil
+	m.RxObsS = map[int]int{}
+	m.TxObsS = map[int]int{}
+
+	for _, id := range m.P {
+		m.RxObsS[id] = -1
+		m.TxObsS[id] = -1
 	}
+
+	// metrics are registered once and shared by all module instances
+	m.Metrics = sharedUrbMetrics
 	m.PendingMessages = map[*UrbMessage]int64{}
 }
 
@@ -98,23 +190,28 @@ func (m *UrbModule) obsolete(r *BufferRecord) bool {
 // maxSeq returns the highest buffered sequence number for messages sent by processor k.
 // should no such exist, -1 is returned
 func (m *UrbModule) maxSeq(k int) int {
-	max := -1
-	for _, record := range m.Buffer.Records {
-		if record.Identifier.ID == k && record.Identifier.Seq > max {
-			max = record.Identifier.Seq
-		}
-	}
-
-	return max
+	return m.Buffer.MaxSeq(k)
 }
 
 // BlockUntilAvailableSpace busy-waits until flow control mechanism ensures enough space on all trusted receivers
 func (m *UrbModule) BlockUntilAvailableSpace() {
-	for m.Seq >= m.minTxObsS()+constants.BufferUnitSize {
+	for !m.hasAvailableSpace() {
 		time.Sleep(time.Millisecond * 5)
 	}
 }
 
+// hasAvailableSpace returns true if the flow control mechanism allows this processor to broadcast another message
+func (m *UrbModule) hasAvailableSpace() bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.availableSpace()
+}
+
+// availableSpace is hasAvailableSpace for callers holding the lock
+func (m *UrbModule) availableSpace() bool {
+	return m.Seq < m.minTxObsS()+m.Params.bufferUnitSize()
+}
+
 // minTxObsS returns the smallest obsolete sequence number that pi had received from a trusted receiver
 func (m *UrbModule) minTxObsS() int {
 	trusted := m.Resolver.Trusted()
@@ -145,9 +242,9 @@ func (m *UrbModule) update(msg *UrbMessage, j int, s int, k int) {
 	// add record to buffer if new id and message is not nil
 	if r == nil && msg != nil {
 		recBy := map[int]bool{j: true, k: true}
-		prevHB := []int{}
-		for i := 0; i < len(m.P); i++ {
-			prevHB = append(prevHB, -1)
+		prevHB := map[int]int{}
+		for _, id := range m.P {
+			prevHB[id] = -1
 		}
 
 		newRecord := &BufferRecord{Msg: msg, Identifier: id, Delivered: false, RecBy: recBy, PrevHB: prevHB}
@@ -162,18 +259,36 @@ func (m *UrbModule) update(msg *UrbMessage, j int, s int, k int) {
 // NOTE call this in a separate goroutine
 func (m *UrbModule) UrbBroadcast(msg *UrbMessage) {
 	// grab lock
-	mux.Lock()
+	m.mux.Lock()
 
 	// busy-wait until flow control mechanism ensures enough space on all trusted receivers
-	// for m.Seq >= m.minTxObsS()+constants.BufferUnitSize {
+	// for m.Seq >= m.minTxObsS()+m.Params.bufferUnitSize() {
 	// 	// release lock, sleep and grab it again before next check
-	// 	mux.Unlock()
+	// 	m.mux.Unlock()
 	// 	time.Sleep(time.Millisecond * 20)
-	// 	mux.Lock()
+	// 	m.mux.Lock()
 	// }
 
+	// reserved headers of the application would be taken for the ones of the ordering
+	msg.Headers = withoutReservedHeaders(msg.Headers)
+	if m.Ordering == CausalOrdering {
+		m.attachVectorClock(msg)
+	}
+	m.broadcast(msg)
+
+	// release lock
+	m.mux.Unlock()
+}
+
+// broadcast adds msg to the buffer under the next sequence number. The caller must hold the lock
+func (m *UrbModule) broadcast(msg *UrbMessage) {
 	m.Seq++
 	m.update(msg, m.ID, m.Seq, m.ID)
+	if m.Store != nil {
+		if err := m.Store.LogBroadcast(Identifier{ID: m.ID, Seq: m.Seq}, msg); err != nil {
+			log.Printf("Could not log broadcast of %v. Got error: %v", msg, err)
+		}
+	}
 
 	// TODO use NTP time
 	// ts := helpers.GetNTPTime().UnixNano()
@@ -185,13 +300,11 @@ func (m *UrbModule) UrbBroadcast(msg *UrbMessage) {
 	m.Metrics.BroadcastedMessagesCount.Inc()
 
 	// log.Printf("broadcasted msg %v", msg)
-
-	// release lock
-	mux.Unlock()
 }
 
-// UrbDeliver delivers a message to the application layer
-func (m *UrbModule) UrbDeliver(msg *UrbMessage, id int) {
+// UrbDeliver delivers a message to the application layer, the caller must hold the lock. The message is handed to the
+// Deliverer once the lock is released, see handOver
+func (m *UrbModule) UrbDeliver(msg *UrbMessage, id Identifier) {
 	if !helpers.IsUnitTesting() && m.Metrics != nil {
 		if t1, exists := m.PendingMessages[msg]; exists {
 			// TODO use NTP time
@@ -202,51 +315,118 @@ func (m *UrbModule) UrbDeliver(msg *UrbMessage, id int) {
 		}
 
 		m.Metrics.DeliveredMessagesCount.Inc()
-		m.Metrics.DeliveredByteCount.Add(float64(len(msg.Text)))
+		m.Metrics.DeliveredByteCount.Add(float64(len(msg.Text) + len(msg.Payload)))
+	}
+
+	m.deliveries = append(m.deliveries, Delivery{Msg: msg, Identifier: id})
+}
+
+// handOver hands the messages delivered while holding the lock to the Deliverer without holding it, so that a slow
+// application does not stall the processing of received messages. Each delivery is logged once handed over, and all
+// entries logged by the iteration are synced to disk at once
+func (m *UrbModule) handOver() {
+	m.mux.Lock()
+	deliveries, deliverer, store := m.deliveries, m.Deliverer, m.Store
+	m.deliveries = nil
+	m.mux.Unlock()
+
+	for _, d := range deliveries {
+		if deliverer != nil {
+			deliverer.Deliver(d.Msg, d.Identifier)
+		}
+		if store != nil {
+			if err := store.LogDeliver(d.Identifier); err != nil {
+				log.Printf("Could not log delivery of %v. Got error: %v", d.Identifier, err)
+			}
+		}
+	}
+	if store != nil {
+		if err := store.Sync(); err != nil {
+			log.Printf("Could not sync store. Got error: %v", err)
+		}
 	}
 }
 
-// DoForever starts the algorithm and runs forever
-func (m *UrbModule) DoForever() {
+// DoForever starts the algorithm and runs until ctx is cancelled
+func (m *UrbModule) DoForever(ctx context.Context) {
 	for {
-		// retrieve lock
-		mux.Lock()
+		m.Step()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.Params.moduleRunSleepDuration()):
+		}
+	}
+}
 
-		// lines 18-19
-		m.flushBufferIfStaleInfo()
+// Step runs one iteration of the do forever loop
+func (m *UrbModule) Step() {
+	// retrieve lock
+	m.mux.Lock()
 
-		// line 20
-		m.checkTransmitWindow()
+	// lines 18-19
+	m.flushBufferIfStaleInfo()
+
+	// line 20
+	m.checkTransmitWindow()
 
-		// line 21
-		m.checkReceivingWindow()
+	// line 21
+	m.checkReceivingWindow()
 
-		// line 22
-		m.updateReceiverCounters()
+	// line 22
+	m.updateReceiverCounters()
 
-		// line 23
-		m.trimBuffer()
+	// line 23
+	m.trimBuffer()
+	m.pruneDeparted()
 
-		// lines 24-28
-		m.processMessages()
+	// lines 24-28
+	m.processMessages()
 
-		// line 29
-		m.gossip()
+	// line 29
+	m.gossip()
 
-		// release lock
-		mux.Unlock()
+	m.iterations++
+	snapshot := m.Store != nil && m.iterations%m.Params.snapshotInterval() == 0
 
-		time.Sleep(constants.ModuleRunSleepDuration)
+	// release lock
+	m.mux.Unlock()
+	m.handOver()
+
+	// the snapshot is taken once the deliveries of this iteration are logged, as it records them as delivered
+	if snapshot {
+		m.mux.Lock()
+		if m.Store != nil {
+			if err := m.Store.Snapshot(m); err != nil {
+				log.Printf("Could not snapshot state. Got error: %v", err)
+			}
+		}
+		m.mux.Unlock()
 	}
 }
 
+// IterationCount returns the number of iterations of the do forever loop run so far
+func (m *UrbModule) IterationCount() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.iterations
+}
+
+// HeldBackCount returns the number of messages held back by the last iteration to deliver them in order
+func (m *UrbModule) HeldBackCount() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.heldBack
+}
+
 // flushBufferIfStaleInfo flushes the buffer whenever records with msg == nil or two (or more) records with same msg identifier
 func (m *UrbModule) flushBufferIfStaleInfo() {
 	identifiers := map[Identifier]bool{}
 	flush := false
 
 	// lines 18-19
-	for _, r := range m.Buffer.Records {
+	for _, r := range m.Buffer.Records() {
 
 		// if empty message found, abort and flush
 		if r.Msg == nil {
@@ -266,7 +446,7 @@ func (m *UrbModule) flushBufferIfStaleInfo() {
 	}
 
 	if flush {
-		m.Buffer.Records = []*BufferRecord{}
+		m.Buffer.Clear()
 	}
 }
 
@@ -275,25 +455,23 @@ func (m *UrbModule) flushBufferIfStaleInfo() {
 func (m *UrbModule) checkTransmitWindow() {
 	mS := m.minTxObsS()
 
-	// build set of seqnums {mS+1, ..., Seq}
-	s := map[int]bool{}
-	for i := mS + 1; i <= m.Seq; i++ {
-		s[i] = true
-	}
-	// build second set of seqnums {s, ..., s'} s.t. id == i
-	s2 := map[int]bool{}
-	for _, r := range m.Buffer.Records {
-		if r.Identifier.ID == m.ID {
-			s2[r.Identifier.Seq] = true
+	// the seqnums {mS+1, ..., Seq} are all buffered if as many distinct ones of this node are buffered in that range,
+	// which is found without building the range since Seq may be arbitrarily far from mS
+	buffered := 0
+	last := mS
+	for _, r := range m.Buffer.Sender(m.ID) {
+		if s := r.Identifier.Seq; s > last && s <= m.Seq {
+			buffered++
+			last = s
 		}
 	}
 
 	// check if should allow this node to send bufferUnitSize messages without considering receivers
-	seqBound := mS <= m.Seq && m.Seq <= (mS+constants.BufferUnitSize)
-	subSet := isSubset(s, s2)
+	seqBound := mS <= m.Seq && m.Seq <= (mS+m.Params.bufferUnitSize())
+	subSet := buffered >= m.Seq-mS
 	if !(seqBound && subSet) {
 		if !seqBound {
-			log.Printf("setting all values in TxObsS to %d due to m.seq not being between mS (%d) and mS+bufferUnitSize (%d)", m.Seq, mS, mS+constants.BufferUnitSize)
+			log.Printf("setting all values in TxObsS to %d due to m.seq not being between mS (%d) and mS+bufferUnitSize (%d)", m.Seq, mS, mS+m.Params.bufferUnitSize())
 		} else if !subSet {
 			log.Printf("setting all values in TxObsS to %d due to seqnums ms+1..seq not in buffer", m.Seq)
 		}
@@ -308,54 +486,67 @@ func (m *UrbModule) checkTransmitWindow() {
 // is not larger than bufferUnitSize
 func (m *UrbModule) checkReceivingWindow() {
 	for _, k := range m.P {
-		m.RxObsS[k] = max(m.RxObsS[k], m.maxSeq(k)-constants.BufferUnitSize)
+		m.RxObsS[k] = max(m.RxObsS[k], m.maxSeq(k)-m.Params.bufferUnitSize())
 	}
 }
 
 // updateReceiverCounters updates the receiver-side counter that stores the highest obsolete message number per sender
 func (m *UrbModule) updateReceiverCounters() {
-	hasObsolete := true
-	for hasObsolete {
-		if r := m.hasObsoleteRecord(); r != nil {
-			m.RxObsS[r.Identifier.ID]++
-		} else {
-			hasObsolete = false
+	for _, k := range m.Buffer.Senders() {
+		for m.hasObsoleteRecord(k) != nil {
+			m.RxObsS[k]++
 		}
 	}
 }
 
-// trimBuffer makes sure buffer only contains sent messages that are not acked by all trusted or non-obsolete messages
+// trimBuffer makes sure buffer only contains sent messages that are not acked by all trusted or non-obsolete messages.
+// Records of processors that left the system are kept until they are obsolete as well, so that the messages they
+// broadcast before leaving are still delivered everywhere. Records of processors without any state are removed
 func (m *UrbModule) trimBuffer() {
-	newBuffer := Buffer{Records: []*BufferRecord{}}
+	mS := m.minTxObsS()
 
-	for _, r := range m.Buffer.Records {
+	m.Buffer.Filter(func(r *BufferRecord) bool {
 		if r.Identifier.ID == m.ID {
-			if m.minTxObsS() < r.Identifier.Seq {
-				newBuffer.Add(r)
-			} else {
-				log.Printf("removed msg %v from buffer since minTxObs (%d) >= seq (%d)", r.Msg, m.minTxObsS(), r.Identifier.Seq)
-			}
-		} else {
-			k := r.Identifier.ID
-			s := r.Identifier.Seq
-			if contains(m.P, k) && m.RxObsS[k] < s && m.maxSeq(k)-constants.BufferUnitSize <= s {
-				newBuffer.Add(r)
+			if mS < r.Identifier.Seq {
+				return true
 			}
+			log.Printf("removed msg %v from buffer since minTxObs (%d) >= seq (%d)", r.Msg, mS, r.Identifier.Seq)
+			return false
 		}
-	}
 
-	m.Buffer = &newBuffer
+		k := r.Identifier.ID
+		s := r.Identifier.Seq
+		rx, exists := m.RxObsS[k]
+		return exists && rx < s && m.maxSeq(k)-m.Params.bufferUnitSize() <= s
+	})
 }
 
 // processMessages delivers messages when acks from all trusted processors are present before sampling hb fd (used for re-transmission)
 func (m *UrbModule) processMessages() {
 	trusted := listToMap(m.Resolver.Trusted())
-	for _, r := range m.Buffer.Records {
-		if !r.Delivered && isSubset(trusted, r.RecBy) {
-			m.UrbDeliver(r.Msg, r.Identifier.ID)
+	if m.Ordering != NoOrdering {
+		if m.Ordering == TotalOrdering {
+			m.heldBack = m.deliverInTotalOrder(trusted)
+		} else {
+			m.heldBack = m.deliverInOrder(trusted)
+		}
+		if m.Metrics != nil {
+			m.Metrics.HeldBackMessages.Set(float64(m.heldBack))
 		}
-		r.Delivered = r.Delivered || isSubset(trusted, r.RecBy)
+	}
 
+	for _, r := range m.Buffer.Records() {
+		if m.Ordering == NoOrdering {
+			if !r.Delivered && isSubset(trusted, r.RecBy) {
+				m.persistAndDeliver(r.Msg, r.Identifier)
+			}
+			r.Delivered = r.Delivered || isSubset(trusted, r.RecBy)
+		}
+
+		// own messages are only sent once their broadcast is synced, so that they are never reused after a restart
+		if r.Identifier.ID == m.ID && m.Store != nil && !m.Store.Synced(r.Identifier.Seq) {
+			continue
+		}
 		u := m.Resolver.Hb()
 		for _, k := range m.P {
 			if _, exists := r.RecBy[k]; !exists || (r.Identifier.ID == m.ID && r.Identifier.Seq == m.TxObsS[k]+1) && r.PrevHB[k] < u[k] {
@@ -366,6 +557,116 @@ func (m *UrbModule) processMessages() {
 	}
 }
 
+// persistAndDeliver delivers msg unless the store knows it was delivered before a restart. The delivery is logged
+// once the deliverer returned, see handOver, so that a message is never recorded as delivered without having been
+// handed over
+func (m *UrbModule) persistAndDeliver(msg *UrbMessage, id Identifier) {
+	if m.Store != nil && m.Store.Delivered(id) {
+		return
+	}
+	m.UrbDeliver(msg, id)
+}
+
+// isMember returns true if processor id is part of the system
+func (m *UrbModule) isMember(id int) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return contains(m.P, id)
+}
+
+// setMembers replaces the set of processors. The ones joining start out with fresh per-processor state, also if they
+// were part of the system before, since a processor rejoining may have restarted and reuse its sequence numbers. Their
+// records from before are dropped. The state of the ones leaving is kept until their messages are obsolete, since
+// they may still be relayed by others, see pruneDeparted
+func (m *UrbModule) setMembers(P []int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	// joining receivers start out where all current receivers are, otherwise the transmit window check would reset
+	// TxObsS and drop all messages that are not yet delivered everywhere
+	mS := m.minTxObsS()
+	for _, k := range P {
+		if !contains(m.P, k) && k != m.ID {
+			if _, exists := m.RxObsS[k]; exists {
+				log.Printf("resetting state of processor %d rejoining the system", k)
+				m.Buffer.Filter(func(r *BufferRecord) bool { return r.Identifier.ID != k })
+				if m.Store != nil {
+					m.Store.forget(k)
+					if err := m.Store.Snapshot(m); err != nil {
+						log.Printf("Could not snapshot state. Got error: %v", err)
+					}
+				}
+			}
+			m.RxObsS[k] = -1
+			m.TxObsS[k] = max(-1, mS)
+			for _, r := range m.Buffer.Records() {
+				r.PrevHB[k] = -1
+			}
+		}
+		for _, r := range m.Buffer.Records() {
+			if _, exists := r.PrevHB[k]; !exists {
+				r.PrevHB[k] = -1
+			}
+		}
+	}
+
+	m.P = P
+}
+
+// pruneDeparted removes the counters of processors that left the system once none of their records are buffered
+// anymore, i.e. all of their messages are obsolete
+func (m *UrbModule) pruneDeparted() {
+	for _, counters := range []map[int]int{m.RxObsS, m.TxObsS} {
+		for k := range counters {
+			if k != m.ID && !contains(m.P, k) && len(m.Buffer.Sender(k)) == 0 {
+				delete(counters, k)
+			}
+		}
+	}
+}
+
+// hasState returns true if the module holds the counters of processor k, which is the case for members and for
+// processors that left while some of their messages are not obsolete yet
+func (m *UrbModule) hasState(k int) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	_, txOk := m.TxObsS[k]
+	_, rxOk := m.RxObsS[k]
+	return txOk && rxOk
+}
+
+// Recover restores the state of the module from s and persists all further changes to it, call it right after Init
+func (m *UrbModule) Recover(s *Store) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if err := s.Recover(m); err != nil {
+		return err
+	}
+	m.Store = s
+	return nil
+}
+
+// CloseStore snapshots the state of the module and closes its store, after which changes are no longer persisted.
+// Does nothing if the module has no store
+func (m *UrbModule) CloseStore() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.Store == nil {
+		return nil
+	}
+	s := m.Store
+	m.Store = nil
+	if err := s.Snapshot(m); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
 // gossip sends control info about max seq that pi stores for pk as well as info about max obsolete record for pk
 func (m *UrbModule) gossip() {
 	for _, k := range m.P {
@@ -376,85 +677,88 @@ func (m *UrbModule) gossip() {
 // --- communication methods ---
 
 func (m *UrbModule) sendMSG(receiverID int, msg *UrbMessage, j int, s int) {
-	data := map[string]interface{}{
-		"msgText": msg.Text,
-		"j":       j,
-		"s":       s,
-	}
+	data := &models.MSGData{J: j, S: s, Text: msg.Text, Payload: msg.Payload, Headers: msg.Headers}
 
 	message := models.Message{Type: models.MSG, Sender: m.ID, Data: data}
-	go SendToProcessor(receiverID, &message)
+	m.Resolver.Send(receiverID, &message)
 }
 
 func (m *UrbModule) sendMSGack(receiverID int, j int, s int) {
-	data := map[string]interface{}{
-		"j": j,
-		"s": s,
-	}
+	data := &models.MSGackData{J: j, S: s}
 
 	message := models.Message{Type: models.MSGack, Sender: m.ID, Data: data}
-	go SendToProcessor(receiverID, &message)
+	m.Resolver.Send(receiverID, &message)
 }
 
 func (m *UrbModule) sendGOSSIP(receiverID int, seqJ int, txObsSJ int, rxObsSJ int) {
-	data := map[string]interface{}{
-		"seqJ":    float64(seqJ),
-		"txObsSJ": float64(txObsSJ),
-		"rxObsSJ": float64(rxObsSJ),
-	}
+	data := &models.GOSSIPData{SeqJ: seqJ, TxObsSJ: txObsSJ, RxObsSJ: rxObsSJ}
 
 	message := models.Message{Type: models.GOSSIP, Sender: m.ID, Data: data}
 	if receiverID == m.ID {
-		// deliver directly if sending to self
-		go m.onGOSSIP(&message)
+		// apply directly if sending to self, the lock is already held by the caller
+		m.applyGOSSIP(m.ID, seqJ, txObsSJ, rxObsSJ)
 	} else {
-		go SendToProcessor(receiverID, &message)
+		m.Resolver.Send(receiverID, &message)
 	}
 }
 
 func (m *UrbModule) onMSG(msg *models.Message) {
 	k := msg.Sender
-	message := UrbMessage{Text: msg.Data["msgText"].(string)}
-	j := int(msg.Data["j"].(float64))
-	s := int(msg.Data["s"].(float64))
+	data := msg.Data.(*models.MSGData)
+	message := UrbMessage{Text: data.Text, Payload: data.Payload, Headers: data.Headers}
+	j := data.J
+	s := data.S
 
-	mux.Lock()
+	m.mux.Lock()
 	m.update(&message, j, s, k)
-	mux.Unlock()
+	m.mux.Unlock()
 
 	m.sendMSGack(k, j, s)
 }
 
 func (m *UrbModule) onMSGack(msg *models.Message) {
 	k := msg.Sender
-	j := int(msg.Data["j"].(float64))
-	s := int(msg.Data["s"].(float64))
+	data := msg.Data.(*models.MSGackData)
+	j := data.J
+	s := data.S
 
-	mux.Lock()
+	m.mux.Lock()
 	m.update(nil, j, s, k)
-	mux.Unlock()
+	m.mux.Unlock()
 }
 
 func (m *UrbModule) onGOSSIP(msg *models.Message) {
 	j := msg.Sender
-	seqJ := int(msg.Data["seqJ"].(float64))
-	txObsSJ := int(msg.Data["txObsSJ"].(float64))
-	rxObsSJ := int(msg.Data["rxObsSJ"].(float64))
+	data := msg.Data.(*models.GOSSIPData)
+	seqJ := data.SeqJ
+	txObsSJ := data.TxObsSJ
+	rxObsSJ := data.RxObsSJ
+
+	m.mux.Lock()
+	m.applyGOSSIP(j, seqJ, txObsSJ, rxObsSJ)
+	m.mux.Unlock()
+}
 
-	mux.Lock()
-	m.Seq = max(seqJ, m.Seq)
+// applyGOSSIP merges control info gossiped by processor j into the local state, the caller must hold the lock
+func (m *UrbModule) applyGOSSIP(j int, seqJ int, txObsSJ int, rxObsSJ int) {
+	// pj has made all our messages up to txObsSJ obsolete, so seq must not lag behind it. Otherwise pj ignores the
+	// messages we broadcast until seq catches up on its own, e.g. after a transient fault or a restart without a store
+	m.Seq = max(max(seqJ, txObsSJ), m.Seq)
 	m.TxObsS[j] = max(txObsSJ, m.TxObsS[j])
 	m.RxObsS[j] = max(rxObsSJ, m.RxObsS[j])
-	mux.Unlock()
 }
 
 // --- helper methods ---
 
-// hasObsoleteRecord returns the first found obsolete record, otherwise nil
-func (m *UrbModule) hasObsoleteRecord() *BufferRecord {
-	for _, r := range m.Buffer.Records {
-		if m.obsolete(r) {
-			return r
+// hasObsoleteRecord returns the first found obsolete record of processor k, otherwise nil. Only records with the
+// sequence number following RxObsS[k] can be obsolete, which are found through the ordered records of k
+func (m *UrbModule) hasObsoleteRecord(k int) *BufferRecord {
+	records := m.Buffer.Sender(k)
+	next := m.RxObsS[k] + 1
+	idx := sort.Search(len(records), func(i int) bool { return records[i].Identifier.Seq >= next })
+	for ; idx < len(records) && records[idx].Identifier.Seq == next; idx++ {
+		if m.obsolete(records[idx]) {
+			return records[idx]
 		}
 	}
 
@@ -9,7 +9,7 @@ import (
 
 func TestObsolete(t *testing.T) {
 	mod, resolver := bootstrap()
-	mod.RxObsS = []int{0, 1, 0, 0, 0, 0}
+	mod.RxObsS = map[int]int{0: 0, 1: 1, 2: 0, 3: 0, 4: 0, 5: 0}
 
 	// construct record that is considered to be obsolete
 	resolver.TrustedRet = []int{0, 1, 2}
@@ -50,7 +50,7 @@ func TestMaxSeq(t *testing.T) {
 
 func TestMinTxObsS(t *testing.T) {
 	mod, resolver := bootstrap()
-	mod.TxObsS = []int{4, 2, 5, 10, 0, 50}
+	mod.TxObsS = map[int]int{0: 4, 1: 2, 2: 5, 3: 10, 4: 0, 5: 50}
 	resolver.TrustedRet = []int{1, 3, 5}
 
 	// should return 2, since mod.TxObsS[1] is smallest value for x, x part of resolver.TrustedRet
@@ -65,13 +65,13 @@ func TestUpdate(t *testing.T) {
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 2, Seq: 0}, RecBy: map[int]bool{0: true, 2: true}})
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 2, Seq: 1}, RecBy: map[int]bool{0: true, 2: true}})
 
-	assert.Equal(t, len(mod.Buffer.Records), 3)
+	assert.Equal(t, mod.Buffer.Len(), 3)
 	// trying to update with a nil message with new identifier should result in buffer being unchanged
 	mod.update(nil, 3, 1, 3)
-	assert.Equal(t, len(mod.Buffer.Records), 3)
+	assert.Equal(t, mod.Buffer.Len(), 3)
 	// updating with proper message with new identifier should add to buffer
 	mod.update(&UrbMessage{Text: "Hello world"}, 3, 0, 3)
-	assert.Equal(t, len(mod.Buffer.Records), 4)
+	assert.Equal(t, mod.Buffer.Len(), 4)
 
 	// trying to update with a message whose identifier already exists should simply add j and k to recBy
 	mod.update(&UrbMessage{Text: "Hello world"}, 1, 0, 5)
@@ -1,8 +1,10 @@
 package ssurb
 
 import (
+	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
 	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
@@ -14,45 +16,108 @@ import (
 type MockResolver struct {
 	Modules    map[ModuleType]interface{}
 	TrustedRet []int
-	HbRet      []int
+	HbRet      map[int]int
 }
 
-func (r *MockResolver) Hb() []int                    { return r.HbRet }
-func (r *MockResolver) Trusted() []int               { return r.TrustedRet }
-func (r *MockResolver) UrbBroadcast(msg *UrbMessage) {}
-func (r *MockResolver) Dispatch(msg *models.Message) {}
+func (r *MockResolver) Hb() map[int]int                          { return r.HbRet }
+func (r *MockResolver) Trusted() []int                           { return r.TrustedRet }
+func (r *MockResolver) UrbBroadcast(msg *UrbMessage)             {}
+func (r *MockResolver) Dispatch(msg *models.Message)             {}
+func (r *MockResolver) Send(receiverID int, msg *models.Message) {}
+func (r *MockResolver) SetMembers(processors []models.Processor) {}
+
+// recordingResolver records all messages dispatched to it
+type recordingResolver struct {
+	MockResolver
+	dispatched []*models.Message
+}
+
+func (r *recordingResolver) Dispatch(msg *models.Message) { r.dispatched = append(r.dispatched, msg) }
 
 func bootstrap() (*UrbModule, *MockResolver) {
 	P := []int{0, 1, 2, 3, 4, 5}
 	seq := 0
 	buffer := Buffer{}
-	rxObsS := []int{}
-	txObsS := []int{}
-	zeroedSlice := []int{}
-	for i := 0; i < len(P); i++ {
-		rxObsS = append(rxObsS, -1)
-		txObsS = append(txObsS, -1)
-	}
+	rxObsS := constMap(P, -1)
+	txObsS := constMap(P, -1)
 	r := MockResolver{Modules: make(map[ModuleType]interface{})}
 	urbModule := UrbModule{ID: 0, P: P, Resolver: &r, Seq: seq, Buffer: &buffer, RxObsS: rxObsS, TxObsS: txObsS}
-	thetaModule := ThetafdModule{ID: 0, P: P, Resolver: &r, Vector: zeroedSlice}
-	hbfdModule := HbfdModule{ID: 0, P: P, Resolver: &r, Hb: zeroedSlice}
+	thetaModule := ThetafdModule{ID: 0, P: P, Resolver: &r, Vector: constMap(P, 0)}
+	hbfdModule := HbfdModule{ID: 0, P: P, Resolver: &r, Hb: constMap(P, 0)}
 
-	r.Modules[URB] = urbModule
-	r.Modules[THETAFD] = thetaModule
-	r.Modules[HBFD] = hbfdModule
+	r.Modules[URB] = &urbModule
+	r.Modules[THETAFD] = &thetaModule
+	r.Modules[HBFD] = &hbfdModule
 
 	helpers.SetUnitTestingEnv()
 	return &urbModule, &r
 }
 
+// bootstrapOrdering returns a module delivering in the given ordering whose receiving windows start at 0, along with
+// the identifiers of the messages it delivers
+func bootstrapOrdering(ordering Ordering) (*UrbModule, *MockResolver, *[]Identifier) {
+	mod, r := bootstrap()
+	mod.Metrics = sharedUrbMetrics
+	mod.PendingMessages = map[*UrbMessage]int64{}
+	mod.Ordering = ordering
+	mod.RxObsS = constMap(mod.P, 0)
+	delivered := []Identifier{}
+	mod.Deliverer = DelivererFunc(func(msg *UrbMessage, id Identifier) { delivered = append(delivered, id) })
+	return mod, r, &delivered
+}
+
+// processAndHandOver processes the buffered messages of mod and hands the ones it delivers over to its deliverer, like
+// an iteration of the do forever loop does
+func processAndHandOver(mod *UrbModule) {
+	mod.processMessages()
+	mod.handOver()
+}
+
+// addRecord adds a record of msg acked by recBy to the buffer of mod
+func addRecord(mod *UrbModule, msg *UrbMessage, id Identifier, recBy map[int]bool) {
+	mod.Buffer.Add(&BufferRecord{Msg: msg, Identifier: id, RecBy: recBy, PrevHB: constMap(mod.P, 0)})
+}
+
+// constMap returns a map from all ids to x
+func constMap(ids []int, x int) map[int]int {
+	m := map[int]int{}
+	for _, id := range ids {
+		m[id] = x
+	}
+	return m
+}
+
 func TestInit(t *testing.T) {
 	mod := UrbModule{ID: 0, P: []int{0, 1, 2}}
 	mod.Init()
 	assert.Equal(t, mod.Seq, 0)
-	assert.Equal(t, len(mod.Buffer.Records), 0)
-	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, []int{-1, -1, -1}))
-	assert.Assert(t, reflect.DeepEqual(mod.RxObsS, []int{-1, -1, -1}))
+	assert.Equal(t, mod.Buffer.Len(), 0)
+	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, map[int]int{0: -1, 1: -1, 2: -1}))
+	assert.Assert(t, reflect.DeepEqual(mod.RxObsS, map[int]int{0: -1, 1: -1, 2: -1}))
+}
+
+func TestModulesLockIndependently(t *testing.T) {
+	mod, _ := bootstrap()
+	mod2, _ := bootstrap()
+	mod2.PendingMessages = map[*UrbMessage]int64{}
+	mod2.Metrics = sharedUrbMetrics
+
+	// holding the lock of one module must not block another module in the same process
+	mod.mux.Lock()
+	defer mod.mux.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		mod2.UrbBroadcast(&UrbMessage{Text: "Hello world!"})
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		assert.Equal(t, mod2.Seq, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast blocked on lock of other module")
+	}
 }
 
 func TestFlushBufferIfStaleInfo(t *testing.T) {
@@ -61,43 +126,43 @@ func TestFlushBufferIfStaleInfo(t *testing.T) {
 	// add two records without stale info, should not be flushed
 	mod.Buffer.Add(&BufferRecord{Msg: &UrbMessage{}, Identifier: Identifier{ID: 1, Seq: 0}})
 	mod.Buffer.Add(&BufferRecord{Msg: &UrbMessage{}, Identifier: Identifier{ID: 2, Seq: 0}})
-	assert.Equal(t, len(mod.Buffer.Records), 2)
+	assert.Equal(t, mod.Buffer.Len(), 2)
 	mod.flushBufferIfStaleInfo()
-	assert.Equal(t, len(mod.Buffer.Records), 2)
+	assert.Equal(t, mod.Buffer.Len(), 2)
 
 	// add one record with empty msg, buffer should be flushed
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 1, Seq: 1}})
-	assert.Equal(t, len(mod.Buffer.Records), 3)
+	assert.Equal(t, mod.Buffer.Len(), 3)
 	mod.flushBufferIfStaleInfo()
-	assert.Equal(t, len(mod.Buffer.Records), 0)
+	assert.Equal(t, mod.Buffer.Len(), 0)
 
 	// add two non-stale records and one with a duplicate identifier, buffer should be flushed
 	mod.Buffer.Add(&BufferRecord{Msg: &UrbMessage{}, Identifier: Identifier{ID: 1, Seq: 0}})
 	mod.Buffer.Add(&BufferRecord{Msg: &UrbMessage{}, Identifier: Identifier{ID: 2, Seq: 0}})
 	mod.Buffer.Add(&BufferRecord{Msg: &UrbMessage{}, Identifier: Identifier{ID: 2, Seq: 0}})
-	assert.Equal(t, len(mod.Buffer.Records), 3)
+	assert.Equal(t, mod.Buffer.Len(), 3)
 	mod.flushBufferIfStaleInfo()
-	assert.Equal(t, len(mod.Buffer.Records), 0)
+	assert.Equal(t, mod.Buffer.Len(), 0)
 
 }
 
 func TestCheckTransmitWindow(t *testing.T) {
 	mod, resolver := bootstrap()
 	resolver.TrustedRet = []int{0, 1, 2}
-	initTx := []int{10, 5, 2, -1, -1, 1}
+	initTx := map[int]int{0: 10, 1: 5, 2: 2, 3: -1, 4: -1, 5: 1}
 	mod.TxObsS = initTx
 
 	// mod.TxObsS should get mod.Seq in all values since mod.Seq (1) < minTxObs (2)
 	mod.Seq = 1
 	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, initTx))
 	mod.checkTransmitWindow()
-	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, []int{1, 1, 1, 1, 1, 1}))
+	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, constMap(mod.P, 1)))
 
 	// mod.TxObsS should get mod.Seq in all values since mod.Seq (20) > minTxObs (2) + bufferUnitSize (10) = 12
 	mod.Seq = 12
-	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, []int{1, 1, 1, 1, 1, 1}))
+	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, constMap(mod.P, 1)))
 	mod.checkTransmitWindow()
-	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, []int{12, 12, 12, 12, 12, 12}))
+	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, constMap(mod.P, 12)))
 
 	// mod.TxObsS should get mod.Seq in all values since set of allowed seqnums not subset of msg seqnums sent by this processor
 	// set of allowed seqnums = {3, 4, 5}
@@ -108,7 +173,7 @@ func TestCheckTransmitWindow(t *testing.T) {
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 0, Seq: 5}})
 	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, initTx))
 	mod.checkTransmitWindow()
-	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, []int{5, 5, 5, 5, 5, 5}))
+	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, constMap(mod.P, 5)))
 
 	// mod.TxObsS should remain unchanged since all conditions hold up
 	// set of allowed seqnums = {3, 4, 5}
@@ -120,8 +185,13 @@ func TestCheckTransmitWindow(t *testing.T) {
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 0, Seq: 5}})
 	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, initTx))
 	mod.checkTransmitWindow()
-	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, []int{5, 5, 5, 5, 5, 5}))
+	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, constMap(mod.P, 5)))
 
+	// a corrupted seq far beyond the window is handled without going through the seqnums in between
+	mod.TxObsS = initTx
+	mod.Seq = math.MaxInt32
+	mod.checkTransmitWindow()
+	assert.Assert(t, reflect.DeepEqual(mod.TxObsS, constMap(mod.P, math.MaxInt32)))
 }
 
 func TestCheckReceivingWindow(t *testing.T) {
@@ -166,35 +236,61 @@ func TestTrimBuffer(t *testing.T) {
 	// should only keep the first record since its minTxObs < its seqnum
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 0, Seq: 13}, RecBy: map[int]bool{0: true, 1: true}})
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 0, Seq: 0}, RecBy: map[int]bool{0: true, 1: true}})
-	assert.Equal(t, len(mod.Buffer.Records), 2)
+	assert.Equal(t, mod.Buffer.Len(), 2)
+	mod.trimBuffer()
+	assert.Equal(t, mod.Buffer.Len(), 1)
+	assert.Equal(t, mod.Buffer.Records()[0].Identifier, Identifier{ID: 0, Seq: 13})
+
+	// add record of a processor the module holds no state of, should be removed
+	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 20, Seq: 3}, RecBy: map[int]bool{0: true, 1: true}})
+	assert.Equal(t, mod.Buffer.Len(), 2)
 	mod.trimBuffer()
-	assert.Equal(t, len(mod.Buffer.Records), 1)
-	assert.Equal(t, mod.Buffer.Records[0].Identifier, Identifier{ID: 0, Seq: 13})
+	assert.Equal(t, mod.Buffer.Len(), 1)
 
-	// add record with processor not part of P, should be removed
-	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 20, Seq: 0}, RecBy: map[int]bool{0: true, 1: true}})
-	assert.Equal(t, len(mod.Buffer.Records), 2)
+	// add record of a processor that left P, should be kept until it is obsolete
+	mod.P = []int{0, 1, 2, 4, 5}
+	mod.RxObsS[3] = 1
+	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 3, Seq: 2}, RecBy: map[int]bool{0: true, 3: true}})
+	mod.trimBuffer()
+	assert.Equal(t, mod.Buffer.Len(), 2)
+	mod.RxObsS[3] = 2
 	mod.trimBuffer()
-	assert.Equal(t, len(mod.Buffer.Records), 1)
+	assert.Equal(t, mod.Buffer.Len(), 1)
 
 	// add record with seqnum not > mod.rxObs[k], k = record.id
 	mod.RxObsS[1] = 5
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 1, Seq: 0}, RecBy: map[int]bool{0: true, 1: true}})
-	assert.Equal(t, len(mod.Buffer.Records), 2)
+	assert.Equal(t, mod.Buffer.Len(), 2)
 	mod.trimBuffer()
-	assert.Equal(t, len(mod.Buffer.Records), 1)
+	assert.Equal(t, mod.Buffer.Len(), 1)
 
 	// add record which seqnum is < maxSeq(k) - bufferUnitsize
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 1, Seq: 2}, RecBy: map[int]bool{0: true, 1: true}})
-	assert.Equal(t, len(mod.Buffer.Records), 2)
+	assert.Equal(t, mod.Buffer.Len(), 2)
 	mod.trimBuffer()
-	assert.Equal(t, len(mod.Buffer.Records), 1)
+	assert.Equal(t, mod.Buffer.Len(), 1)
 
 	// add record from other processor which should be kept in buffer
 	mod.Buffer.Add(&BufferRecord{Identifier: Identifier{ID: 1, Seq: 8}, RecBy: map[int]bool{0: true, 1: true}})
-	assert.Equal(t, len(mod.Buffer.Records), 2)
+	assert.Equal(t, mod.Buffer.Len(), 2)
 	mod.trimBuffer()
-	assert.Equal(t, len(mod.Buffer.Records), 2)
+	assert.Equal(t, mod.Buffer.Len(), 2)
+}
+
+func TestUrbBroadcastStripsReservedHeaders(t *testing.T) {
+	mod, _, _ := bootstrapOrdering(NoOrdering)
+
+	// reserved headers are removed without changing the headers of the caller, others are kept
+	headers := map[string]string{HeaderVectorClock: "1:9", HeaderTotalOrder: "1:1", HeaderTotalOrderPhase: "accept",
+		HeaderTotalOrderInstance: "1", HeaderTotalOrderBallot: "1:0", HeaderTotalOrderPromised: "1:0",
+		HeaderTotalOrderAccepted: "1:0", HeaderTotalOrderPrevious: "0:0", HeaderTotalOrderOrdered: "1:1",
+		HeaderTopic: "news"}
+	mod.UrbBroadcast(&UrbMessage{Headers: headers})
+	assert.DeepEqual(t, mod.Buffer.Get(Identifier{ID: 0, Seq: 1}).Msg.Headers, map[string]string{HeaderTopic: "news"})
+	assert.Equal(t, len(headers), 10)
+	for key := range headers {
+		assert.Equal(t, ReservedHeader(key), key != HeaderTopic, key)
+	}
 }
 
 func TestProcessMessages(t *testing.T) {
@@ -205,16 +301,39 @@ func TestProcessMessages(t *testing.T) {
 	buf := mod.Buffer
 	buf.Add(&BufferRecord{Msg: &UrbMessage{Text: "Hello world!"}, Identifier: Identifier{ID: 1, Seq: 0}, RecBy: map[int]bool{0: true}})
 	buf.Add(&BufferRecord{Msg: &UrbMessage{Text: "Hello world!"}, Identifier: Identifier{ID: 1, Seq: 1}, RecBy: map[int]bool{0: true, 1: true, 2: true}})
-	assert.Assert(t, !mod.Buffer.Records[0].Delivered)
-	assert.Assert(t, !mod.Buffer.Records[1].Delivered)
-	mod.processMessages()
-	assert.Assert(t, !mod.Buffer.Records[0].Delivered)
-	assert.Assert(t, mod.Buffer.Records[1].Delivered)
+	assert.Assert(t, !mod.Buffer.Records()[0].Delivered)
+	assert.Assert(t, !mod.Buffer.Records()[1].Delivered)
+	processAndHandOver(mod)
+	assert.Assert(t, !mod.Buffer.Records()[0].Delivered)
+	assert.Assert(t, mod.Buffer.Records()[1].Delivered)
 
 	// adding processor 1 to recBy makes trusted subset of recBy, should now be delivered
-	mod.Buffer.Records[0].RecBy[1] = true
-	mod.processMessages()
-	assert.Assert(t, mod.Buffer.Records[0].Delivered)
+	mod.Buffer.Records()[0].RecBy[1] = true
+	processAndHandOver(mod)
+	assert.Assert(t, mod.Buffer.Records()[0].Delivered)
+}
+
+func TestProcessMessagesDeliversOnce(t *testing.T) {
+	mod, resolver := bootstrap()
+	resolver.TrustedRet = []int{0, 1}
+
+	delivered := map[Identifier]int{}
+	mod.Deliverer = DelivererFunc(func(msg *UrbMessage, id Identifier) {
+		assert.Equal(t, msg.Text, "Hello world!")
+		delivered[id]++
+	})
+
+	// only the record acked by all trusted processors should reach the deliverer
+	mod.Buffer.Add(&BufferRecord{Msg: &UrbMessage{Text: "Hello world!"}, Identifier: Identifier{ID: 1, Seq: 0}, RecBy: map[int]bool{0: true}})
+	mod.Buffer.Add(&BufferRecord{Msg: &UrbMessage{Text: "Hello world!"}, Identifier: Identifier{ID: 2, Seq: 3}, RecBy: map[int]bool{0: true, 1: true}})
+	processAndHandOver(mod)
+	assert.Assert(t, reflect.DeepEqual(delivered, map[Identifier]int{{ID: 2, Seq: 3}: 1}))
+
+	// running processMessages again must not redeliver, but should deliver the newly acked record
+	mod.Buffer.Records()[0].RecBy[1] = true
+	processAndHandOver(mod)
+	processAndHandOver(mod)
+	assert.Assert(t, reflect.DeepEqual(delivered, map[Identifier]int{{ID: 1, Seq: 0}: 1, {ID: 2, Seq: 3}: 1}))
 }
 
 func TestHasObsoleteRecord(t *testing.T) {
@@ -223,15 +342,18 @@ func TestHasObsoleteRecord(t *testing.T) {
 	resolver.TrustedRet = []int{0, 1}
 
 	// buffer empty, should return nil
-	assert.Assert(t, mod.hasObsoleteRecord() == nil)
+	assert.Assert(t, mod.hasObsoleteRecord(1) == nil)
 
-	// add one record to buffer that has Delivered = false, i.e. not obsolete
+	// add records to buffer that have Delivered = false or are not next in line, i.e. not obsolete
 	mod.Buffer.Add(&BufferRecord{Delivered: false})
-	assert.Assert(t, mod.hasObsoleteRecord() == nil)
+	mod.Buffer.Add(&BufferRecord{Delivered: false, Identifier: Identifier{ID: 1, Seq: 2}, RecBy: map[int]bool{0: true, 1: true}})
+	mod.Buffer.Add(&BufferRecord{Delivered: true, Identifier: Identifier{ID: 1, Seq: 3}, RecBy: map[int]bool{0: true, 1: true}})
+	assert.Assert(t, mod.hasObsoleteRecord(0) == nil)
+	assert.Assert(t, mod.hasObsoleteRecord(1) == nil)
 
 	// add another record to buffer that is obsolete, make sure that record is returned by hasObsoleteRecord
 	r := BufferRecord{Delivered: true, Identifier: Identifier{ID: 1, Seq: 2}, RecBy: map[int]bool{0: true, 1: true}}
 	mod.Buffer.Add(&r)
-	assert.Assert(t, mod.hasObsoleteRecord() != nil)
-	assert.Equal(t, mod.hasObsoleteRecord().Identifier, Identifier{ID: 1, Seq: 2})
+	assert.Assert(t, mod.hasObsoleteRecord(1) != nil)
+	assert.Equal(t, mod.hasObsoleteRecord(1), &r)
 }
@@ -0,0 +1,124 @@
+package ssurb
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+type validationMetrics struct {
+	UnknownType     string
+	MissingField    string
+	UnknownSender   string
+	IndexOutOfRange string
+
+	RejectedCount *prometheus.CounterVec
+}
+
+var sharedValidationMetrics = &validationMetrics{
+	UnknownType:     "unknown_type",
+	MissingField:    "missing_field",
+	UnknownSender:   "unknown_sender",
+	IndexOutOfRange: "index_out_of_range",
+
+	RejectedCount: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rejected_message_count",
+		Help: "The amount of inbound messages rejected before being dispatched",
+	}, []string{"reason"}),
+}
+
+// ValidationError is returned for inbound messages that must not be dispatched, Reason labels the rejection metric
+type ValidationError struct {
+	Reason string
+	Msg    *models.Message
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Rejected message %+v: %s", *e.Msg, e.Reason)
+}
+
+// Validate checks that an inbound message is well-formed and only refers to processors known to the modules, so that
+// handling it can not crash the node. Returns a *ValidationError otherwise
+func (r *Resolver) Validate(m *models.Message) error {
+	reject := func(reason string) error {
+		return &ValidationError{Reason: reason, Msg: m}
+	}
+
+	// the payload must match the type, heartbeats carry none
+	var indices []int
+	switch m.Type {
+	case models.MSG:
+		data, ok := m.Data.(*models.MSGData)
+		if !ok || data == nil {
+			return reject(sharedValidationMetrics.MissingField)
+		}
+		indices = []int{data.J}
+	case models.MSGack:
+		data, ok := m.Data.(*models.MSGackData)
+		if !ok || data == nil {
+			return reject(sharedValidationMetrics.MissingField)
+		}
+		indices = []int{data.J}
+	case models.GOSSIP:
+		data, ok := m.Data.(*models.GOSSIPData)
+		if !ok || data == nil {
+			return reject(sharedValidationMetrics.MissingField)
+		}
+	case models.RECONF:
+		data, ok := m.Data.(*models.RECONFData)
+		if !ok || data == nil || len(data.Processors) == 0 {
+			return reject(sharedValidationMetrics.MissingField)
+		}
+		ids := map[int]bool{}
+		for _, p := range data.Processors {
+			if ids[p.ID] {
+				return reject(sharedValidationMetrics.IndexOutOfRange)
+			}
+			ids[p.ID] = true
+		}
+		if data.Epoch < 0 || data.Epoch > MaxEpoch || !ids[data.Proposer] {
+			return reject(sharedValidationMetrics.IndexOutOfRange)
+		}
+	case models.HBFDheartbeat, models.THETAheartbeat:
+	default:
+		return reject(sharedValidationMetrics.UnknownType)
+	}
+
+	urbModule := r.GetUrbModule()
+	if !urbModule.isMember(m.Sender) {
+		return reject(sharedValidationMetrics.UnknownSender)
+	}
+
+	// the sender must have state in all modules, the processors referred to in the payload only in the urb module.
+	// The latter may have left the system, whose messages are still relayed until they are obsolete
+	if !r.inRange(m.Sender) {
+		return reject(sharedValidationMetrics.IndexOutOfRange)
+	}
+	for _, idx := range indices {
+		if !urbModule.hasState(idx) {
+			return reject(sharedValidationMetrics.IndexOutOfRange)
+		}
+	}
+
+	return nil
+}
+
+// inRange returns true if all modules hold state of processor id
+func (r *Resolver) inRange(id int) bool {
+	urbOk := r.GetUrbModule().hasState(id)
+
+	hbfdModule := r.Modules[HBFD].(*HbfdModule)
+	hbfdModule.mux.Lock()
+	_, hbfdOk := hbfdModule.Hb[id]
+	hbfdModule.mux.Unlock()
+
+	thetafdModule := r.Modules[THETAFD].(*ThetafdModule)
+	thetafdModule.mux.Lock()
+	_, thetafdOk := thetafdModule.Vector[id]
+	thetafdModule.mux.Unlock()
+
+	return urbOk && hbfdOk && thetafdOk
+}
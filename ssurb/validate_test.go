@@ -0,0 +1,80 @@
+package ssurb
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/constants"
+	"github.com/axelniklasson/self-stabilizing-uniform-reliable-broadcast/models"
+)
+
+func TestValidateAcceptsWellFormedMessages(t *testing.T) {
+	s := NewSimulator(3)
+	r := s.Nodes[0].Resolver
+
+	messages := []models.Message{
+		{Type: models.MSG, Sender: 1, Data: &models.MSGData{J: 1, S: 1, Text: "foo"}},
+		{Type: models.MSGack, Sender: 2, Data: &models.MSGackData{J: 0, S: 1}},
+		{Type: models.GOSSIP, Sender: 1, Data: &models.GOSSIPData{SeqJ: 1, TxObsSJ: 0, RxObsSJ: 0}},
+		{Type: models.HBFDheartbeat, Sender: 2},
+		{Type: models.THETAheartbeat, Sender: 0},
+	}
+	for _, msg := range messages {
+		assert.NilError(t, r.Validate(&msg))
+	}
+}
+
+func TestValidateRejectsMalformedMessages(t *testing.T) {
+	s := NewSimulator(3)
+	r := s.Nodes[0].Resolver
+
+	// a processor outside of P that slipped into the state of a module
+	s.Nodes[0].Urb.P = []int{0, 1, 2, 3}
+
+	cases := map[string]models.Message{
+		sharedValidationMetrics.UnknownType:     {Type: models.MessageType(42), Sender: 1},
+		sharedValidationMetrics.MissingField:    {Type: models.MSG, Sender: 1},
+		sharedValidationMetrics.UnknownSender:   {Type: models.HBFDheartbeat, Sender: 7},
+		sharedValidationMetrics.IndexOutOfRange: {Type: models.THETAheartbeat, Sender: 3},
+	}
+	for reason, msg := range cases {
+		err := r.Validate(&msg)
+		assert.Assert(t, err != nil, reason)
+		assert.Equal(t, err.(*ValidationError).Reason, reason)
+	}
+
+	// payloads of the wrong type or referring to unknown processors
+	invalid := []models.Message{
+		{Type: models.MSGack, Sender: 1, Data: &models.MSGData{}},
+		{Type: models.GOSSIP, Sender: 1, Data: (*models.GOSSIPData)(nil)},
+		{Type: models.MSG, Sender: 1, Data: &models.MSGData{J: -1}},
+		{Type: models.MSGack, Sender: 1, Data: &models.MSGackData{J: 5}},
+		{Type: models.HBFDheartbeat, Sender: -1},
+	}
+	for _, msg := range invalid {
+		assert.Assert(t, r.Validate(&msg) != nil, "%+v", msg)
+	}
+
+	// gossip about messages of this processor beyond its seq is valid, it catches up on it after losing its state
+	s.Nodes[0].Urb.Seq = 5
+	assert.NilError(t, r.Validate(&models.Message{Type: models.GOSSIP, Sender: 1,
+		Data: &models.GOSSIPData{SeqJ: 5 + 3*constants.BufferUnitSize, TxObsSJ: 5 + 3*constants.BufferUnitSize}}))
+}
+
+func TestDispatchDropsInvalidMessages(t *testing.T) {
+	s := NewSimulator(3)
+	node := s.Nodes[0]
+
+	// none of these may crash the node or touch its state
+	node.Resolver.Dispatch(&models.Message{Type: models.MessageType(42), Sender: 1})
+	node.Resolver.Dispatch(&models.Message{Type: models.MSG, Sender: 1})
+	node.Resolver.Dispatch(&models.Message{Type: models.MSG, Sender: 1, Data: &models.MSGData{J: 9, S: 1}})
+	node.Resolver.Dispatch(&models.Message{Type: models.HBFDheartbeat, Sender: 9})
+	assert.Equal(t, node.Urb.Buffer.Len(), 0)
+	assert.DeepEqual(t, node.Hbfd.HB(), map[int]int{0: 0, 1: 0, 2: 0})
+
+	// valid messages are still dispatched
+	node.Resolver.Dispatch(&models.Message{Type: models.MSG, Sender: 1, Data: &models.MSGData{J: 1, S: 1, Text: "foo"}})
+	assert.Equal(t, node.Urb.Buffer.Len(), 1)
+}